@@ -35,4 +35,9 @@ integration {
     name = "UTM zip"
     slug = "zip"
   }
+  component {
+    type = "post-processor"
+    name = "UTM vagrant"
+    slug = "vagrant"
+  }
 }
@@ -5,8 +5,6 @@ package common
 
 import (
 	"fmt"
-	"os"
-	"path/filepath"
 
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
 )
@@ -20,9 +18,11 @@ type artifact struct {
 	// The ID of the artifact, which is the name of the VM
 	id string
 	// The directory containing the VM files (.utm)
-	dir string
+	dir OutputDir
 	// The files in the directory
 	f []string
+	// No image was produced, the VM ran in disposable mode
+	disposable bool
 
 	// StateData should store data such as GeneratedData
 	// to be shared with post-processors
@@ -32,20 +32,9 @@ type artifact struct {
 // NewArtifact returns a UTM artifact containing a .utm
 // directory (file for UTM, which can be imported into UTM).
 // in the given output directory
-func NewArtifact(dir string, vmName string, generatedData map[string]interface{}) (packersdk.Artifact, error) {
-	files := make([]string, 0, 5)
-	visit := func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			files = append(files, path)
-		}
-
-		return err
-	}
-
-	if err := filepath.Walk(dir, visit); err != nil {
+func NewArtifact(dir OutputDir, vmName string, generatedData map[string]interface{}) (packersdk.Artifact, error) {
+	files, err := dir.ListFiles()
+	if err != nil {
 		return nil, err
 	}
 
@@ -57,6 +46,16 @@ func NewArtifact(dir string, vmName string, generatedData map[string]interface{}
 	}, nil
 }
 
+// NewDisposableArtifact returns an artifact without files, for the
+// builds which ran the VM in disposable mode and produced no image.
+func NewDisposableArtifact(vmName string, generatedData map[string]interface{}) packersdk.Artifact {
+	return &artifact{
+		id:         vmName,
+		disposable: true,
+		StateData:  generatedData,
+	}
+}
+
 func (*artifact) BuilderId() string {
 	return BuilderId
 }
@@ -70,6 +69,9 @@ func (a *artifact) Id() string {
 }
 
 func (a *artifact) String() string {
+	if a.disposable {
+		return fmt.Sprintf("No image was produced: VM %s ran in disposable mode and its changes were discarded", a.id)
+	}
 	return fmt.Sprintf("VM (.utm file) is in directory : %s", a.dir)
 }
 
@@ -78,5 +80,8 @@ func (a *artifact) State(name string) interface{} {
 }
 
 func (a *artifact) Destroy() error {
-	return os.RemoveAll(a.dir)
+	if a.disposable {
+		return nil
+	}
+	return a.dir.RemoveAll()
 }
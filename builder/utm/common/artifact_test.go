@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
@@ -33,7 +34,9 @@ func TestNewArtifact(t *testing.T) {
 	}
 
 	generatedData := map[string]interface{}{"generated_data": "data"}
-	a, err := NewArtifact(td, "vm_name", generatedData)
+	dir := &LocalOutputDir{}
+	dir.SetOutputDir(td)
+	a, err := NewArtifact(dir, "vm_name", generatedData)
 	if err != nil {
 		t.Fatalf("err: %s", err)
 	}
@@ -48,3 +51,17 @@ func TestNewArtifact(t *testing.T) {
 		t.Fatalf("bad: should length have generated_data: %s", a.State("generated_data"))
 	}
 }
+
+func TestNewDisposableArtifact(t *testing.T) {
+	a := NewDisposableArtifact("vm_name", map[string]interface{}{"generated_data": "data"})
+
+	if len(a.Files()) != 0 {
+		t.Fatalf("should have no files: %#v", a.Files())
+	}
+	if !strings.Contains(a.String(), "No image was produced") {
+		t.Fatalf("bad: %s", a.String())
+	}
+	if err := a.Destroy(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
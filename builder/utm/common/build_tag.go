@@ -0,0 +1,164 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Every VM imported by a build carries a line starting with this prefix
+// in its notes, so VMs left behind by a killed Packer can be found.
+const buildTagPrefix = "packer-plugin-utm build: "
+
+// BuildTag identifies the Packer process which imported a VM.
+type BuildTag struct {
+	// The machine running Packer, which may not be the UTM host
+	Host string `json:"host"`
+	// The boot of the machine and the PID namespace of the process, in
+	// which PID is unique. Containers may share a host name, not these.
+	Namespace string    `json:"namespace,omitempty"`
+	PID       int       `json:"pid"`
+	Created   time.Time `json:"created"`
+}
+
+// NewBuildTag returns the tag of this process.
+func NewBuildTag() (*BuildTag, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &BuildTag{
+		Host:      host,
+		Namespace: ProcessNamespace(),
+		PID:       os.Getpid(),
+		Created:   time.Now().UTC().Truncate(time.Second),
+	}, nil
+}
+
+// ProcessNamespace identifies the boot of this machine and, on Linux,
+// the PID namespace of this process. It is empty when it can't be told.
+func ProcessNamespace() string {
+	switch runtime.GOOS {
+	case "linux":
+		boot, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+		if err != nil {
+			return ""
+		}
+		ns, err := os.Readlink("/proc/self/ns/pid")
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(boot)) + " " + ns
+	case "darwin":
+		// Like "{ sec = 1700000000, usec = 0 } Tue Nov 14 22:13:20 2023"
+		out, err := exec.Command("sysctl", "-n", "kern.boottime").Output()
+		if err != nil {
+			return ""
+		}
+		boot, _, found := strings.Cut(string(out), "}")
+		if !found {
+			return ""
+		}
+		return strings.TrimSpace(strings.TrimPrefix(boot, "{"))
+	}
+	return ""
+}
+
+// ParseBuildTag parses a line of VM notes written by BuildTag.String.
+func ParseBuildTag(line string) (*BuildTag, error) {
+	if !strings.HasPrefix(line, buildTagPrefix) {
+		return nil, fmt.Errorf("not a build tag: %q", line)
+	}
+	tag := new(BuildTag)
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, buildTagPrefix)), tag); err != nil {
+		return nil, fmt.Errorf("error parsing build tag %q: %s", line, err)
+	}
+	return tag, nil
+}
+
+func (t *BuildTag) String() string {
+	data, _ := json.Marshal(t)
+	return buildTagPrefix + string(data)
+}
+
+// Orphaned tells whether the process which created the tag is gone and
+// the tag is older than minAge, and why not if it is not. Processes of
+// other machines, of other PID namespaces such as other containers, or
+// of an unknown namespace cannot be checked from host and namespace, so
+// their VMs are never orphaned.
+func (t *BuildTag) Orphaned(host string, namespace string, now time.Time, minAge time.Duration) (bool, string) {
+	if t.Host != host {
+		return false, fmt.Sprintf("created on another machine (%s)", t.Host)
+	}
+	if t.Namespace == "" || namespace == "" {
+		return false, "the PID namespace of its process is unknown"
+	}
+	if t.Namespace != namespace {
+		return false, fmt.Sprintf("created in another boot or PID namespace (%s)", t.Namespace)
+	}
+	if processExists(t.PID) {
+		return false, fmt.Sprintf("process %d is still running", t.PID)
+	}
+	if age := now.Sub(t.Created); age < minAge {
+		return false, fmt.Sprintf("created %s ago, less than %s", age.Truncate(time.Second), minAge)
+	}
+	return true, ""
+}
+
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// TaggedVM is a VM carrying a build tag.
+type TaggedVM struct {
+	UUID string
+	Tag  *BuildTag
+}
+
+// ListTaggedVMs returns the VMs carrying a build tag. Tags which cannot
+// be parsed are skipped.
+func ListTaggedVMs(ctx context.Context, driver Driver) ([]TaggedVM, []error, error) {
+	output, err := driver.ExecuteOsaScript(ctx, "list_build_tags.applescript", buildTagPrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var vms []TaggedVM
+	var errs []error
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+		uuid, tagLine, found := strings.Cut(line, "\t")
+		if !found {
+			errs = append(errs, fmt.Errorf("unexpected output: %q", line))
+			continue
+		}
+		tag, err := ParseBuildTag(tagLine)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("VM %s: %s", uuid, err))
+			continue
+		}
+		vms = append(vms, TaggedVM{UUID: uuid, Tag: tag})
+	}
+	return vms, errs, nil
+}
+
+// SetBuildTag replaces the build tag of the (stopped) VM by tag,
+// or removes it if tag is nil.
+func SetBuildTag(ctx context.Context, driver Driver, vmName string, tag *BuildTag) error {
+	command := []string{"set_build_tag.applescript", vmName, buildTagPrefix}
+	if tag != nil {
+		command = append(command, tag.String())
+	}
+	_, err := driver.ExecuteOsaScript(ctx, command...)
+	return err
+}
@@ -0,0 +1,62 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBuildTag_roundTrip(t *testing.T) {
+	tag, err := NewBuildTag()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	parsed, err := ParseBuildTag(tag.String())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if *parsed != *tag {
+		t.Fatalf("bad: %#v", parsed)
+	}
+
+	if _, err := ParseBuildTag("some user notes"); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestBuildTag_Orphaned(t *testing.T) {
+	now := time.Now()
+	tag := &BuildTag{Host: "builder", Namespace: "ns", PID: os.Getpid(), Created: now.Add(-2 * time.Hour)}
+
+	if orphaned, _ := tag.Orphaned("builder", "ns", now, time.Hour); orphaned {
+		t.Fatal("the process is running")
+	}
+	if orphaned, _ := tag.Orphaned("other", "ns", now, time.Hour); orphaned {
+		t.Fatal("processes of other machines cannot be checked")
+	}
+
+	// No process has a negative pid
+	tag.PID = -1 << 30
+	if orphaned, reason := tag.Orphaned("builder", "ns", now, time.Hour); !orphaned {
+		t.Fatalf("should be orphaned: %s", reason)
+	}
+	if orphaned, _ := tag.Orphaned("builder", "ns", now, 3*time.Hour); orphaned {
+		t.Fatal("too recent")
+	}
+
+	// Containers sharing a host name have their own PIDs
+	if orphaned, _ := tag.Orphaned("builder", "other-ns", now, time.Hour); orphaned {
+		t.Fatal("processes of other PID namespaces cannot be checked")
+	}
+	if orphaned, _ := tag.Orphaned("builder", "", now, time.Hour); orphaned {
+		t.Fatal("processes of an unknown PID namespace cannot be checked")
+	}
+	tag.Namespace = ""
+	if orphaned, _ := tag.Orphaned("builder", "ns", now, time.Hour); orphaned {
+		t.Fatal("tags without a PID namespace cannot be checked")
+	}
+}
@@ -0,0 +1,99 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// The name of the checkpoint file in the output directory.
+const CheckpointFilename = "packer-checkpoint.json"
+
+// The phases a checkpoint records, in the order a build completes them.
+// There is no phase between two provisioners: Packer runs them all
+// through a single call of the provision hook, the builder can't tell
+// when one of them is done.
+const (
+	// The VM is registered with UTM under the checkpoint VM name
+	CheckpointImported = "imported"
+	// The provisioners all ran in the VM
+	CheckpointProvisioned = "provisioned"
+)
+
+var checkpointPhases = []string{CheckpointImported, CheckpointProvisioned}
+
+// Checkpoint records the progress of a build, so an interrupted build
+// can be resumed by the next run of the same template.
+type Checkpoint struct {
+	// The build and the source it was started from, which the
+	// resuming build must match
+	BuildName string `json:"build_name"`
+	Source    string `json:"source"`
+	// The VM the build runs in
+	VMName string `json:"vm_name"`
+	// The last completed phase
+	Phase   string    `json:"phase"`
+	Updated time.Time `json:"updated"`
+}
+
+// Reached tells whether the build completed phase.
+func (c *Checkpoint) Reached(phase string) bool {
+	return checkpointPhaseIndex(c.Phase) >= checkpointPhaseIndex(phase)
+}
+
+// Matches tells why a build of buildName from source can't resume from
+// the checkpoint, or returns an empty string when it can.
+func (c *Checkpoint) Matches(buildName string, source string) string {
+	if c.BuildName != buildName {
+		return fmt.Sprintf("it was written by build %q", c.BuildName)
+	}
+	if c.Source != source {
+		return fmt.Sprintf("the build was started from %s", c.Source)
+	}
+	return ""
+}
+
+func checkpointPhaseIndex(phase string) int {
+	for i, p := range checkpointPhases {
+		if p == phase {
+			return i
+		}
+	}
+	return -1
+}
+
+// ReadCheckpoint reads the checkpoint in dir, and returns nil when
+// there is none.
+func ReadCheckpoint(dir OutputDir) (*Checkpoint, error) {
+	data, err := dir.ReadFile(CheckpointFilename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading checkpoint: %s", err)
+	}
+
+	var c Checkpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("error reading checkpoint %s: %s", CheckpointFilename, err)
+	}
+	if checkpointPhaseIndex(c.Phase) < 0 || c.VMName == "" {
+		return nil, fmt.Errorf("invalid checkpoint %s: phase %q, VM %q", CheckpointFilename, c.Phase, c.VMName)
+	}
+	return &c, nil
+}
+
+// WriteCheckpoint writes the checkpoint c in dir.
+func WriteCheckpoint(dir OutputDir, c *Checkpoint) error {
+	c.Updated = time.Now().UTC()
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := dir.WriteFile(CheckpointFilename, append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing checkpoint: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir := &LocalOutputDir{}
+	dir.SetOutputDir(t.TempDir())
+
+	if c, err := ReadCheckpoint(dir); err != nil || c != nil {
+		t.Fatalf("bad: %#v %v", c, err)
+	}
+
+	written := &Checkpoint{
+		BuildName: "utm.windows",
+		Source:    "/images/windows.utm",
+		VMName:    "packer-windows",
+		Phase:     CheckpointImported,
+	}
+	if err := WriteCheckpoint(dir, written); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	c, err := ReadCheckpoint(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if c.VMName != "packer-windows" || !c.Updated.Equal(written.Updated) {
+		t.Fatalf("bad: %#v", c)
+	}
+
+	if !c.Reached(CheckpointImported) || c.Reached(CheckpointProvisioned) {
+		t.Fatalf("bad phase: %s", c.Phase)
+	}
+	if reason := c.Matches("utm.windows", "/images/windows.utm"); reason != "" {
+		t.Fatalf("should match: %s", reason)
+	}
+	if c.Matches("utm.linux", "/images/windows.utm") == "" || c.Matches("utm.windows", "/images/other.utm") == "" {
+		t.Fatal("should not match")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir.String(), CheckpointFilename), []byte(`{"phase": "done"}`), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := ReadCheckpoint(dir); err == nil {
+		t.Fatal("should error")
+	}
+}
@@ -14,6 +14,11 @@ func CommHost(host string) func(multistep.StateBag) (string, error) {
 }
 
 func CommPort(state multistep.StateBag) (int, error) {
+	// The forwarded port is on a remote UTM host, use the tunnel to it
+	if tunnelPort, ok := state.GetOk("commTunnelPort"); ok {
+		return tunnelPort.(int), nil
+	}
+
 	commHostPort := state.Get("commHostPort").(int)
 	return commHostPort, nil
 }
@@ -0,0 +1,111 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// The name of the snapshot taken before provisioning.
+const provisioningSnapshotName = "packer-before-provisioning"
+
+// findDisksScript prints the qcow2 disks of the first bundle whose
+// config.plist has the UUID given as first argument, among the bundles
+// given as the other arguments and the bundles imported into UTM.
+const findDisksScript = `uuid=$1
+shift
+for bundle in "$@" "$HOME/Library/Containers/com.utmapp.UTM/Data/Documents"/*.utm; do
+  if grep -qi "<string>$uuid</string>" "$bundle/config.plist" 2>/dev/null; then
+    for disk in "$bundle"/Data/*.qcow2; do
+      if [ -f "$disk" ]; then echo "$disk"; fi
+    done
+    exit 0
+  fi
+done
+echo "no bundle found for VM $uuid" >&2
+exit 1`
+
+// DiskSnapshotter manages internal snapshots of the qcow2 disks of a
+// stopped VM with qemu-img, on the UTM host. UTM has no snapshot API.
+type DiskSnapshotter struct {
+	// Runs commands on the UTM host, on this machine when nil
+	Executor Executor
+	// The path of qemu-img on the UTM host
+	QemuImgPath string
+	// The maximum time a qemu-img call may take
+	Timeout time.Duration
+}
+
+// Disks returns the qcow2 disks of the VM with the given UUID. The
+// bundles UTM 4.5 opens in place are not in the UTM directory, so they
+// have to be given.
+func (s *DiskSnapshotter) Disks(ctx context.Context, uuid string, bundles ...string) ([]string, error) {
+	args := append([]string{"-c", findDisksScript, "sh", uuid}, bundles...)
+	stdout, stderr, err := s.execute(ctx, "/bin/sh", args...)
+	if err != nil {
+		return nil, fmt.Errorf("error finding the disks of VM %s: %s", uuid, commandError(err, stderr))
+	}
+
+	var disks []string
+	for _, line := range strings.Split(stdout, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			disks = append(disks, line)
+		}
+	}
+	if len(disks) == 0 {
+		return nil, fmt.Errorf("VM %s has no qcow2 disk", uuid)
+	}
+	return disks, nil
+}
+
+// Create takes the snapshot name of every disk.
+func (s *DiskSnapshotter) Create(ctx context.Context, disks []string, name string) error {
+	return s.snapshot(ctx, "-c", disks, name)
+}
+
+// Apply reverts every disk to the snapshot name.
+func (s *DiskSnapshotter) Apply(ctx context.Context, disks []string, name string) error {
+	return s.snapshot(ctx, "-a", disks, name)
+}
+
+// Delete removes the snapshot name from every disk.
+func (s *DiskSnapshotter) Delete(ctx context.Context, disks []string, name string) error {
+	return s.snapshot(ctx, "-d", disks, name)
+}
+
+func (s *DiskSnapshotter) snapshot(ctx context.Context, op string, disks []string, name string) error {
+	for _, disk := range disks {
+		log.Printf("Executing qemu-img snapshot %s %s %s", op, name, disk)
+		if _, stderr, err := s.execute(ctx, s.QemuImgPath, "snapshot", op, name, disk); err != nil {
+			return fmt.Errorf("qemu-img snapshot %s %s %s: %s", op, name, disk, commandError(err, stderr))
+		}
+	}
+	return nil
+}
+
+func (s *DiskSnapshotter) execute(ctx context.Context, name string, args ...string) (string, string, error) {
+	ctx, cancel := withTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	executor := s.Executor
+	if executor == nil {
+		executor = &LocalExecutor{}
+	}
+	stdout, stderr, err := executor.Execute(ctx, nil, name, args...)
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return stdout, stderr, err
+}
+
+// commandError describes a failed command by its output, if any.
+func commandError(err error, stderr string) error {
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) && strings.TrimSpace(stderr) != "" {
+		return errors.New(strings.TrimSpace(stderr))
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiskSnapshotter_Disks(t *testing.T) {
+	// UTM keeps the imported bundles in its container
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	documents := filepath.Join(home, "Library", "Containers", "com.utmapp.UTM", "Data", "Documents")
+
+	writeBundle := func(dir string, uuid string, disks ...string) {
+		if err := os.MkdirAll(filepath.Join(dir, "Data"), 0755); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		plist := "<plist><dict><key>Information</key><dict>" +
+			"<key>UUID</key><string>" + uuid + "</string></dict></dict></plist>"
+		if err := os.WriteFile(filepath.Join(dir, "config.plist"), []byte(plist), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		for _, disk := range disks {
+			if err := os.WriteFile(filepath.Join(dir, "Data", disk), nil, 0644); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+		}
+	}
+	writeBundle(filepath.Join(documents, "imported.utm"), "AAAAAAAA-0000-4000-8000-000000000001",
+		"b.qcow2", "a.qcow2", "efi_vars.fd")
+	opened := filepath.Join(t.TempDir(), "opened.utm")
+	writeBundle(opened, "AAAAAAAA-0000-4000-8000-000000000002", "disk.qcow2")
+
+	s := &DiskSnapshotter{QemuImgPath: "qemu-img"}
+	disks, err := s.Disks(context.Background(), "aaaaaaaa-0000-4000-8000-000000000001")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := []string{
+		filepath.Join(documents, "imported.utm", "Data", "a.qcow2"),
+		filepath.Join(documents, "imported.utm", "Data", "b.qcow2"),
+	}
+	if !reflect.DeepEqual(disks, expected) {
+		t.Fatalf("bad disks: %#v", disks)
+	}
+
+	// Bundles opened in place are given
+	disks, err = s.Disks(context.Background(), "AAAAAAAA-0000-4000-8000-000000000002", opened)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(disks, []string{filepath.Join(opened, "Data", "disk.qcow2")}) {
+		t.Fatalf("bad disks: %#v", disks)
+	}
+
+	_, err = s.Disks(context.Background(), "AAAAAAAA-0000-4000-8000-000000000003", opened)
+	if err == nil || !strings.Contains(err.Error(), "no bundle found") {
+		t.Fatalf("should error: %v", err)
+	}
+}
+
+func TestDiskSnapshotter_Snapshots(t *testing.T) {
+	utm := NewSimulatedUTM("4.6.4")
+	vm := utm.AddVM("vm")
+	vm.BundlePath = t.TempDir()
+	disk := filepath.Join(vm.BundlePath, "disk.qcow2")
+	if err := os.WriteFile(disk, []byte("before"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	s := &DiskSnapshotter{Executor: utm, QemuImgPath: "qemu-img"}
+	ctx := context.Background()
+	if err := s.Create(ctx, []string{disk}, "snap"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.WriteFile(disk, []byte("after"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.Apply(ctx, []string{disk}, "snap"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if data, _ := os.ReadFile(disk); string(data) != "before" {
+		t.Fatalf("bad disk: %q", data)
+	}
+
+	// The disks of a started VM are locked
+	vm.Status = "started"
+	err := s.Delete(ctx, []string{disk}, "snap")
+	if err == nil || !strings.Contains(err.Error(), `Failed to get "write" lock`) {
+		t.Fatalf("should error: %v", err)
+	}
+	vm.Status = "stopped"
+	if err := s.Delete(ctx, []string{disk}, "snap"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.Apply(ctx, []string{disk}, "snap"); err == nil {
+		t.Fatal("should error, the snapshot is deleted")
+	}
+}
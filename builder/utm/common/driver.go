@@ -1,9 +1,16 @@
 package common
 
 import (
+	"context"
 	"embed"
+	"errors"
+	"fmt"
 	"log"
+	"os"
 	"os/exec"
+	"time"
+
+	"github.com/hashicorp/go-version"
 )
 
 var (
@@ -11,6 +18,10 @@ var (
 	osascripts embed.FS
 )
 
+// The path of utmctl inside the UTM application bundle. utmctl is not
+// on the PATH unless the user links it there, so we fall back to this.
+const defaultUtmctlPath = "/Applications/UTM.app/Contents/MacOS/utmctl"
+
 // A driver is able to talk to UTM and perform certain
 // operations with it. Some of the operations on here may seem overly
 // specific, but they were built specifically in mind to handle features
@@ -18,49 +29,183 @@ var (
 // versions out of the builder steps, so sometimes the methods are
 // extremely specific.
 type Driver interface {
+	// Clone the VM with the given name or UUID to a new VM
+	// with the given name.
+	Clone(ctx context.Context, name string, cloneName string) error
+
 	// Delete a VM by name
-	Delete(string) error
+	Delete(context.Context, string) error
 
 	// Executes the given AppleScript with the given arguments.
-	ExecuteOsaScript(command ...string) (string, error)
+	ExecuteOsaScript(ctx context.Context, command ...string) (string, error)
+
+	// ForwardFreePort forwards a free port of the UTM host, between
+	// hostPortMin and hostPortMax, to guestPort of the VM and returns it.
+	ForwardFreePort(ctx context.Context, vmName string, guestPort int, hostPortMin int, hostPortMax int) (int, error)
+
+	// Export the VM with the given name to the given path.
+	// Only supported if Features().ScriptedExport is true.
+	Export(context.Context, string, string) error
+
+	// Features returns the capabilities of the installed UTM version.
+	Features() DriverFeatures
 
 	// Import a VM
-	Import(string, string) error
+	Import(context.Context, string, string) error
 
 	// Checks if the VM with the given name is running.
-	IsRunning(string) (bool, error)
+	IsRunning(context.Context, string) (bool, error)
+
+	// List returns the VMs registered with UTM.
+	List(context.Context) ([]VMInfo, error)
 
 	// Stop stops a running machine, forcefully.
-	Stop(string) error
+	Stop(context.Context, string) error
 
 	// Utmctl executes the given Utmctl command
 	// and returns the stdout channel as string
-	Utmctl(...string) (string, error)
+	Utmctl(context.Context, ...string) (string, error)
 
 	// Verify checks to make sure that this driver should function
 	// properly. If there is any indication the driver can't function,
 	// this will return an error.
-	Verify() error
+	Verify(context.Context) error
 
 	// Version reads the version of UTM that is installed.
-	Version() (string, error)
+	Version(context.Context) (string, error)
 }
 
-// NewDriver creates a new driver for UTM.
-func NewDriver() (Driver, error) {
-	var utmctlPath string
+// DriverFeatures describes what the installed UTM version can do,
+// so steps can pick a code path without comparing versions themselves.
+type DriverFeatures struct {
+	// The VM can be exported through AppleScript instead of
+	// the 'Share...' action in the UTM UI.
+	ScriptedExport bool
+	// The VM can be given a name on import, so vm_name does not
+	// have to match the name stored in the UTM bundle.
+	ImportNaming bool
+	// UTM can talk to the QEMU guest agent (e.g. to query the guest IP).
+	GuestAgent bool
+}
 
-	var err error
-	utmctlPath, err = exec.LookPath("utmctl")
+// VMInfo is a VM registered with UTM, as listed by utmctl.
+type VMInfo struct {
+	UUID   string
+	Status string
+	Name   string
+}
+
+// StopAndDelete stops the VM with the given name or UUID if it is
+// running, and deletes it.
+func StopAndDelete(ctx context.Context, driver Driver, identifier string) error {
+	running, err := driver.IsRunning(ctx, identifier)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	if running {
+		if err := driver.Stop(ctx, identifier); err != nil {
+			return err
+		}
+	}
+	if err := driver.Delete(ctx, identifier); err != nil && !errors.Is(err, ErrVMNotFound) {
+		return err
+	}
+	return nil
+}
 
+// NewDriver creates a new driver for UTM, picking the implementation
+// that matches the installed UTM version.
+func NewDriver(ctx context.Context, config *DriverConfig) (Driver, error) {
+	utmctlPath, err := findUtmctl()
+	if err != nil {
+		return nil, err
+	}
 	log.Printf("utmctl path: %s", utmctlPath)
-	driver := &Utm45Driver{utmctlPath}
-	if err := driver.Verify(); err != nil {
+
+	return NewDriverWithExecutor(ctx, config, &LocalExecutor{}, utmctlPath)
+}
+
+// NewDriverWithExecutor creates a new driver for UTM that runs utmctl
+// (found at utmctlPath) and osascript through the given executor.
+func NewDriverWithExecutor(ctx context.Context, config *DriverConfig, executor Executor, utmctlPath string) (Driver, error) {
+	// Every supported UTM version answers the version query
+	// the same way, so the oldest driver is good enough to ask.
+	base := Utm45Driver{
+		UtmctlPath:          utmctlPath,
+		Executor:            executor,
+		UtmctlTimeout:       config.UtmctlTimeout,
+		OsaScriptTimeout:    config.OsaScriptTimeout,
+		ImportExportTimeout: config.ImportExportTimeout,
+		Retry: RetryPolicy{
+			MaxAttempts:    config.RetryMaxAttempts,
+			InitialBackoff: time.Second,
+			MaxBackoff:     30 * time.Second,
+		},
+		LockTimeout: config.LockTimeout,
+	}
+	if locker, ok := executor.(hostLocker); ok {
+		base.Lock = locker.HostLock(hostLockPath)
+	}
+	// Like Verify, but the version is only read once, to pick the driver
+	// which then checks it is supported
+	if err := base.verifyRunning(ctx); err != nil {
+		return nil, err
+	}
+	utmVersion, err := base.Version(ctx)
+	if err != nil {
 		return nil, err
 	}
 
+	driver, err := newDriverForVersion(base, utmVersion)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("UTM driver features: %+v", driver.Features())
+
 	return driver, nil
 }
+
+// NewDryRunDriver creates a driver that records the commands it would
+// run in executor instead of running them. UTM is not queried, so it
+// behaves like the driver of the newest supported UTM version.
+func NewDryRunDriver(executor *RecordingExecutor) Driver {
+	return &Utm46Driver{Utm45Driver{
+		UtmctlPath: "utmctl",
+		Executor:   executor,
+	}}
+}
+
+// newDriverForVersion returns the driver implementation for the given
+// UTM version, built on top of base, or an error if that version is not supported.
+func newDriverForVersion(base Utm45Driver, utmVersion string) (Driver, error) {
+	v, err := version.NewVersion(utmVersion)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing UTM version %q: %s", utmVersion, err)
+	}
+
+	switch {
+	case v.LessThan(version.Must(version.NewVersion(utm45MinVersion))):
+		return nil, fmt.Errorf(
+			"UTM %s is not supported, please upgrade to UTM %s or later", utmVersion, utm45MinVersion)
+	case v.LessThan(version.Must(version.NewVersion(utm46MinVersion))):
+		log.Printf("Using UTM 4.5 driver for UTM %s", utmVersion)
+		return &base, nil
+	default:
+		log.Printf("Using UTM 4.6 driver for UTM %s", utmVersion)
+		return &Utm46Driver{base}, nil
+	}
+}
+
+// findUtmctl looks for utmctl on the PATH and then inside the
+// UTM application bundle.
+func findUtmctl() (string, error) {
+	if path, err := exec.LookPath("utmctl"); err == nil {
+		return path, nil
+	}
+
+	if _, err := os.Stat(defaultUtmctlPath); err != nil {
+		return "", fmt.Errorf(
+			"utmctl not found on PATH or at %s, is UTM installed?", defaultUtmctlPath)
+	}
+	return defaultUtmctlPath, nil
+}
@@ -1,28 +1,176 @@
 package common
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/hashicorp/go-version"
 )
 
+// The oldest UTM version this driver works with.
+const utm45MinVersion = "4.5.0"
+
 type Utm45Driver struct {
 	// This is the path to the utmctl binary
 	UtmctlPath string
+
+	// Runs utmctl and osascript. Commands run locally when nil.
+	Executor Executor
+
+	// Timeouts for a single call. A deadline on the context passed
+	// to the driver still applies. Zero means no timeout.
+	UtmctlTimeout       time.Duration
+	OsaScriptTimeout    time.Duration
+	ImportExportTimeout time.Duration
+
+	// How utmctl and AppleScript calls are retried on transient errors.
+	// Imports, exports, the utmctl subcommands changing a VM and the
+	// scripts changing a VM in a way that would add up when applied twice
+	// are never retried: a timed out Apple Event may still have been applied.
+	Retry RetryPolicy
+
+	// Serializes the changes of VM configurations with the other Packer
+	// processes on the UTM host, waiting at most LockTimeout. Nil means
+	// no locking.
+	Lock        HostLock
+	LockTimeout time.Duration
+}
+
+// Clone copies the VM with the given name or UUID to a new VM named
+// cloneName. Like imports, clones copy disks and are never retried.
+// They do not rewrite a VM configuration, so they do not hold the
+// host lock for the length of the copy.
+func (d *Utm45Driver) Clone(ctx context.Context, name string, cloneName string) error {
+	_, err := d.utmctl(ctx, d.ImportExportTimeout, "clone", name, "--name", cloneName)
+	return err
 }
 
-func (d *Utm45Driver) Delete(name string) error {
-	_, err := d.Utmctl("delete", name)
+func (d *Utm45Driver) Delete(ctx context.Context, name string) error {
+	_, err := d.Utmctl(ctx, "delete", name)
 	return err
 }
 
 // ExecuteOsaScript executes an AppleScript command with the given arguments.
-func (d *Utm45Driver) ExecuteOsaScript(command ...string) (string, error) {
+func (d *Utm45Driver) ExecuteOsaScript(ctx context.Context, command ...string) (string, error) {
+	if len(command) == 0 {
+		return "", fmt.Errorf("no command provided")
+	}
+
+	if readOnlyScripts[command[0]] {
+		return d.Retry.Do(ctx, command[0], func() (string, error) {
+			return d.executeOsaScript(ctx, d.OsaScriptTimeout, command...)
+		})
+	}
+
+	// The other scripts read, modify and write back the VM configuration
+	run := func() (string, error) {
+		return d.locked(ctx, command[0], func() (string, error) {
+			return d.executeOsaScript(ctx, d.OsaScriptTimeout, command...)
+		})
+	}
+	if idempotentScripts[command[0]] {
+		return d.Retry.Do(ctx, command[0], run)
+	}
+	return run()
+}
+
+// The embedded scripts which do not change anything,
+// so they do not need the host lock.
+var readOnlyScripts = map[string]bool{
+	"list_build_tags.applescript":    true,
+	"list_port_forwards.applescript": true,
+}
+
+// The embedded scripts which leave the VM the same when they are applied
+// twice, so they can be retried even if the failed attempt was applied.
+var idempotentScripts = map[string]bool{
+	"clear_network_interfaces.applescript": true,
+	"clear_port_forwards.applescript":      true,
+	"rename_vm.applescript":                true,
+	"set_build_tag.applescript":            true,
+}
+
+// freePortScript prints a port between its first two arguments that can
+// be bound on the loopback interface and is not one of the others, tried
+// in random order so concurrent builds are unlikely to pick the same one.
+const freePortScript = `use Socket;
+my ($min, $max, @used) = @ARGV;
+my %used = map { $_ => 1 } @used;
+my @ports = grep { !$used{$_} } ($min..$max);
+while (@ports) {
+  my $port = splice(@ports, int(rand(@ports)), 1);
+  socket(my $s, PF_INET, SOCK_STREAM, getprotobyname("tcp")) or die "socket: $!\n";
+  if (bind($s, sockaddr_in($port, inet_aton("127.0.0.1")))) { print "$port\n"; exit 0; }
+  close($s);
+}
+die "no free port between $min and $max\n";`
+
+// ForwardFreePort forwards a port of the UTM host to guestPort of the
+// emulated VLAN interface of the VM, and returns it. The port is free on
+// the host and not forwarded to any VM yet, and the host lock is held
+// from picking it until it is forwarded, so concurrent builds on the
+// host do not pick the same one.
+func (d *Utm45Driver) ForwardFreePort(ctx context.Context, vmName string, guestPort int, hostPortMin int, hostPortMax int) (int, error) {
+	out, err := d.locked(ctx, "add_port_forwards.applescript", func() (string, error) {
+		forwarded, err := d.executeOsaScript(ctx, d.OsaScriptTimeout, "list_port_forwards.applescript")
+		if err != nil {
+			return "", err
+		}
+
+		args := []string{"-e", freePortScript, strconv.Itoa(hostPortMin), strconv.Itoa(hostPortMax)}
+		args = append(args, strings.Fields(forwarded)...)
+		execCtx, cancel := withTimeout(ctx, d.UtmctlTimeout)
+		defer cancel()
+		stdout, stderr, err := d.execute(execCtx, nil, "perl", args...)
+		if err != nil {
+			return "", fmt.Errorf("error finding a free port on the UTM host: %s", strings.TrimSpace(stderr))
+		}
+		port := strings.TrimSpace(stdout)
+
+		_, err = d.executeOsaScript(ctx, d.OsaScriptTimeout, "add_port_forwards.applescript", vmName,
+			"--index", "1", fmt.Sprintf("TcPp,,%d,127.0.0.1,%s", guestPort, port))
+		return port, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(out)
+}
+
+// locked calls fn holding the host lock, if any.
+// The description is only used for messages.
+func (d *Utm45Driver) locked(ctx context.Context, description string, fn func() (string, error)) (string, error) {
+	if d.Lock == nil {
+		return fn()
+	}
+
+	lockCtx, cancel := withTimeout(ctx, d.LockTimeout)
+	defer cancel()
+
+	log.Printf("Waiting for the UTM host lock to run %s", description)
+	unlock, err := d.Lock.Lock(lockCtx)
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			return "", fmt.Errorf("timeout after %s waiting for the UTM host lock to run %s, "+
+				"another build may be stuck changing a VM", d.LockTimeout, description)
+		}
+		return "", fmt.Errorf("error acquiring the UTM host lock to run %s: %w", description, err)
+	}
+	defer unlock()
+
+	return fn()
+}
+
+// executeOsaScript executes one of the embedded AppleScripts,
+// killing osascript if it takes longer than timeout.
+func (d *Utm45Driver) executeOsaScript(ctx context.Context, timeout time.Duration, command ...string) (string, error) {
 	if len(command) == 0 {
 		return "", fmt.Errorf("no command provided")
 	}
@@ -37,32 +185,20 @@ func (d *Utm45Driver) ExecuteOsaScript(command ...string) (string, error) {
 		return "", fmt.Errorf("failed to read script %s: %v", scriptPath, err)
 	}
 
-	// Construct the command to execute
-	cmd := exec.Command("osascript", "-")
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
 
-	// Append additional arguments to the command
-	if len(command) > 1 {
-		cmd.Args = append(cmd.Args, command[1:]...)
-	}
+	// The script is read from stdin, the arguments follow "-"
+	stdoutString, stderrString, err := d.execute(ctx, scriptContent,
+		"osascript", append([]string{"-"}, command[1:]...)...)
 
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		return "", err
+	var exitErr *ExitError
+	if ctx.Err() != nil {
+		err = fmt.Errorf("osascript %s: %w", command[0], ctx.Err())
+	} else if errors.As(err, &exitErr) {
+		err = newOsaScriptError(command[0], stderrString)
 	}
 
-	go func() {
-		defer stdin.Close()
-		io.WriteString(stdin, string(scriptContent))
-	}()
-
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err = cmd.Run()
-
-	stdoutString := strings.TrimSpace(stdout.String())
-	stderrString := strings.TrimSpace(stderr.String())
-
 	if stdoutString != "" {
 		log.Printf("stdout: %s", stdoutString)
 	}
@@ -73,18 +209,22 @@ func (d *Utm45Driver) ExecuteOsaScript(command ...string) (string, error) {
 	return stdoutString, err
 }
 
-func (d *Utm45Driver) Import(name string, path string) error {
-	var stdout bytes.Buffer
-	// TODO: While importing we should have ability to set the name of the VM
-	// UTM does not support setting the name of the VM while importing
+func (d *Utm45Driver) Export(ctx context.Context, name string, path string) error {
+	return fmt.Errorf("exporting VMs through AppleScript requires UTM %s or later", utm46MinVersion)
+}
+
+func (d *Utm45Driver) Features() DriverFeatures {
+	return DriverFeatures{
+		GuestAgent: true,
+	}
+}
+
+func (d *Utm45Driver) Import(ctx context.Context, name string, path string) error {
+	// UTM 4.5 does not support setting the name of the VM while importing
 	// So we make sure VM name is same as the name in plist.config (previous name in UTM bundle)
-	// This is a limitation of UTM
-	cmd := exec.Command(
-		"osascript", "-e",
-		fmt.Sprintf(`tell application "UTM" to open POSIX file "%s"`, path),
-	)
-	cmd.Stdout = &stdout
-	if err := cmd.Run(); err != nil {
+	// This is a limitation of UTM, fixed by Utm46Driver
+	// The path is an argument, so no quote in it can change the script
+	if _, err := d.executeOsaScript(ctx, d.ImportExportTimeout, "open_vm.applescript", path); err != nil {
 		return err
 	}
 	// "missing value" in the output means AppleScript was successful
@@ -95,16 +235,12 @@ func (d *Utm45Driver) Import(name string, path string) error {
 	return nil
 }
 
-func (d *Utm45Driver) IsRunning(name string) (bool, error) {
-	var stdout bytes.Buffer
-
-	cmd := exec.Command(d.UtmctlPath, "status", name)
-	cmd.Stdout = &stdout
-	if err := cmd.Run(); err != nil {
+func (d *Utm45Driver) IsRunning(ctx context.Context, name string) (bool, error) {
+	output, err := d.Utmctl(ctx, "status", name)
+	if err != nil {
 		return false, err
 	}
 
-	output := strings.TrimSpace(stdout.String())
 	if output == "started" {
 		return true, nil
 	}
@@ -128,27 +264,68 @@ func (d *Utm45Driver) IsRunning(name string) (bool, error) {
 	return false, nil
 }
 
-func (d *Utm45Driver) Stop(name string) error {
-	if _, err := d.Utmctl("stop", name); err != nil {
+// The lines of 'utmctl list' after the header: UUID, status and name
+var listLineRe = regexp.MustCompile(`^(\S+)\s+(\S+)\s+(.*)$`)
+
+func (d *Utm45Driver) List(ctx context.Context) ([]VMInfo, error) {
+	output, err := d.Utmctl(ctx, "list")
+	if err != nil {
+		return nil, err
+	}
+
+	var vms []VMInfo
+	for i, line := range strings.Split(output, "\n") {
+		if i == 0 || strings.TrimSpace(line) == "" {
+			continue
+		}
+		match := listLineRe.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			return nil, fmt.Errorf("unexpected output of utmctl list: %q", line)
+		}
+		vms = append(vms, VMInfo{UUID: match[1], Status: match[2], Name: match[3]})
+	}
+	return vms, nil
+}
+
+func (d *Utm45Driver) Stop(ctx context.Context, name string) error {
+	if _, err := d.Utmctl(ctx, "stop", name); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (d *Utm45Driver) Utmctl(args ...string) (string, error) {
-	var stdout, stderr bytes.Buffer
+func (d *Utm45Driver) Utmctl(ctx context.Context, args ...string) (string, error) {
+	run := func() (string, error) {
+		return d.utmctl(ctx, d.UtmctlTimeout, args...)
+	}
+	if len(args) > 0 && readOnlySubcommands[args[0]] {
+		return d.Retry.Do(ctx, "utmctl "+strings.Join(args, " "), run)
+	}
+	return run()
+}
 
-	log.Printf("Executing utmctl: %#v", args)
-	cmd := exec.Command(d.UtmctlPath, args...)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err := cmd.Run()
+// The utmctl subcommands which do not change anything, so they can be
+// retried. A timed out start or stop may have been applied, and would
+// fail when retried on the VM it already started or stopped.
+var readOnlySubcommands = map[string]bool{
+	"list":    true,
+	"status":  true,
+	"version": true,
+}
 
-	stdoutString := strings.TrimSpace(stdout.String())
-	stderrString := strings.TrimSpace(stderr.String())
+// utmctl executes utmctl once.
+func (d *Utm45Driver) utmctl(ctx context.Context, timeout time.Duration, args ...string) (string, error) {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
 
-	if _, ok := err.(*exec.ExitError); ok {
-		err = fmt.Errorf("Utmctl error: %s", stderrString)
+	log.Printf("Executing utmctl: %#v", args)
+	stdoutString, stderrString, err := d.execute(ctx, nil, d.UtmctlPath, args...)
+
+	var exitErr *ExitError
+	if ctx.Err() != nil {
+		err = fmt.Errorf("utmctl %s: %w", strings.Join(args, " "), ctx.Err())
+	} else if errors.As(err, &exitErr) {
+		err = newUtmctlError(args, exitErr.Code, stderrString)
 	}
 
 	if stdoutString != "" {
@@ -161,36 +338,118 @@ func (d *Utm45Driver) Utmctl(args ...string) (string, error) {
 	return stdoutString, err
 }
 
-func (d *Utm45Driver) Verify() error {
-	return nil
+func (d *Utm45Driver) Verify(ctx context.Context) error {
+	return d.verify(ctx, utm45MinVersion)
 }
 
-func (d *Utm45Driver) Version() (string, error) {
-	var stdout bytes.Buffer
+// verify makes sure UTM is installed, at least minVersion, running
+// and that we are allowed to control it through AppleScript.
+func (d *Utm45Driver) verify(ctx context.Context, minVersion string) error {
+	if err := d.verifyRunning(ctx); err != nil {
+		return err
+	}
 
-	cmd := exec.Command("osascript", "-e",
-		`tell application "System Events" to return version of application "UTM"`)
+	utmVersion, err := d.Version(ctx)
+	if err != nil {
+		return err
+	}
+	v, err := version.NewVersion(utmVersion)
+	if err != nil {
+		return fmt.Errorf("error parsing UTM version %q: %s", utmVersion, err)
+	}
+	if v.LessThan(version.Must(version.NewVersion(minVersion))) {
+		return fmt.Errorf("UTM %s is too old, please upgrade to UTM %s or later", utmVersion, minVersion)
+	}
+	return nil
+}
+
+// verifyRunning makes sure UTM is running and that we are allowed to
+// control it through AppleScript.
+func (d *Utm45Driver) verifyRunning(ctx context.Context) error {
+	// Asking whether an application is running does not launch it.
+	stdout, _, err := d.osascriptInline(ctx, `application "UTM" is running`)
+	if err != nil {
+		return fmt.Errorf("error checking if UTM is running: %s", err)
+	}
+	if stdout != "true" {
+		// An application which is not installed is not running either
+		if _, err := d.Version(ctx); err != nil {
+			return err
+		}
+		return fmt.Errorf("UTM is not running, please start UTM before running Packer")
+	}
 
-	cmd.Stdout = &stdout
-	if err := cmd.Run(); err != nil {
-		return "", err
+	// Any command sent to UTM triggers the automation permission check,
+	// so do it now instead of halfway through the build.
+	if _, _, err := d.osascriptInline(ctx, `tell application "UTM" to count of virtual machines`); err != nil {
+		if errors.Is(err, ErrAutomationDenied) {
+			return fmt.Errorf("osascript is not allowed to control UTM (-1743), " +
+				"allow it in System Settings > Privacy & Security > Automation")
+		}
+		return fmt.Errorf("error talking to UTM through AppleScript: %s", err)
 	}
 
-	versionOutput := strings.TrimSpace(stdout.String())
-	log.Printf("UTM version output : %s", versionOutput)
+	return nil
+}
+
+func (d *Utm45Driver) Version(ctx context.Context) (string, error) {
+	stdout, _, err := d.osascriptInline(ctx,
+		`tell application "System Events" to return version of application "UTM"`)
+	log.Printf("UTM version output : %s", stdout)
 
-	// Check if the output contains the error message
-	if strings.Contains(versionOutput, "get application") {
-		return "", fmt.Errorf("UTM is not installed")
+	// System Events can't find an application that is not installed
+	if err != nil {
+		var osaErr *OsaScriptError
+		if errors.As(err, &osaErr) && osaErr.Number == errAENoSuchObject {
+			return "", fmt.Errorf("UTM is not installed")
+		}
+		return "", fmt.Errorf("error reading UTM version: %s", err)
 	}
 
 	versionRe := regexp.MustCompile(`^(\d+\.\d+\.\d+)$`)
-	matches := versionRe.FindStringSubmatch(versionOutput)
+	matches := versionRe.FindStringSubmatch(stdout)
 	if matches == nil || len(matches) != 2 {
-		return "", fmt.Errorf("no version found: %s", versionOutput)
+		return "", fmt.Errorf("no version found: %s", stdout)
 	}
 
 	log.Printf("UTM version: %s", matches[1])
 	return matches[1], nil
+}
 
+// osascriptInline runs a one line AppleScript and returns
+// its trimmed stdout and stderr.
+func (d *Utm45Driver) osascriptInline(ctx context.Context, script string) (string, string, error) {
+	ctx, cancel := withTimeout(ctx, d.OsaScriptTimeout)
+	defer cancel()
+
+	stdoutString, stderrString, err := d.execute(ctx, nil, "osascript", "-e", script)
+
+	var exitErr *ExitError
+	if ctx.Err() != nil {
+		err = fmt.Errorf("osascript: %w", ctx.Err())
+	} else if errors.As(err, &exitErr) {
+		err = newOsaScriptError(script, stderrString)
+	}
+
+	return stdoutString, stderrString, err
+}
+
+// execute runs a command through the executor and trims its output.
+func (d *Utm45Driver) execute(ctx context.Context, stdin []byte, name string, args ...string) (string, string, error) {
+	executor := d.Executor
+	if executor == nil {
+		executor = &LocalExecutor{}
+	}
+
+	stdout, stderr, err := executor.Execute(ctx, stdin, name, args...)
+	return strings.TrimSpace(stdout), strings.TrimSpace(stderr), err
+}
+
+// withTimeout returns ctx with the given timeout applied,
+// or ctx itself if timeout is zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
 }
@@ -4,9 +4,162 @@
 package common
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestUtm45Driver_impl(t *testing.T) {
 	var _ Driver = new(Utm45Driver)
 }
+
+func TestUtm45Driver_UtmctlTimeout(t *testing.T) {
+	// sleep stands in for a utmctl that hangs
+	driver := &Utm45Driver{
+		UtmctlPath:    "sleep",
+		UtmctlTimeout: 100 * time.Millisecond,
+	}
+
+	start := time.Now()
+	_, err := driver.Utmctl(context.Background(), "30")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("should time out: %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatalf("took too long: %s", time.Since(start))
+	}
+}
+
+func TestNewCommand_killsProcessGroup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// The child sleep inherits stdout, so Run would wait for it
+	// unless the whole process group is killed.
+	var stdout bytes.Buffer
+	cmd := newCommand(ctx, "sh", "-c", "sleep 30 & wait")
+	cmd.Stdout = &stdout
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	if err := cmd.Run(); err == nil {
+		t.Fatal("should error")
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Fatalf("took too long, process group was not killed: %s", time.Since(start))
+	}
+}
+
+// timingOutExecutor applies the next Failures AppleScripts and utmctl
+// commands, then reports that their Apple Event timed out anyway.
+type timingOutExecutor struct {
+	*SimulatedUTM
+	Failures int
+}
+
+func (e *timingOutExecutor) Execute(ctx context.Context, stdin []byte, name string, args ...string) (string, string, error) {
+	stdout, stderr, err := e.SimulatedUTM.Execute(ctx, stdin, name, args...)
+	if err != nil || e.Failures == 0 {
+		return stdout, stderr, err
+	}
+	switch name {
+	case "osascript":
+		e.Failures--
+		return "", "0:130: execution error: UTM got an error: AppleEvent timed out. (-1712)", &ExitError{Code: 1}
+	case "utmctl":
+		e.Failures--
+		return "", "Error from event: The operation couldn’t be completed. (OSStatus error -1712.)", &ExitError{Code: 1}
+	}
+	return stdout, stderr, err
+}
+
+func TestUtm45Driver_ExecuteOsaScriptRetry(t *testing.T) {
+	utm := NewSimulatedUTM("4.6.4")
+	vm := utm.AddVM("vm")
+	executor := &timingOutExecutor{SimulatedUTM: utm, Failures: 1}
+	driver := &Utm45Driver{
+		UtmctlPath: "utmctl",
+		Executor:   executor,
+		Retry:      RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+	}
+	ctx := context.Background()
+
+	// Adding the forward again would duplicate it
+	if _, err := driver.ExecuteOsaScript(ctx, "add_port_forwards.applescript", "vm",
+		"--index", "1", "TcPp,,22,127.0.0.1,2222"); err == nil {
+		t.Fatal("should error")
+	}
+	if forwards := vm.NetworkInterfaces[1].PortForwards; len(forwards) != 1 {
+		t.Fatalf("should not be retried: %#v", forwards)
+	}
+
+	// Clearing it again changes nothing
+	executor.Failures = 1
+	if _, err := driver.ExecuteOsaScript(ctx, "clear_port_forwards.applescript", "vm",
+		"--index", "1", "2222"); err != nil {
+		t.Fatalf("should be retried: %s", err)
+	}
+	if forwards := vm.NetworkInterfaces[1].PortForwards; len(forwards) != 0 {
+		t.Fatalf("bad: %#v", forwards)
+	}
+}
+
+func TestUtm45Driver_UtmctlRetry(t *testing.T) {
+	utm := NewSimulatedUTM("4.6.4")
+	utm.AddVM("vm")
+	executor := &timingOutExecutor{SimulatedUTM: utm, Failures: 1}
+	driver := &Utm45Driver{
+		UtmctlPath: "utmctl",
+		Executor:   executor,
+		Retry:      RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+	}
+	ctx := context.Background()
+
+	// Starting the VM again would fail, it is running
+	if _, err := driver.Utmctl(ctx, "start", "vm"); err == nil {
+		t.Fatal("should error")
+	}
+	starts := 0
+	for _, call := range utm.Calls {
+		if call[0] == "utmctl" && call[1] == "start" {
+			starts++
+		}
+	}
+	if starts != 1 || utm.VM("vm").Status != "started" {
+		t.Fatalf("should not be retried: %d starts", starts)
+	}
+
+	// Asking for the status again changes nothing
+	executor.Failures = 1
+	if status, err := driver.Utmctl(ctx, "status", "vm"); err != nil || status != "started" {
+		t.Fatalf("should be retried: %q %v", status, err)
+	}
+}
+
+func TestUtm45Driver_ImportQuotedPath(t *testing.T) {
+	bundle := filepath.Join(t.TempDir(), `a "quoted\ bundle.utm`)
+	if err := os.Mkdir(bundle, 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	utm := NewSimulatedUTM("4.5.4")
+	driver := &Utm45Driver{UtmctlPath: "utmctl", Executor: utm}
+
+	if err := driver.Import(context.Background(), "packer-test", bundle); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// The path is passed as is, not in the script
+	if last := utm.Calls[len(utm.Calls)-1]; !reflect.DeepEqual(last, []string{"osascript", "open_vm.applescript", bundle}) {
+		t.Fatalf("bad call: %#v", last)
+	}
+	if vms := utm.VMs(); len(vms) != 1 || vms[0].BundlePath != bundle {
+		t.Fatalf("bad VMs: %#v", vms)
+	}
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// The first UTM version with AppleScript import and export.
+const utm46MinVersion = "4.6.0"
+
+// Utm46Driver is the driver for UTM 4.6 and later. It behaves like
+// Utm45Driver, except that VMs are imported and exported through
+// AppleScript.
+type Utm46Driver struct {
+	Utm45Driver
+}
+
+func (d *Utm46Driver) Export(ctx context.Context, name string, path string) error {
+	// AppleScript needs an absolute POSIX path
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.executeOsaScript(ctx, d.ImportExportTimeout, "export_vm.applescript", name, absPath)
+	return err
+}
+
+func (d *Utm46Driver) Features() DriverFeatures {
+	return DriverFeatures{
+		ScriptedExport: true,
+		ImportNaming:   true,
+		GuestAgent:     true,
+	}
+}
+
+func (d *Utm46Driver) Import(ctx context.Context, name string, path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	// Unlike 'open', the import command copies the bundle into UTM
+	// and lets us rename the VM, so vm_name is always honoured.
+	// The copy does not hold the host lock, only the renaming
+	// rewrites the VM configuration.
+	id, err := d.executeOsaScript(ctx, d.ImportExportTimeout, "import_vm.applescript", absPath)
+	if err != nil {
+		return err
+	}
+	id = strings.TrimSpace(id)
+	if _, err := d.ExecuteOsaScript(ctx, "rename_vm.applescript", id, name); err != nil {
+		// Nothing finds the VM under vm_name, delete it or it leaks
+		if deleteErr := d.Delete(context.Background(), id); deleteErr != nil {
+			return fmt.Errorf("%w (the imported VM %s could not be deleted: %s)", err, id, deleteErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (d *Utm46Driver) Verify(ctx context.Context) error {
+	return d.verify(ctx, utm46MinVersion)
+}
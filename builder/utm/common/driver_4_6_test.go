@@ -0,0 +1,49 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUtm46Driver_impl(t *testing.T) {
+	var _ Driver = new(Utm46Driver)
+}
+
+// failingScriptExecutor fails the embedded script Script,
+// running every other command with the SimulatedUTM.
+type failingScriptExecutor struct {
+	*SimulatedUTM
+	Script string
+}
+
+func (e *failingScriptExecutor) Execute(ctx context.Context, stdin []byte, name string, args ...string) (string, string, error) {
+	if name == "osascript" && embeddedScriptName(stdin) == e.Script {
+		return "", "execution error: UTM got an error: Connection is invalid. (-609)", &ExitError{Code: 1}
+	}
+	return e.SimulatedUTM.Execute(ctx, stdin, name, args...)
+}
+
+func TestUtm46Driver_ImportRenameFailure(t *testing.T) {
+	bundle := filepath.Join(t.TempDir(), "bundle.utm")
+	if err := os.Mkdir(bundle, 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	utm := NewSimulatedUTM("4.6.4")
+	driver := &Utm46Driver{Utm45Driver{
+		UtmctlPath: "utmctl",
+		Executor:   &failingScriptExecutor{SimulatedUTM: utm, Script: "rename_vm.applescript"},
+	}}
+
+	if err := driver.Import(context.Background(), "packer-test", bundle); err == nil {
+		t.Fatal("should error")
+	}
+	// The imported VM is not left registered
+	if vms := utm.VMs(); len(vms) != 0 {
+		t.Fatalf("bad VMs: %#v", vms)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:generate packer-sdc struct-markdown
+
+package common
+
+import (
+	"errors"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+type DriverConfig struct {
+	// The maximum time a single `utmctl` call (start, stop, status, ...) may
+	// take before it is cancelled. This guards against `utmctl` hanging, e.g.
+	// when UTM shows a modal dialog. By default this is 2m or two minutes.
+	UtmctlTimeout time.Duration `mapstructure:"utmctl_timeout" required:"false"`
+	// The maximum time a single AppleScript (`osascript`) call, such as adding
+	// a port forward, may take before it is cancelled. By default this is 2m
+	// or two minutes.
+	OsaScriptTimeout time.Duration `mapstructure:"osascript_timeout" required:"false"`
+	// The maximum time importing or exporting the virtual machine may take
+	// before it is cancelled. Large VMs take a while to be copied.
+	// By default this is 30m or thirty minutes.
+	ImportExportTimeout time.Duration `mapstructure:"import_export_timeout" required:"false"`
+	// The maximum number of attempts for a `utmctl` or AppleScript call that
+	// fails with a transient error, such as "Connection is invalid" (-609) or
+	// "AppleEvent timed out" (-1712), which UTM returns right after it launched
+	// or while it saves a VM configuration. Retries back off exponentially,
+	// starting at one second. The AppleScripts adding port forwards or network
+	// interfaces and the `utmctl` commands starting, stopping, cloning or
+	// deleting a VM are not retried, a timed out call may have been applied.
+	// Set to 1 to disable retries. By default this is 3.
+	RetryMaxAttempts int `mapstructure:"retry_max_attempts" required:"false"`
+	// The maximum time to wait for the other Packer builds on the same UTM
+	// host to finish changing a VM configuration (adding a port forward,
+	// naming an imported VM, ...). Changes are serialized with a lock file
+	// on the UTM host, /tmp/packer-plugin-utm.lock, as UTM may lose some of
+	// them or crash otherwise. Imports, clones and exports do not hold the
+	// lock while they copy the disks. By default this is 30m or thirty
+	// minutes.
+	LockTimeout time.Duration `mapstructure:"lock_timeout" required:"false"`
+}
+
+func (c *DriverConfig) Prepare(ctx *interpolate.Context) []error {
+	if c.UtmctlTimeout == 0 {
+		c.UtmctlTimeout = 2 * time.Minute
+	}
+
+	if c.OsaScriptTimeout == 0 {
+		c.OsaScriptTimeout = 2 * time.Minute
+	}
+
+	if c.ImportExportTimeout == 0 {
+		c.ImportExportTimeout = 30 * time.Minute
+	}
+
+	if c.RetryMaxAttempts == 0 {
+		c.RetryMaxAttempts = 3
+	}
+
+	if c.LockTimeout == 0 {
+		c.LockTimeout = 30 * time.Minute
+	}
+
+	var errs []error
+	if c.UtmctlTimeout < 0 || c.OsaScriptTimeout < 0 || c.ImportExportTimeout < 0 || c.LockTimeout < 0 {
+		errs = append(errs, errors.New("driver timeouts must not be negative"))
+	}
+	if c.RetryMaxAttempts < 0 {
+		errs = append(errs, errors.New("retry_max_attempts must not be negative"))
+	}
+
+	return errs
+}
@@ -0,0 +1,68 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+func TestDriverConfigPrepare_Defaults(t *testing.T) {
+	c := new(DriverConfig)
+	errs := c.Prepare(interpolate.NewContext())
+	if len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+	if c.UtmctlTimeout != 2*time.Minute {
+		t.Fatalf("bad: %s", c.UtmctlTimeout)
+	}
+	if c.OsaScriptTimeout != 2*time.Minute {
+		t.Fatalf("bad: %s", c.OsaScriptTimeout)
+	}
+	if c.ImportExportTimeout != 30*time.Minute {
+		t.Fatalf("bad: %s", c.ImportExportTimeout)
+	}
+	if c.RetryMaxAttempts != 3 {
+		t.Fatalf("bad: %d", c.RetryMaxAttempts)
+	}
+	if c.LockTimeout != 30*time.Minute {
+		t.Fatalf("bad: %s", c.LockTimeout)
+	}
+}
+
+func TestDriverConfigPrepare_RetryMaxAttempts(t *testing.T) {
+	c := &DriverConfig{RetryMaxAttempts: 1}
+	errs := c.Prepare(interpolate.NewContext())
+	if len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+	if c.RetryMaxAttempts != 1 {
+		t.Fatalf("bad: %d", c.RetryMaxAttempts)
+	}
+
+	c = &DriverConfig{RetryMaxAttempts: -1}
+	errs = c.Prepare(interpolate.NewContext())
+	if len(errs) == 0 {
+		t.Fatal("should error")
+	}
+}
+
+func TestDriverConfigPrepare_Timeouts(t *testing.T) {
+	c := &DriverConfig{UtmctlTimeout: 10 * time.Second}
+	errs := c.Prepare(interpolate.NewContext())
+	if len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+	if c.UtmctlTimeout != 10*time.Second {
+		t.Fatalf("bad: %s", c.UtmctlTimeout)
+	}
+
+	c = &DriverConfig{OsaScriptTimeout: -1 * time.Second}
+	errs = c.Prepare(interpolate.NewContext())
+	if len(errs) == 0 {
+		t.Fatal("should error")
+	}
+}
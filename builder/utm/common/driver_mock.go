@@ -1,10 +1,18 @@
 package common
 
-import "sync"
+import (
+	"context"
+	"sync"
+)
 
 type DriverMock struct {
 	sync.Mutex
 
+	CloneCalled bool
+	CloneName   string
+	CloneTarget string
+	CloneErr    error
+
 	DeleteCalled bool
 	DeleteName   string
 	DeleteErr    error
@@ -13,6 +21,17 @@ type DriverMock struct {
 	ExecuteOsaErrs   []error
 	ExecuteOsaResult string
 
+	ExportCalled bool
+	ExportName   string
+	ExportPath   string
+	ExportErr    error
+
+	FeaturesResult DriverFeatures
+
+	ForwardFreePortCalls  [][]interface{}
+	ForwardFreePortResult int
+	ForwardFreePortErr    error
+
 	ImportCalled bool
 	ImportName   string
 	ImportPath   string
@@ -22,6 +41,10 @@ type DriverMock struct {
 	IsRunningReturn bool
 	IsRunningErr    error
 
+	ListCalled bool
+	ListResult []VMInfo
+	ListErr    error
+
 	StopName string
 	StopErr  error
 
@@ -37,13 +60,20 @@ type DriverMock struct {
 	VersionErr    error
 }
 
-func (d *DriverMock) Delete(name string) error {
+func (d *DriverMock) Clone(ctx context.Context, name string, cloneName string) error {
+	d.CloneCalled = true
+	d.CloneName = name
+	d.CloneTarget = cloneName
+	return d.CloneErr
+}
+
+func (d *DriverMock) Delete(ctx context.Context, name string) error {
 	d.DeleteCalled = true
 	d.DeleteName = name
 	return d.DeleteErr
 }
 
-func (d *DriverMock) ExecuteOsaScript(command ...string) (string, error) {
+func (d *DriverMock) ExecuteOsaScript(ctx context.Context, command ...string) (string, error) {
 	d.ExecuteOsaCalls = append(d.ExecuteOsaCalls, command)
 
 	if len(d.ExecuteOsaErrs) >= len(d.ExecuteOsaCalls) {
@@ -52,14 +82,30 @@ func (d *DriverMock) ExecuteOsaScript(command ...string) (string, error) {
 	return d.ExecuteOsaResult, nil
 }
 
-func (d *DriverMock) Import(name string, path string) error {
+func (d *DriverMock) Export(ctx context.Context, name string, path string) error {
+	d.ExportCalled = true
+	d.ExportName = name
+	d.ExportPath = path
+	return d.ExportErr
+}
+
+func (d *DriverMock) Features() DriverFeatures {
+	return d.FeaturesResult
+}
+
+func (d *DriverMock) ForwardFreePort(ctx context.Context, vmName string, guestPort int, hostPortMin int, hostPortMax int) (int, error) {
+	d.ForwardFreePortCalls = append(d.ForwardFreePortCalls, []interface{}{vmName, guestPort, hostPortMin, hostPortMax})
+	return d.ForwardFreePortResult, d.ForwardFreePortErr
+}
+
+func (d *DriverMock) Import(ctx context.Context, name string, path string) error {
 	d.ImportCalled = true
 	d.ImportName = name
 	d.ImportPath = path
 	return d.ImportErr
 }
 
-func (d *DriverMock) IsRunning(name string) (bool, error) {
+func (d *DriverMock) IsRunning(ctx context.Context, name string) (bool, error) {
 	d.Lock()
 	defer d.Unlock()
 
@@ -67,12 +113,17 @@ func (d *DriverMock) IsRunning(name string) (bool, error) {
 	return d.IsRunningReturn, d.IsRunningErr
 }
 
-func (d *DriverMock) Stop(name string) error {
+func (d *DriverMock) List(ctx context.Context) ([]VMInfo, error) {
+	d.ListCalled = true
+	return d.ListResult, d.ListErr
+}
+
+func (d *DriverMock) Stop(ctx context.Context, name string) error {
 	d.StopName = name
 	return d.StopErr
 }
 
-func (d *DriverMock) Utmctl(args ...string) (string, error) {
+func (d *DriverMock) Utmctl(ctx context.Context, args ...string) (string, error) {
 	d.UtmctlCalls = append(d.UtmctlCalls, args)
 
 	if len(d.UtmctlErrs) >= len(d.UtmctlCalls) {
@@ -81,12 +132,12 @@ func (d *DriverMock) Utmctl(args ...string) (string, error) {
 	return d.UtmctlResult, nil
 }
 
-func (d *DriverMock) Verify() error {
+func (d *DriverMock) Verify(ctx context.Context) error {
 	d.VerifyCalled = true
 	return d.VerifyErr
 }
 
-func (d *DriverMock) Version() (string, error) {
+func (d *DriverMock) Version(ctx context.Context) (string, error) {
 	d.VersionCalled = true
 	return d.VersionResult, d.VersionErr
 }
@@ -0,0 +1,62 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"testing"
+)
+
+func TestNewDriverForVersion(t *testing.T) {
+	tcs := []struct {
+		Version string
+		Driver  Driver
+		Err     bool
+	}{
+		{Version: "4.4.5", Err: true},
+		{Version: "4.5.0", Driver: &Utm45Driver{}},
+		{Version: "4.5.4", Driver: &Utm45Driver{}},
+		{Version: "4.6.0", Driver: &Utm46Driver{}},
+		{Version: "4.7.1", Driver: &Utm46Driver{}},
+		{Version: "foo", Err: true},
+	}
+
+	for _, tc := range tcs {
+		driver, err := newDriverForVersion(Utm45Driver{UtmctlPath: "utmctl"}, tc.Version)
+		if tc.Err {
+			if err == nil {
+				t.Fatalf("%s: should error", tc.Version)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: err: %s", tc.Version, err)
+		}
+
+		switch tc.Driver.(type) {
+		case *Utm45Driver:
+			if _, ok := driver.(*Utm45Driver); !ok {
+				t.Fatalf("%s: expected Utm45Driver, got %T", tc.Version, driver)
+			}
+		case *Utm46Driver:
+			if _, ok := driver.(*Utm46Driver); !ok {
+				t.Fatalf("%s: expected Utm46Driver, got %T", tc.Version, driver)
+			}
+		}
+	}
+}
+
+func TestDriverFeatures(t *testing.T) {
+	if (&Utm45Driver{}).Features().ScriptedExport {
+		t.Fatal("UTM 4.5 should not support scripted export")
+	}
+	if (&Utm45Driver{}).Features().ImportNaming {
+		t.Fatal("UTM 4.5 should not support import naming")
+	}
+	if !(&Utm46Driver{}).Features().ScriptedExport {
+		t.Fatal("UTM 4.6 should support scripted export")
+	}
+	if !(&Utm46Driver{}).Features().ImportNaming {
+		t.Fatal("UTM 4.6 should support import naming")
+	}
+}
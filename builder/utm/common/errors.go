@@ -0,0 +1,179 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrVMNotFound means UTM has no VM with the given name or UUID.
+	ErrVMNotFound = errors.New("virtual machine not found")
+
+	// ErrUTMNotRunning means UTM is not running or could not be reached.
+	ErrUTMNotRunning = errors.New("UTM is not running")
+
+	// ErrAutomationDenied means macOS did not allow us to send
+	// Apple Events to UTM (System Settings > Privacy & Security > Automation).
+	ErrAutomationDenied = errors.New("not allowed to control UTM through AppleScript")
+
+	// ErrInvalidConfig means UTM rejected a VM configuration or a parameter.
+	ErrInvalidConfig = errors.New("invalid virtual machine configuration")
+)
+
+// AppleScript / Apple Event error numbers we know how to classify.
+// See the "AppleScript Error Codes" section of the AppleScript Language Guide.
+const (
+	errProcNotFound         = -600
+	errConnectionInvalid    = -609
+	errAECoercionFail       = -1700
+	errAEWrongDataType      = -1703
+	errAEEventTimedOut      = -1712
+	errAEParamMissed        = -1715
+	errAEIllegalIndex       = -1719
+	errAENoSuchObject       = -1728
+	errAEEventNotPermitted  = -1743
+	errAEEventFailed        = -10000
+	errAEPrivilegeViolation = -10004
+	errOSACantLaunch        = -10810
+)
+
+// The exit code of utmctl when its arguments are wrong, the usage error
+// of its argument parser (EX_USAGE). Other failures all exit with 1, so
+// only the Apple Event number and stderr tell them apart.
+const utmctlExitUsage = 64
+
+// UtmctlError is returned when utmctl exits with a non-zero status.
+// Use errors.Is with the Err* sentinels to find out what went wrong.
+type UtmctlError struct {
+	// The arguments utmctl was called with
+	Args []string
+	// The exit code of utmctl
+	ExitCode int
+	// The Apple Event error number, 0 if none was reported
+	Number int
+	// The (trimmed) stderr of utmctl
+	Stderr string
+	// One of the Err* sentinels, or nil if the error is unknown
+	Err error
+}
+
+func (e *UtmctlError) Error() string {
+	return fmt.Sprintf("Utmctl error: %s", e.Stderr)
+}
+
+func (e *UtmctlError) Unwrap() error {
+	return e.Err
+}
+
+// OsaScriptError is returned when osascript exits with a non-zero status.
+// Use errors.Is with the Err* sentinels to find out what went wrong.
+type OsaScriptError struct {
+	// The script name, or the inline script that was executed
+	Script string
+	// The AppleScript error number, 0 if none was reported
+	Number int
+	// The AppleScript error message
+	Message string
+	// The (trimmed) stderr of osascript
+	Stderr string
+	// One of the Err* sentinels, or nil if the error is unknown
+	Err error
+}
+
+func (e *OsaScriptError) Error() string {
+	if e.Number == 0 {
+		return fmt.Sprintf("osascript error: %s", e.Stderr)
+	}
+	return fmt.Sprintf("osascript error: %s (%d)", e.Message, e.Number)
+}
+
+func (e *OsaScriptError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	// osascript reports "0:75: execution error: UTM got an error: ... (-1728)"
+	osaErrorRe = regexp.MustCompile(`(?s)^(?:\d+:\d+: )?(?:execution error: )?(.*?)\s*\((-?\d+)\)$`)
+	// utmctl reports "Error from event: ... (OSStatus error -1743.)"
+	osStatusRe = regexp.MustCompile(`OSStatus error (-?\d+)`)
+)
+
+// newOsaScriptError builds an OsaScriptError from the stderr of osascript.
+func newOsaScriptError(script string, stderr string) *OsaScriptError {
+	e := &OsaScriptError{
+		Script:  script,
+		Message: stderr,
+		Stderr:  stderr,
+	}
+	if m := osaErrorRe.FindStringSubmatch(stderr); m != nil {
+		e.Message = m[1]
+		e.Number, _ = strconv.Atoi(m[2])
+	}
+	e.Err = classifyError(e.Number, e.Message)
+	return e
+}
+
+// newUtmctlError builds an UtmctlError from the exit code and stderr of utmctl.
+func newUtmctlError(args []string, exitCode int, stderr string) *UtmctlError {
+	number := 0
+	if m := osStatusRe.FindStringSubmatch(stderr); m != nil {
+		number, _ = strconv.Atoi(m[1])
+	}
+	err := classifyError(number, stderr)
+	switch {
+	case err != nil:
+	case exitCode == utmctlExitUsage:
+		// utmctl rejected its arguments before sending any Apple Event
+		err = ErrInvalidConfig
+	case number == errAENoSuchObject && len(args) > 1:
+		// utmctl does not say which object is missing, but the only one
+		// its commands with an identifier look up is the VM
+		err = ErrVMNotFound
+	}
+	return &UtmctlError{
+		Args:     args,
+		ExitCode: exitCode,
+		Number:   number,
+		Stderr:   stderr,
+		Err:      err,
+	}
+}
+
+// classifyError maps an AppleScript error number and/or message
+// to one of the Err* sentinels, or nil if it is not one we know.
+// errAENoSuchObject is reported for any missing object, such as an
+// application or an argument, so only its message tells a missing VM.
+func classifyError(number int, message string) error {
+	switch number {
+	case errProcNotFound, errConnectionInvalid, errOSACantLaunch:
+		return ErrUTMNotRunning
+	case errAEEventNotPermitted, errAEPrivilegeViolation:
+		return ErrAutomationDenied
+	case errAECoercionFail, errAEWrongDataType, errAEParamMissed, errAEIllegalIndex:
+		return ErrInvalidConfig
+	}
+
+	// utmctl reports some errors without a number
+	msg := strings.ToLower(message)
+	switch {
+	case strings.Contains(msg, "virtual machine not found"),
+		strings.Contains(msg, "can’t get virtual machine"),
+		strings.Contains(msg, "can't get virtual machine"):
+		return ErrVMNotFound
+	case strings.Contains(msg, "application not found"),
+		strings.Contains(msg, "isn’t running"),
+		strings.Contains(msg, "isn't running"):
+		return ErrUTMNotRunning
+	case strings.Contains(msg, "not authorized to send apple events"):
+		return ErrAutomationDenied
+	case number == errAEEventFailed && strings.Contains(msg, "config"):
+		return ErrInvalidConfig
+	case strings.Contains(msg, "invalid configuration"):
+		return ErrInvalidConfig
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestNewOsaScriptError(t *testing.T) {
+	tcs := []struct {
+		Stderr  string
+		Number  int
+		Message string
+		Err     error
+	}{
+		{
+			Stderr:  `0:133: execution error: UTM got an error: Can’t get virtual machine "foo". (-1728)`,
+			Number:  -1728,
+			Message: `UTM got an error: Can’t get virtual machine "foo".`,
+			Err:     ErrVMNotFound,
+		},
+		{
+			// Not every missing object is a VM
+			Stderr:  `0:67: execution error: System Events got an error: Can’t get application "UTM". (-1728)`,
+			Number:  -1728,
+			Message: `System Events got an error: Can’t get application "UTM".`,
+			Err:     nil,
+		},
+		{
+			Stderr:  `0:42: execution error: Can’t get item 2 of argv. (-1728)`,
+			Number:  -1728,
+			Message: `Can’t get item 2 of argv.`,
+			Err:     nil,
+		},
+		{
+			Stderr:  `0:63: execution error: Not authorized to send Apple events to UTM. (-1743)`,
+			Number:  -1743,
+			Message: `Not authorized to send Apple events to UTM.`,
+			Err:     ErrAutomationDenied,
+		},
+		{
+			Stderr:  `0:50: execution error: UTM got an error: Application isn’t running. (-600)`,
+			Number:  -600,
+			Message: `UTM got an error: Application isn’t running.`,
+			Err:     ErrUTMNotRunning,
+		},
+		{
+			Stderr:  `0:88: execution error: UTM got an error: Can’t make "x" into type integer. (-1700)`,
+			Number:  -1700,
+			Message: `UTM got an error: Can’t make "x" into type integer.`,
+			Err:     ErrInvalidConfig,
+		},
+		{
+			Stderr:  `something unexpected`,
+			Number:  0,
+			Message: `something unexpected`,
+			Err:     nil,
+		},
+	}
+
+	for _, tc := range tcs {
+		err := newOsaScriptError("foo.applescript", tc.Stderr)
+		if err.Number != tc.Number {
+			t.Fatalf("%s: bad number: %d", tc.Stderr, err.Number)
+		}
+		if err.Message != tc.Message {
+			t.Fatalf("%s: bad message: %q", tc.Stderr, err.Message)
+		}
+		if err.Err != tc.Err {
+			t.Fatalf("%s: bad classification: %v", tc.Stderr, err.Err)
+		}
+	}
+}
+
+func TestNewUtmctlError(t *testing.T) {
+	tcs := []struct {
+		Stderr string
+		Err    error
+	}{
+		{Stderr: "Error: Virtual machine not found.", Err: ErrVMNotFound},
+		{Stderr: "Error from event: The operation couldn’t be completed. (OSStatus error -1728.)", Err: ErrVMNotFound},
+		{Stderr: "Error from event: The operation couldn’t be completed. (OSStatus error -1743.)", Err: ErrAutomationDenied},
+		{Stderr: "Error from event: The operation couldn’t be completed. (OSStatus error -600.)", Err: ErrUTMNotRunning},
+		{Stderr: "Error: Application not found.", Err: ErrUTMNotRunning},
+		{Stderr: "Error: Something else.", Err: nil},
+	}
+
+	for _, tc := range tcs {
+		err := newUtmctlError([]string{"status", "foo"}, 1, tc.Stderr)
+		if err.Err != tc.Err {
+			t.Fatalf("%s: bad classification: %v", tc.Stderr, err.Err)
+		}
+	}
+
+	// Only the exit code tells that the arguments were wrong
+	if err := newUtmctlError([]string{"start"}, 64,
+		"Error: Missing expected argument '<identifier>'"); err.Err != ErrInvalidConfig {
+		t.Fatalf("bad classification: %v", err.Err)
+	}
+
+	// Without an identifier, utmctl looked up something else
+	if err := newUtmctlError([]string{"list"}, 1,
+		"Error from event: The operation couldn’t be completed. (OSStatus error -1728.)"); err.Err != nil {
+		t.Fatalf("bad classification: %v", err.Err)
+	}
+}
+
+func TestErrorsIs(t *testing.T) {
+	var err error = newUtmctlError([]string{"delete", "foo"}, 1, "Error: Virtual machine not found.")
+	err = fmt.Errorf("error deleting VM: %w", err)
+
+	if !errors.Is(err, ErrVMNotFound) {
+		t.Fatal("should be ErrVMNotFound")
+	}
+	if errors.Is(err, ErrUTMNotRunning) {
+		t.Fatal("should not be ErrUTMNotRunning")
+	}
+
+	var utmctlErr *UtmctlError
+	if !errors.As(err, &utmctlErr) {
+		t.Fatal("should be an UtmctlError")
+	}
+	if utmctlErr.ExitCode != 1 {
+		t.Fatalf("bad: %d", utmctlErr.ExitCode)
+	}
+}
@@ -0,0 +1,105 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// An Executor runs the commands the driver needs, such as utmctl and
+// osascript. The driver only talks to UTM through it, so swapping the
+// executor lets the driver run against something other than the local
+// UTM, like the SimulatedUTM in tests.
+type Executor interface {
+	// Execute runs name with the given arguments, writing stdin (if not
+	// nil) to its standard input, and returns its stdout and stderr.
+	// A non-zero exit status is returned as an *ExitError.
+	Execute(ctx context.Context, stdin []byte, name string, args ...string) (string, string, error)
+}
+
+// ExitError reports that a command exited with a non-zero status.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// LocalExecutor runs commands on this machine.
+type LocalExecutor struct{}
+
+func (e *LocalExecutor) Execute(ctx context.Context, stdin []byte, name string, args ...string) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := newCommand(ctx, name, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		err = &ExitError{Code: exitErr.ExitCode()}
+	}
+
+	return stdout.String(), stderr.String(), err
+}
+
+// RecordingExecutor records the commands it is asked to run, without
+// running them, and reports that they succeeded with no output.
+// It backs the driver of dry runs.
+type RecordingExecutor struct {
+	sync.Mutex
+
+	// The commands, the embedded scripts are
+	// recorded as "osascript <script name> <args...>"
+	Commands [][]string
+}
+
+func (e *RecordingExecutor) Execute(ctx context.Context, stdin []byte, name string, args ...string) (string, string, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	command := append([]string{name}, args...)
+	if name == "osascript" && len(args) >= 1 && args[0] == "-" {
+		command = append([]string{name, embeddedScriptName(stdin)}, args[1:]...)
+	}
+	e.Commands = append(e.Commands, command)
+	return "", "", ctx.Err()
+}
+
+// embeddedScriptName returns the name of the embedded script
+// with the given content, or "-" if it is not one of ours.
+func embeddedScriptName(content []byte) string {
+	entries, err := osascripts.ReadDir("scripts")
+	if err != nil {
+		return "-"
+	}
+	for _, entry := range entries {
+		script, err := osascripts.ReadFile("scripts/" + entry.Name())
+		if err == nil && bytes.Equal(script, content) {
+			return entry.Name()
+		}
+	}
+	return "-"
+}
+
+// newCommand returns a command that runs in its own process group.
+// When ctx is done the whole group is killed, so helpers spawned by
+// osascript (or a modal dialog waiting in UTM) can't keep us hanging.
+func newCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	// Don't wait forever for output pipes held open by orphaned children
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
+}
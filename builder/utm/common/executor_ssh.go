@@ -0,0 +1,263 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHExecutor runs commands on a remote UTM host over SSH.
+type SSHExecutor struct {
+	client *ssh.Client
+	agent  net.Conn
+}
+
+// NewSSHExecutor connects to the UTM host described by config.
+func NewSSHExecutor(config *RemoteConfig) (*SSHExecutor, error) {
+	e := &SSHExecutor{}
+
+	var auth []ssh.AuthMethod
+	if config.UtmHostPrivateKeyFile != "" {
+		key, err := os.ReadFile(config.UtmHostPrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading utm_host_private_key_file: %s", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing utm_host_private_key_file: %s", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			log.Printf("Not using the SSH agent at %s: %s", socket, err)
+		} else {
+			e.agent = conn
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("no way to log into the UTM host, " +
+			"set utm_host_private_key_file or run an SSH agent")
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !config.UtmHostSkipHostKeyCheck {
+		var err error
+		hostKeyCallback, err = knownhosts.New(config.UtmHostKnownHostsFile)
+		if err != nil {
+			e.Close()
+			return nil, fmt.Errorf("error reading utm_host_known_hosts_file: %s", err)
+		}
+	}
+
+	addr := net.JoinHostPort(config.UtmHost, strconv.Itoa(config.UtmHostPort))
+	log.Printf("Connecting to UTM host %s@%s", config.UtmHostUser, addr)
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            config.UtmHostUser,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		e.Close()
+		return nil, fmt.Errorf("error connecting to UTM host %s: %s", addr, err)
+	}
+	e.client = client
+
+	return e, nil
+}
+
+// Execute runs the command through the login shell of the UTM host.
+// stdin is streamed to the command, so the embedded AppleScripts
+// never have to be copied to the host.
+func (e *SSHExecutor) Execute(ctx context.Context, stdin []byte, name string, args ...string) (string, string, error) {
+	session, err := e.client.NewSession()
+	if err != nil {
+		return "", "", fmt.Errorf("error opening SSH session: %s", err)
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	if stdin != nil {
+		session.Stdin = bytes.NewReader(stdin)
+	}
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+
+	if err := session.Start(shellQuote(append([]string{name}, args...))); err != nil {
+		return "", "", fmt.Errorf("error starting %s on UTM host: %s", name, err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- session.Wait() }()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// Not every sshd delivers signals,
+		// closing the session at least hangs up on the command.
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		<-done
+		err = ctx.Err()
+	}
+
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		err = &ExitError{Code: exitErr.ExitStatus()}
+	}
+
+	return stdout.String(), stderr.String(), err
+}
+
+// Forward listens on a local port and forwards every connection to
+// remoteAddr on the UTM host through the SSH connection, like ssh -L.
+// Closing the listener stops forwarding.
+func (e *SSHExecutor) Forward(remoteAddr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go e.forward(conn, remoteAddr)
+		}
+	}()
+
+	return l, nil
+}
+
+func (e *SSHExecutor) forward(local net.Conn, remoteAddr string) {
+	defer local.Close()
+
+	remote, err := e.client.Dial("tcp", remoteAddr)
+	if err != nil {
+		log.Printf("Error forwarding to %s on UTM host: %s", remoteAddr, err)
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// lockScript takes an exclusive flock on the file named by its argument,
+// prints "locked" and holds the lock until its stdin is closed. While
+// waiting it prints dots, so it dies of SIGPIPE once we hang up. Like
+// FileLock, it creates the file with mode 0666 whatever the umask.
+const lockScript = `use Fcntl qw(:flock);
+$| = 1;
+umask(0);
+open(my $f, ">>", $ARGV[0]) or die "$ARGV[0]: $!\n";
+until (flock($f, LOCK_EX | LOCK_NB)) { print "."; sleep 1; }
+print "locked\n";
+<STDIN>;`
+
+// HostLock returns a lock on the file at path on the UTM host. It is held
+// by a process on the host, and released when the SSH connection drops.
+func (e *SSHExecutor) HostLock(path string) HostLock {
+	return &sshFileLock{executor: e, path: path}
+}
+
+type sshFileLock struct {
+	executor *SSHExecutor
+	path     string
+}
+
+func (l *sshFileLock) Lock(ctx context.Context) (func(), error) {
+	session, err := l.executor.client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("error opening SSH session: %s", err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	if err := session.Start(shellQuote([]string{"perl", "-e", lockScript, l.path})); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("error locking %s on UTM host: %s", l.path, err)
+	}
+
+	locked := make(chan error, 1)
+	go func() {
+		_, err := bufio.NewReader(stdout).ReadString('\n')
+		locked <- err
+	}()
+
+	select {
+	case err = <-locked:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		session.Close()
+		if ctx.Err() == nil {
+			err = fmt.Errorf("error locking %s on UTM host: %s %s", l.path, err, strings.TrimSpace(stderr.String()))
+		}
+		return nil, err
+	}
+
+	return func() {
+		stdin.Close()
+		session.Wait()
+		session.Close()
+	}, nil
+}
+
+// Close disconnects from the UTM host.
+func (e *SSHExecutor) Close() error {
+	if e.agent != nil {
+		e.agent.Close()
+	}
+	if e.client != nil {
+		return e.client.Close()
+	}
+	return nil
+}
+
+// shellQuote joins a command line, quoting every argument
+// so the remote shell passes it through unchanged.
+func shellQuote(command []string) string {
+	quoted := make([]string, len(command))
+	for i, arg := range command {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
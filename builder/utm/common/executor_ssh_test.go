@@ -0,0 +1,238 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRemoteConfig starts a SimulatedUTMHost in front of utm
+// and returns the config to connect to it.
+func testRemoteConfig(t *testing.T, utm *SimulatedUTM) *RemoteConfig {
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	host, err := NewSimulatedUTMHost(utm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	t.Cleanup(func() { host.Close() })
+
+	config, err := host.RemoteConfig(t.TempDir())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return config
+}
+
+func testSSHExecutor(t *testing.T, config *RemoteConfig) *SSHExecutor {
+	executor, err := NewSSHExecutor(config)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	t.Cleanup(func() { executor.Close() })
+	return executor
+}
+
+func TestSSHExecutor_impl(t *testing.T) {
+	var _ Executor = new(SSHExecutor)
+	var _ Forwarder = new(SSHExecutor)
+}
+
+func TestSSHExecutor_Driver(t *testing.T) {
+	utm := NewSimulatedUTM("4.6.4")
+	utm.AddVM("remote vm")
+	executor := testSSHExecutor(t, testRemoteConfig(t, utm))
+
+	driver, err := NewDriverWithExecutor(context.Background(), &DriverConfig{}, executor, defaultUtmctlPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ctx := context.Background()
+
+	// Arguments with spaces survive the remote shell
+	if _, err := driver.Utmctl(ctx, "start", "remote vm"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if running, err := driver.IsRunning(ctx, "remote vm"); err != nil || !running {
+		t.Fatalf("bad: %t %v", running, err)
+	}
+
+	// Scripts are streamed over stdin
+	if _, err := driver.ExecuteOsaScript(ctx, "add_port_forwards.applescript", "remote vm",
+		"--index", "1", "TcPp,,22,127.0.0.1,2222"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if forwards := utm.VM("remote vm").NetworkInterfaces[1].PortForwards; len(forwards) != 1 {
+		t.Fatalf("bad: %#v", forwards)
+	}
+
+	// Errors are classified like local ones
+	if _, err := driver.Utmctl(ctx, "stop", "missing"); !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("bad: %#v", err)
+	}
+}
+
+func TestSSHExecutor_ForwardFreePort(t *testing.T) {
+	utm := NewSimulatedUTM("4.6.4")
+	utm.AddVM("remote vm")
+	other := utm.AddVM("other vm")
+	executor := testSSHExecutor(t, testRemoteConfig(t, utm))
+	driver, err := NewDriverWithExecutor(context.Background(), &DriverConfig{}, executor, defaultUtmctlPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Three free ports: one in use on the host, one forwarded
+	// to another VM, and the one to pick
+	var base int
+	for base = 42000; base < 43000; base += 3 {
+		free := true
+		for port := base; port < base+3 && free; port++ {
+			l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+			if free = err == nil; free {
+				l.Close()
+			}
+		}
+		if free {
+			break
+		}
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", base))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer l.Close()
+	other.NetworkInterfaces[1].PortForwards = []SimulatedPortForward{{HostPort: base + 1}}
+
+	port, err := driver.ForwardFreePort(context.Background(), "remote vm", 22, base, base+2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if port != base+2 {
+		t.Fatalf("bad port: %d, expected %d", port, base+2)
+	}
+	forwards := utm.VM("remote vm").NetworkInterfaces[1].PortForwards
+	if len(forwards) != 1 || forwards[0].HostPort != port || forwards[0].GuestPort != 22 {
+		t.Fatalf("bad: %#v", forwards)
+	}
+
+	// Every port is taken now
+	if _, err := driver.ForwardFreePort(context.Background(), "other vm", 22, base, base+2); err == nil ||
+		!strings.Contains(err.Error(), "no free port") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestSSHExecutor_UnknownHostKey(t *testing.T) {
+	config := testRemoteConfig(t, NewSimulatedUTM("4.6.4"))
+	if err := os.WriteFile(config.UtmHostKnownHostsFile, nil, 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := NewSSHExecutor(config); err == nil {
+		t.Fatal("should not connect to an unknown host")
+	}
+
+	config.UtmHostSkipHostKeyCheck = true
+	testSSHExecutor(t, config)
+}
+
+func TestSSHExecutor_Forward(t *testing.T) {
+	executor := testSSHExecutor(t, testRemoteConfig(t, NewSimulatedUTM("4.6.4")))
+
+	// An echo server standing in for the guest
+	guest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer guest.Close()
+	go func() {
+		for {
+			conn, err := guest.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	l, err := executor.Forward(guest.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(reply) != "ping" {
+		t.Fatalf("bad: %q", reply)
+	}
+}
+
+func TestRemoteOutputDir(t *testing.T) {
+	executor := testSSHExecutor(t, testRemoteConfig(t, NewSimulatedUTM("4.6.4")))
+
+	dir := &RemoteOutputDir{Executor: executor}
+	dir.SetOutputDir(filepath.Join(t.TempDir(), "output dir"))
+
+	if exists, err := dir.DirExists(); err != nil || exists {
+		t.Fatalf("bad: %t %v", exists, err)
+	}
+	if err := dir.MkdirAll(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if exists, err := dir.DirExists(); err != nil || !exists {
+		t.Fatalf("bad: %t %v", exists, err)
+	}
+
+	file := filepath.Join(dir.String(), "vm.utm", "config.plist")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.WriteFile(file, []byte("plist"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if files, err := dir.ListFiles(); err != nil || len(files) != 1 || files[0] != file {
+		t.Fatalf("bad: %#v %v", files, err)
+	}
+
+	if _, err := dir.ReadFile("state.json"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("should not exist: %v", err)
+	}
+	if err := dir.WriteFile("state.json", []byte("{}\n")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if data, err := dir.ReadFile("state.json"); err != nil || string(data) != "{}\n" {
+		t.Fatalf("bad: %q %v", data, err)
+	}
+
+	if err := dir.RemoveAll(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := os.Stat(dir.String()); !os.IsNotExist(err) {
+		t.Fatalf("should be removed: %v", err)
+	}
+}
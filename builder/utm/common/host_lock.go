@@ -0,0 +1,67 @@
+package common
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// The lock file shared by every Packer process using the UTM host.
+// It is not in os.TempDir() as that differs between the desktop
+// session and SSH sessions on macOS.
+const hostLockPath = "/tmp/packer-plugin-utm.lock"
+
+// A HostLock serializes operations with the other Packer processes
+// using the same UTM host, such as the AppleScripts that read, modify
+// and write back a VM configuration, which UTM does not serialize.
+type HostLock interface {
+	// Lock blocks until the lock is acquired or ctx is done.
+	// The returned function releases the lock.
+	Lock(ctx context.Context) (func(), error)
+}
+
+// hostLocker is implemented by the executors which can lock a file on
+// the UTM host. A process holding such a lock must release it on exit,
+// so a crashed build does not block the others.
+type hostLocker interface {
+	HostLock(path string) HostLock
+}
+
+// FileLock is a HostLock using flock(2) on a file of this machine.
+// The file is created readable and writable by everyone, whatever the
+// umask, so the builds of the other users can lock it too.
+type FileLock struct {
+	Path string
+}
+
+func (l *FileLock) Lock(ctx context.Context) (func(), error) {
+	if err := createLockFile(l.Path); err != nil {
+		return nil, err
+	}
+	f := flock.New(l.Path)
+	if _, err := f.TryLockContext(ctx, 100*time.Millisecond); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Unlock() }, nil
+}
+
+// createLockFile creates the lock file at path with mode 0666
+// if it does not exist.
+func createLockFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDONLY, 0666)
+	if os.IsExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Chmod(path, 0666)
+}
+
+func (e *LocalExecutor) HostLock(path string) HostLock {
+	return &FileLock{Path: path}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testHostLock checks that a second holder of the lock has to wait
+// for the first one, and can give up.
+func testHostLock(t *testing.T, first, second HostLock) {
+	ctx := context.Background()
+
+	unlock, err := first.Lock(ctx)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if _, err := second.Lock(timeoutCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("should time out: %v", err)
+	}
+
+	unlock()
+
+	timeoutCtx, cancel = context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	unlock, err = second.Lock(timeoutCtx)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	unlock()
+}
+
+func TestFileLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "utm.lock")
+	testHostLock(t, &FileLock{Path: path}, &FileLock{Path: path})
+	testLockFileMode(t, path)
+}
+
+// testLockFileMode checks that the other users can lock the file too.
+func testLockFileMode(t *testing.T, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if info.Mode().Perm() != 0666 {
+		t.Fatalf("bad mode: %s", info.Mode())
+	}
+}
+
+func TestSSHExecutor_HostLock(t *testing.T) {
+	config := testRemoteConfig(t, NewSimulatedUTM("4.6.4"))
+	path := filepath.Join(t.TempDir(), "utm.lock")
+
+	// Two connections, like two Packer processes
+	first := testSSHExecutor(t, config).HostLock(path)
+	second := testSSHExecutor(t, config).HostLock(path)
+	testHostLock(t, first, second)
+	testLockFileMode(t, path)
+}
+
+// testLockedExecutor records which commands run while holding Lock.
+type testLockedExecutor struct {
+	Executor
+	Lock   *fakeHostLock
+	Locked map[string]bool
+}
+
+type fakeHostLock struct {
+	held bool
+}
+
+func (l *fakeHostLock) Lock(ctx context.Context) (func(), error) {
+	l.held = true
+	return func() { l.held = false }, nil
+}
+
+func (e *testLockedExecutor) Execute(ctx context.Context, stdin []byte, name string, args ...string) (string, string, error) {
+	command := name
+	if name == "osascript" {
+		command = embeddedScriptName(stdin)
+	} else if len(args) > 0 {
+		command = args[0]
+	}
+	e.Locked[command] = e.Lock.held
+	return e.Executor.Execute(ctx, stdin, name, args...)
+}
+
+func TestUtm46Driver_HostLock(t *testing.T) {
+	utm := NewSimulatedUTM("4.6.4")
+	utm.AddVM("vm")
+	lock := &fakeHostLock{}
+	executor := &testLockedExecutor{Executor: utm, Lock: lock, Locked: map[string]bool{}}
+	driver := &Utm46Driver{Utm45Driver{UtmctlPath: "utmctl", Executor: executor, Lock: lock}}
+	ctx := context.Background()
+
+	if _, err := driver.Utmctl(ctx, "status", "vm"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := driver.ExecuteOsaScript(ctx, "clear_network_interfaces.applescript", "vm"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The copies of imports and clones do not hold the lock for long,
+	// only the renaming of the imported VM rewrites its configuration
+	bundle := filepath.Join(t.TempDir(), "source.utm")
+	if err := os.Mkdir(bundle, 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := driver.Import(ctx, "imported", bundle); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := driver.Clone(ctx, "vm", "clone"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if executor.Locked["status"] || executor.Locked["clone"] {
+		t.Fatalf("utmctl should not be locked: %#v", executor.Locked)
+	}
+	if executor.Locked["import_vm.applescript"] {
+		t.Fatal("import should not be locked")
+	}
+	if !executor.Locked["clear_network_interfaces.applescript"] || !executor.Locked["rename_vm.applescript"] {
+		t.Fatalf("scripts should be locked: %#v", executor.Locked)
+	}
+	if utm.VM("imported") == nil || utm.VM("clone") == nil {
+		t.Fatalf("bad VMs: %#v", utm.VMs())
+	}
+	if lock.held {
+		t.Fatal("lock should be released")
+	}
+}
+
+func TestUtm45Driver_HostLockTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "utm.lock")
+	unlock, err := (&FileLock{Path: path}).Lock(context.Background())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer unlock()
+
+	utm := NewSimulatedUTM("4.6.4")
+	utm.AddVM("vm")
+	driver := &Utm45Driver{
+		UtmctlPath:  "utmctl",
+		Executor:    utm,
+		Lock:        &FileLock{Path: path},
+		LockTimeout: 200 * time.Millisecond,
+	}
+
+	_, err = driver.ExecuteOsaScript(context.Background(), "clear_network_interfaces.applescript", "vm")
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("should time out: %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// OutputDir abstracts the handling of the output directory, so it can
+// live on a remote UTM host as well as on the machine running Packer.
+type OutputDir interface {
+	DirExists() (bool, error)
+	ListFiles() ([]string, error)
+	MkdirAll() error
+	// ReadFile and WriteFile handle the file name in the directory,
+	// ReadFile fails with an os.ErrNotExist error when it is missing
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte) error
+	Remove(string) error
+	RemoveAll() error
+	SetOutputDir(string)
+	String() string
+}
+
+// LocalOutputDir is an OutputDir on the machine running Packer.
+type LocalOutputDir struct {
+	dir string
+}
+
+func (d *LocalOutputDir) DirExists() (bool, error) {
+	_, err := os.Stat(d.dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *LocalOutputDir) ListFiles() ([]string, error) {
+	files := make([]string, 0, 10)
+
+	visit := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	}
+
+	return files, filepath.Walk(d.dir, visit)
+}
+
+func (d *LocalOutputDir) MkdirAll() error {
+	return os.MkdirAll(d.dir, 0755)
+}
+
+func (d *LocalOutputDir) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(d.dir, name))
+}
+
+func (d *LocalOutputDir) WriteFile(name string, data []byte) error {
+	return os.WriteFile(filepath.Join(d.dir, name), data, 0644)
+}
+
+func (d *LocalOutputDir) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (d *LocalOutputDir) RemoveAll() error {
+	return os.RemoveAll(d.dir)
+}
+
+func (d *LocalOutputDir) SetOutputDir(path string) {
+	d.dir = path
+}
+
+func (d *LocalOutputDir) String() string {
+	return d.dir
+}
+
+// RemoteOutputDir is an OutputDir on the UTM host,
+// handled with shell commands run through Executor.
+type RemoteOutputDir struct {
+	Executor Executor
+
+	dir string
+}
+
+func (d *RemoteOutputDir) DirExists() (bool, error) {
+	return RemoteFileExists(d.Executor, d.dir)
+}
+
+func (d *RemoteOutputDir) ListFiles() ([]string, error) {
+	stdout, err := d.run("find", d.dir, "-type", "f")
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, 10)
+	for _, line := range strings.Split(stdout, "\n") {
+		if line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+func (d *RemoteOutputDir) MkdirAll() error {
+	_, err := d.run("mkdir", "-p", d.dir)
+	return err
+}
+
+func (d *RemoteOutputDir) ReadFile(name string) ([]byte, error) {
+	path := filepath.Join(d.dir, name)
+	exists, err := RemoteFileExists(d.Executor, path)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	stdout, err := d.run("cat", path)
+	return []byte(stdout), err
+}
+
+func (d *RemoteOutputDir) WriteFile(name string, data []byte) error {
+	path := filepath.Join(d.dir, name)
+	_, stderr, err := d.Executor.Execute(context.Background(), data, "sh", "-c", `cat > "$1"`, "sh", path)
+	if err != nil {
+		return fmt.Errorf("writing %s on UTM host failed: %s: %s", path, err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+func (d *RemoteOutputDir) Remove(path string) error {
+	_, err := d.run("rm", path)
+	return err
+}
+
+func (d *RemoteOutputDir) RemoveAll() error {
+	_, err := d.run("rm", "-rf", d.dir)
+	return err
+}
+
+func (d *RemoteOutputDir) SetOutputDir(path string) {
+	d.dir = path
+}
+
+func (d *RemoteOutputDir) String() string {
+	return d.dir
+}
+
+func (d *RemoteOutputDir) run(name string, args ...string) (string, error) {
+	stdout, stderr, err := d.Executor.Execute(context.Background(), nil, name, args...)
+	if err != nil {
+		return "", fmt.Errorf("%s on UTM host failed: %s: %s", name, err, strings.TrimSpace(stderr))
+	}
+	return stdout, nil
+}
+
+// RemoteFileExists tells if path exists on the host executor runs commands on.
+func RemoteFileExists(executor Executor, path string) (bool, error) {
+	_, stderr, err := executor.Execute(context.Background(), nil, "test", "-e", path)
+
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) && exitErr.Code == 1 {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("test on UTM host failed: %s: %s", err, strings.TrimSpace(stderr))
+	}
+	return true, nil
+}
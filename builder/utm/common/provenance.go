@@ -0,0 +1,212 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// The name of the provenance file in the output directory.
+const ProvenanceFilename = "packer-provenance.json"
+
+// The types of the provenance, an in-toto statement holding a SLSA
+// provenance predicate.
+const (
+	provenanceStatementType = "https://in-toto.io/Statement/v1"
+	provenancePredicateType = "https://slsa.dev/provenance/v1"
+	provenanceBuildType     = "https://github.com/naveenrajm7/packer-plugin-utm/builder/utm/v1"
+)
+
+// Provenance is the in-toto statement describing how the files of the
+// output directory were built.
+type Provenance struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     ProvenancePredicate  `json:"predicate"`
+}
+
+// ProvenancePredicate is a SLSA provenance.
+type ProvenancePredicate struct {
+	BuildDefinition struct {
+		BuildType          string                 `json:"buildType"`
+		ExternalParameters map[string]interface{} `json:"externalParameters"`
+		InternalParameters map[string]interface{} `json:"internalParameters,omitempty"`
+		// The source bundle and its files
+		ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies,omitempty"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID string `json:"id"`
+			// The versions of the plugin, of UTM and of Packer
+			Version map[string]string `json:"version"`
+		} `json:"builder"`
+		Metadata struct {
+			StartedOn  time.Time `json:"startedOn"`
+			FinishedOn time.Time `json:"finishedOn"`
+		} `json:"metadata"`
+		// The runs of the provisioners
+		Byproducts []ResourceDescriptor `json:"byproducts,omitempty"`
+	} `json:"runDetails"`
+}
+
+// ResourceDescriptor describes a file, or the source of a build.
+type ResourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest,omitempty"`
+
+	Annotations map[string]interface{} `json:"annotations,omitempty"`
+}
+
+// ProvisionRun records a run of the provisioners of a build.
+type ProvisionRun struct {
+	StartedOn  time.Time `json:"startedOn"`
+	FinishedOn time.Time `json:"finishedOn"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// ProvenanceHook is a hook recording when the provisioners run, the
+// provisioners themselves are hidden behind the hook Packer gives.
+type ProvenanceHook struct {
+	packersdk.Hook
+
+	mu   sync.Mutex
+	runs []ProvisionRun
+}
+
+func (h *ProvenanceHook) Run(ctx context.Context, name string, ui packersdk.Ui, comm packersdk.Communicator, data interface{}) error {
+	if name != packersdk.HookProvision {
+		return h.Hook.Run(ctx, name, ui, comm, data)
+	}
+
+	run := ProvisionRun{StartedOn: time.Now().UTC()}
+	err := h.Hook.Run(ctx, name, ui, comm, data)
+	run.FinishedOn = time.Now().UTC()
+	if err != nil {
+		run.Error = err.Error()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.runs = append(h.runs, run)
+	return err
+}
+
+// Runs returns the runs of the provisioners so far.
+func (h *ProvenanceHook) Runs() []ProvisionRun {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]ProvisionRun(nil), h.runs...)
+}
+
+// ChecksumDigest returns the digest of a checksum option, such as
+// "sha256:{$checksum}", or nil when it does not hold one.
+func ChecksumDigest(checksum string) map[string]string {
+	checksumType, value, ok := strings.Cut(checksum, ":")
+	if !ok {
+		return nil
+	}
+	switch checksumType = strings.ToLower(checksumType); checksumType {
+	case "md5", "sha1", "sha256", "sha512":
+		return map[string]string{checksumType: strings.ToLower(value)}
+	}
+	return nil
+}
+
+// FileDigests returns the sha256 digests of the files under root, by
+// their slash separated path relative to root. The files are read on
+// the host executor runs commands on, or on this machine when it is nil.
+func FileDigests(ctx context.Context, executor Executor, root string) (map[string]string, error) {
+	if executor != nil {
+		return remoteFileDigests(ctx, executor, root)
+	}
+
+	digests := map[string]string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		digests[filepath.ToSlash(rel)] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	return digests, err
+}
+
+func remoteFileDigests(ctx context.Context, executor Executor, root string) (map[string]string, error) {
+	stdout, stderr, err := executor.Execute(ctx, nil,
+		"find", root, "-type", "f", "-exec", "shasum", "-a", "256", "{}", "+")
+	if err != nil {
+		return nil, fmt.Errorf("shasum on UTM host failed: %s: %s", err, strings.TrimSpace(stderr))
+	}
+
+	digests := map[string]string{}
+	for _, line := range strings.Split(stdout, "\n") {
+		digest, path, ok := strings.Cut(line, "  ")
+		if !ok {
+			continue
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil, err
+		}
+		digests[filepath.ToSlash(rel)] = digest
+	}
+	return digests, nil
+}
+
+// descriptors returns the files of digests as resource descriptors
+// named prefix followed by their path, sorted by name.
+func descriptors(prefix string, digests map[string]string) []ResourceDescriptor {
+	files := make([]ResourceDescriptor, 0, len(digests))
+	for name, digest := range digests {
+		files = append(files, ResourceDescriptor{
+			Name:   prefix + name,
+			Digest: map[string]string{"sha256": digest},
+		})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files
+}
+
+// WriteProvenance writes p in dir, and returns the path of the file.
+func WriteProvenance(dir OutputDir, p *Provenance) (string, error) {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := dir.WriteFile(ProvenanceFilename, append(data, '\n')); err != nil {
+		return "", fmt.Errorf("error writing provenance: %s", err)
+	}
+	return filepath.Join(dir.String(), ProvenanceFilename), nil
+}
@@ -0,0 +1,48 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestChecksumDigest(t *testing.T) {
+	cases := map[string]map[string]string{
+		"sha256:ABC":              {"sha256": "abc"},
+		"md5:abc":                 {"md5": "abc"},
+		"abc":                     nil,
+		"none":                    nil,
+		"file:./local/SHA256SUMS": nil,
+	}
+	for checksum, expected := range cases {
+		if digest := ChecksumDigest(checksum); !reflect.DeepEqual(digest, expected) {
+			t.Fatalf("bad digest of %s: %#v", checksum, digest)
+		}
+	}
+}
+
+func TestFileDigests(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "Data"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Data", "disk.qcow2"), []byte("disk"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	digests, err := FileDigests(context.Background(), nil, dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := map[string]string{
+		"Data/disk.qcow2": "1044dec7206e8d7c9fbb4ae8f766668406d2567fc7fc1a160a9d4700fcf8f8e9",
+	}
+	if !reflect.DeepEqual(digests, expected) {
+		t.Fatalf("bad digests: %#v", digests)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:generate packer-sdc struct-markdown
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+type RemoteConfig struct {
+	// The macOS host running UTM. When set, every `utmctl` and `osascript`
+	// call, as well as the output directory handling, happens on this host
+	// over SSH, and `source_path` and `output_directory` are paths on it.
+	// The communicator reaches the guest through the same SSH connection,
+	// so `skip_nat_mapping` can't be used with it.
+	// By default UTM runs on the machine running Packer.
+	UtmHost string `mapstructure:"utm_host" required:"false"`
+	// The SSH port of `utm_host`. By default this is 22.
+	UtmHostPort int `mapstructure:"utm_host_port" required:"false"`
+	// The user to log into `utm_host` as. It must be logged into the
+	// desktop session running UTM. Required when `utm_host` is set.
+	UtmHostUser string `mapstructure:"utm_host_user" required:"false"`
+	// The private key used to log into `utm_host`. Keys from the SSH agent
+	// (`SSH_AUTH_SOCK`) are tried as well.
+	UtmHostPrivateKeyFile string `mapstructure:"utm_host_private_key_file" required:"false"`
+	// The known_hosts file used to verify the key of `utm_host`.
+	// By default this is ~/.ssh/known_hosts.
+	UtmHostKnownHostsFile string `mapstructure:"utm_host_known_hosts_file" required:"false"`
+	// Defaults to false. When enabled, the key of `utm_host` is not verified.
+	UtmHostSkipHostKeyCheck bool `mapstructure:"utm_host_skip_host_key_check" required:"false"`
+	// The path of `utmctl` on `utm_host`.
+	// By default this is /Applications/UTM.app/Contents/MacOS/utmctl.
+	UtmHostUtmctlPath string `mapstructure:"utm_host_utmctl_path" required:"false"`
+}
+
+func (c *RemoteConfig) Prepare(ctx *interpolate.Context) []error {
+	if c.UtmHost == "" {
+		return nil
+	}
+
+	if c.UtmHostPort == 0 {
+		c.UtmHostPort = 22
+	}
+
+	if c.UtmHostUtmctlPath == "" {
+		c.UtmHostUtmctlPath = defaultUtmctlPath
+	}
+
+	var errs []error
+	if c.UtmHostUser == "" {
+		errs = append(errs, errors.New("utm_host_user is required when utm_host is set"))
+	}
+
+	if c.UtmHostPrivateKeyFile != "" {
+		if _, err := os.Stat(c.UtmHostPrivateKeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("utm_host_private_key_file is invalid: %s", err))
+		}
+	}
+
+	if c.UtmHostKnownHostsFile == "" && !c.UtmHostSkipHostKeyCheck {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error finding known_hosts, set utm_host_known_hosts_file: %s", err))
+		} else {
+			c.UtmHostKnownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,49 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+func TestRemoteConfigPrepare_local(t *testing.T) {
+	var c RemoteConfig
+	if errs := c.Prepare(interpolate.NewContext()); len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+	if c.UtmHostPort != 0 || c.UtmHostUtmctlPath != "" {
+		t.Fatalf("nothing should be set without utm_host: %#v", c)
+	}
+}
+
+func TestRemoteConfigPrepare_defaults(t *testing.T) {
+	c := RemoteConfig{
+		UtmHost:     "mac-mini",
+		UtmHostUser: "packer",
+	}
+	if errs := c.Prepare(interpolate.NewContext()); len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+	if c.UtmHostPort != 22 {
+		t.Fatalf("bad port: %d", c.UtmHostPort)
+	}
+	if c.UtmHostUtmctlPath != defaultUtmctlPath {
+		t.Fatalf("bad utmctl path: %s", c.UtmHostUtmctlPath)
+	}
+	if c.UtmHostKnownHostsFile == "" {
+		t.Fatal("known_hosts should default to the one of the user")
+	}
+}
+
+func TestRemoteConfigPrepare_errors(t *testing.T) {
+	c := RemoteConfig{
+		UtmHost:               "mac-mini",
+		UtmHostPrivateKeyFile: "/i/dont/exist",
+	}
+	if errs := c.Prepare(interpolate.NewContext()); len(errs) != 2 {
+		t.Fatalf("should error on missing user and key: %#v", errs)
+	}
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// RetryPolicy retries driver calls that failed with a transient UTM
+// error, such as the scripting bridge not being ready right after UTM
+// launched, with exponential backoff.
+type RetryPolicy struct {
+	// The maximum number of attempts, including the first one.
+	// Zero or one means no retries.
+	MaxAttempts int
+	// The time to wait before the first retry. It doubles on every retry.
+	InitialBackoff time.Duration
+	// The maximum time to wait between two attempts.
+	MaxBackoff time.Duration
+}
+
+// Do calls fn until it succeeds, fails with an error that is not
+// transient, the attempts are used up or ctx is done.
+// The description is only used for logging.
+func (p RetryPolicy) Do(ctx context.Context, description string, fn func() (string, error)) (string, error) {
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		out, err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !isRetryable(err) {
+			return out, err
+		}
+
+		log.Printf("%s failed with a transient error (attempt %d/%d), retrying in %s: %s",
+			description, attempt, p.MaxAttempts, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return out, fmt.Errorf("%s: %w (last error: %s)", description, ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// isRetryable tells if err is a transient error of UTM's
+// scripting bridge that is likely to go away when trying again.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var number int
+	var message string
+	var osaErr *OsaScriptError
+	var utmctlErr *UtmctlError
+	switch {
+	case errors.As(err, &osaErr):
+		number, message = osaErr.Number, osaErr.Message
+	case errors.As(err, &utmctlErr):
+		number, message = utmctlErr.Number, utmctlErr.Stderr
+	default:
+		return false
+	}
+
+	switch number {
+	case errConnectionInvalid, errAEEventTimedOut:
+		return true
+	}
+
+	message = strings.ToLower(message)
+	return strings.Contains(message, "connection is invalid") ||
+		strings.Contains(message, "appleevent timed out")
+}
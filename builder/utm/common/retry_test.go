@@ -0,0 +1,125 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeExecutor fails the first Failures calls with Err, then succeeds.
+type fakeExecutor struct {
+	Failures int
+	Err      error
+
+	Calls int
+}
+
+func (e *fakeExecutor) Execute() (string, error) {
+	e.Calls++
+	if e.Calls <= e.Failures {
+		return "", e.Err
+	}
+	return "ok", nil
+}
+
+func testRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     2 * time.Millisecond,
+	}
+}
+
+func TestRetryPolicy_transient(t *testing.T) {
+	tcs := []struct {
+		Name string
+		Err  error
+	}{
+		{"connection invalid", newOsaScriptError("foo.applescript",
+			"0:20: execution error: UTM got an error: Connection is invalid. (-609)")},
+		{"event timed out", newOsaScriptError("foo.applescript",
+			"0:20: execution error: UTM got an error: AppleEvent timed out. (-1712)")},
+		{"utmctl", newUtmctlError([]string{"list"}, 1,
+			"Error from event: The operation couldn’t be completed. (OSStatus error -609.)")},
+	}
+
+	for _, tc := range tcs {
+		exec := &fakeExecutor{Failures: 2, Err: tc.Err}
+		out, err := testRetryPolicy().Do(context.Background(), tc.Name, exec.Execute)
+		if err != nil {
+			t.Fatalf("%s: err: %s", tc.Name, err)
+		}
+		if out != "ok" {
+			t.Fatalf("%s: bad: %q", tc.Name, out)
+		}
+		if exec.Calls != 3 {
+			t.Fatalf("%s: should be called 3 times: %d", tc.Name, exec.Calls)
+		}
+	}
+}
+
+func TestRetryPolicy_maxAttempts(t *testing.T) {
+	exec := &fakeExecutor{
+		Failures: 5,
+		Err: newOsaScriptError("foo.applescript",
+			"0:20: execution error: UTM got an error: Connection is invalid. (-609)"),
+	}
+	_, err := testRetryPolicy().Do(context.Background(), "foo", exec.Execute)
+	if err != exec.Err {
+		t.Fatalf("should return the last error: %v", err)
+	}
+	if exec.Calls != 3 {
+		t.Fatalf("should be called 3 times: %d", exec.Calls)
+	}
+
+	// The zero value does not retry
+	exec = &fakeExecutor{Failures: 5, Err: exec.Err}
+	if _, err := (RetryPolicy{}).Do(context.Background(), "foo", exec.Execute); err == nil {
+		t.Fatal("should error")
+	}
+	if exec.Calls != 1 {
+		t.Fatalf("should be called once: %d", exec.Calls)
+	}
+}
+
+func TestRetryPolicy_permanent(t *testing.T) {
+	exec := &fakeExecutor{
+		Failures: 1,
+		Err: newOsaScriptError("foo.applescript",
+			`0:133: execution error: UTM got an error: Can’t get virtual machine "foo". (-1728)`),
+	}
+	_, err := testRetryPolicy().Do(context.Background(), "foo", exec.Execute)
+	if !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("bad: %v", err)
+	}
+	if exec.Calls != 1 {
+		t.Fatalf("should not retry: %d", exec.Calls)
+	}
+}
+
+func TestRetryPolicy_cancelled(t *testing.T) {
+	exec := &fakeExecutor{
+		Failures: 5,
+		Err: newOsaScriptError("foo.applescript",
+			"0:20: execution error: UTM got an error: Connection is invalid. (-609)"),
+	}
+	policy := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Hour}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := policy.Do(ctx, "foo", exec.Execute)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("should be cancelled: %v", err)
+	}
+	if exec.Calls != 1 {
+		t.Fatalf("should be called once: %d", exec.Calls)
+	}
+}
@@ -0,0 +1,557 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SimulatedUTM is an Executor that answers utmctl and osascript
+// commands the way a UTM installation would, from an in-memory VM
+// registry. It lets the builder run end to end on hosts without UTM.
+//
+// Only the commands and scripts used by the driver are implemented.
+type SimulatedUTM struct {
+	sync.Mutex
+
+	// The UTM version reported through System Events
+	Version string
+	// Whether UTM is installed and running
+	Installed bool
+	Running   bool
+	// Whether macOS denies sending Apple Events to UTM
+	AutomationDenied bool
+
+	// Every command executed, the embedded scripts are
+	// recorded as "osascript <script name> <args...>"
+	Calls [][]string
+
+	vms    []*SimulatedVM
+	nextID int
+	// The internal snapshots of the qcow2 disks, by disk and name
+	snapshots map[string]map[string][]byte
+}
+
+// SimulatedVM is a virtual machine registered with a SimulatedUTM.
+type SimulatedVM struct {
+	UUID   string
+	Name   string
+	Status string
+	// The bundle the VM was imported from, if any
+	BundlePath        string
+	Notes             string
+	NetworkInterfaces []*SimulatedNetworkInterface
+	// Whether the VM was last started in disposable mode
+	Disposable bool
+}
+
+// SimulatedNetworkInterface is a network interface of a SimulatedVM.
+type SimulatedNetworkInterface struct {
+	Index int
+	// "ShRd" (shared network), "EmUd" (emulated VLAN), "BrDg" (bridged)...
+	Mode         string
+	MacAddress   string
+	PortForwards []SimulatedPortForward
+}
+
+// SimulatedPortForward is a port forward of an emulated VLAN interface.
+type SimulatedPortForward struct {
+	Protocol     string
+	GuestAddress string
+	GuestPort    int
+	HostAddress  string
+	HostPort     int
+}
+
+// NewSimulatedUTM returns an installed and running UTM
+// of the given version without any VM.
+func NewSimulatedUTM(version string) *SimulatedUTM {
+	return &SimulatedUTM{
+		Version:   version,
+		Installed: true,
+		Running:   true,
+	}
+}
+
+// AddVM registers a stopped VM with the default network interfaces
+// (shared network and emulated VLAN), as if it was imported.
+func (u *SimulatedUTM) AddVM(name string) *SimulatedVM {
+	u.Lock()
+	defer u.Unlock()
+	return u.addVM(name, "")
+}
+
+// VM returns the VM with the given name or UUID, or nil.
+func (u *SimulatedUTM) VM(identifier string) *SimulatedVM {
+	u.Lock()
+	defer u.Unlock()
+	return u.findVM(identifier)
+}
+
+// Snapshots returns the names of the internal snapshots of a disk.
+func (u *SimulatedUTM) Snapshots(disk string) []string {
+	u.Lock()
+	defer u.Unlock()
+	var names []string
+	for name := range u.snapshots[disk] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// VMs returns all the registered VMs.
+func (u *SimulatedUTM) VMs() []*SimulatedVM {
+	u.Lock()
+	defer u.Unlock()
+	return append([]*SimulatedVM(nil), u.vms...)
+}
+
+func (u *SimulatedUTM) Execute(ctx context.Context, stdin []byte, name string, args ...string) (string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	switch path.Base(name) {
+	case "utmctl":
+		u.Calls = append(u.Calls, append([]string{"utmctl"}, args...))
+		return u.utmctl(args)
+	case "osascript":
+		if len(args) == 2 && args[0] == "-e" {
+			u.Calls = append(u.Calls, append([]string{"osascript"}, args...))
+			return u.inlineScript(args[1])
+		}
+		if len(args) >= 1 && args[0] == "-" {
+			script := embeddedScriptName(stdin)
+			u.Calls = append(u.Calls, append([]string{"osascript", script}, args[1:]...))
+			return u.script(script, args[1:])
+		}
+		return "", "usage: osascript [-e statement | programfile] [argument ...]", &ExitError{Code: 1}
+	case "sh":
+		// Only the script finding the disks of a VM
+		if len(args) >= 4 && args[0] == "-c" && args[1] == findDisksScript {
+			u.Calls = append(u.Calls, append([]string{"sh", "find_disks"}, args[3:]...))
+			return u.findDisks(args[3])
+		}
+	case "qemu-img":
+		u.Calls = append(u.Calls, append([]string{"qemu-img"}, args...))
+		return u.qemuImg(args)
+	}
+
+	return "", fmt.Sprintf("%s: command not found", name), &ExitError{Code: 127}
+}
+
+func (u *SimulatedUTM) utmctl(args []string) (string, string, error) {
+	if len(args) == 0 {
+		return "", "Error: Missing expected argument '<subcommand>'", &ExitError{Code: 64}
+	}
+	if stderr, err := u.appleEventError(); err != nil {
+		return "", "Error from event: The operation couldn’t be completed. " + stderr, err
+	}
+
+	if args[0] == "list" {
+		var out strings.Builder
+		out.WriteString("UUID                                 Status   Name\n")
+		for _, vm := range u.vms {
+			fmt.Fprintf(&out, "%s %-8s %s\n", vm.UUID, vm.Status, vm.Name)
+		}
+		return out.String(), "", nil
+	}
+
+	if len(args) < 2 {
+		return "", "Error: Missing expected argument '<identifier>'", &ExitError{Code: 64}
+	}
+	vm := u.findVM(args[1])
+	if vm == nil {
+		return "", "Error from event: The operation couldn’t be completed. (OSStatus error -1728.)", &ExitError{Code: 1}
+	}
+
+	switch args[0] {
+	case "status":
+		return vm.Status + "\n", "", nil
+	case "start":
+		vm.Status = "started"
+		vm.Disposable = len(args) > 2 && args[2] == "--disposable"
+		return "", "", nil
+	case "suspend":
+		vm.Status = "paused"
+		return "", "", nil
+	case "stop":
+		vm.Status = "stopped"
+		return "", "", nil
+	case "delete":
+		for i, v := range u.vms {
+			if v == vm {
+				u.vms = append(u.vms[:i], u.vms[i+1:]...)
+				break
+			}
+		}
+		return "", "", nil
+	case "clone":
+		cloneName := vm.Name + " Copy"
+		for i := 2; i < len(args)-1; i++ {
+			if args[i] == "--name" {
+				cloneName = args[i+1]
+			}
+		}
+		clone := u.addVM(cloneName, vm.BundlePath)
+		clone.Notes = vm.Notes
+		for i, nic := range vm.NetworkInterfaces {
+			if i < len(clone.NetworkInterfaces) {
+				clone.NetworkInterfaces[i].Mode = nic.Mode
+				// Like the UTM versions which keep the MAC addresses
+				clone.NetworkInterfaces[i].MacAddress = nic.MacAddress
+				clone.NetworkInterfaces[i].PortForwards = append([]SimulatedPortForward(nil), nic.PortForwards...)
+			}
+		}
+		return "", "", nil
+	case "ip-address":
+		if vm.Status != "started" {
+			return "", "Error from event: The operation couldn’t be completed. (OSStatus error -10000.)", &ExitError{Code: 1}
+		}
+		return "10.0.2.15\n", "", nil
+	}
+
+	return "", fmt.Sprintf("Error: Unexpected argument '%s'", args[0]), &ExitError{Code: 64}
+}
+
+func (u *SimulatedUTM) inlineScript(script string) (string, string, error) {
+	switch {
+	case script == `tell application "System Events" to return version of application "UTM"`:
+		if !u.Installed {
+			return "", `0:67: execution error: System Events got an error: Can’t get application "UTM". (-1728)`, &ExitError{Code: 1}
+		}
+		return u.Version + "\n", "", nil
+	case script == `application "UTM" is running`:
+		return strconv.FormatBool(u.Installed && u.Running) + "\n", "", nil
+	}
+
+	if stderr, err := u.appleEventError(); err != nil {
+		return "", "0:0: execution error: " + stderr, err
+	}
+
+	switch {
+	case script == `tell application "UTM" to count of virtual machines`:
+		return strconv.Itoa(len(u.vms)) + "\n", "", nil
+	}
+
+	return "", "0:0: syntax error: A unknown token can’t go here. (-2740)", &ExitError{Code: 1}
+}
+
+func (u *SimulatedUTM) script(script string, args []string) (string, string, error) {
+	if stderr, err := u.appleEventError(); err != nil {
+		return "", "execution error: " + stderr, err
+	}
+	if script == "list_port_forwards.applescript" {
+		var lines []string
+		for _, vm := range u.vms {
+			for _, nic := range vm.NetworkInterfaces {
+				for _, pf := range nic.PortForwards {
+					lines = append(lines, strconv.Itoa(pf.HostPort))
+				}
+			}
+		}
+		return strings.Join(lines, "\n") + "\n", "", nil
+	}
+
+	if len(args) == 0 {
+		return "", "execution error: Can’t get item 1 of {}. (-1728)", &ExitError{Code: 1}
+	}
+
+	// All scripts but open, import and list take the VM name first
+	if script == "open_vm.applescript" {
+		if _, err := os.Stat(args[0]); err != nil {
+			return "", "execution error: UTM got an error: The file couldn’t be opened. (-10000)", &ExitError{Code: 1}
+		}
+		// UTM 4.5 names the VM after the name stored in the bundle
+		u.addVM(bundleName(args[0]), args[0])
+		return "missing value\n", "", nil
+	}
+	if script == "import_vm.applescript" {
+		if _, err := os.Stat(args[0]); err != nil {
+			return "", "execution error: UTM got an error: The file couldn’t be opened. (-10000)", &ExitError{Code: 1}
+		}
+		// UTM names the VM after the bundle
+		vm := u.addVM(strings.TrimSuffix(filepath.Base(args[0]), ".utm"), args[0])
+		return vm.UUID + "\n", "", nil
+	}
+
+	if script == "list_build_tags.applescript" {
+		var lines []string
+		for _, vm := range u.vms {
+			for _, line := range strings.Split(vm.Notes, "\n") {
+				if strings.HasPrefix(line, args[0]) {
+					lines = append(lines, vm.UUID+"\t"+line)
+				}
+			}
+		}
+		return strings.Join(lines, "\n") + "\n", "", nil
+	}
+
+	vm := u.findVM(args[0])
+	if vm == nil {
+		return "", fmt.Sprintf("execution error: UTM got an error: Can’t get virtual machine \"%s\". (-1728)", args[0]),
+			&ExitError{Code: 1}
+	}
+
+	switch script {
+	case "add_network_interface.applescript":
+		if len(args) != 2 {
+			return "", "execution error: Can’t get item 2 of argv. (-1728)", &ExitError{Code: 1}
+		}
+		u.addNetworkInterface(vm, args[1])
+		return "", "", nil
+	case "clear_network_interfaces.applescript":
+		vm.NetworkInterfaces = nil
+		return "", "", nil
+	case "rename_vm.applescript":
+		if len(args) < 2 {
+			return "", "execution error: Can’t get item 2 of argv. (-1728)", &ExitError{Code: 1}
+		}
+		vm.Name = args[1]
+		return "", "", nil
+	case "set_build_tag.applescript":
+		if len(args) < 2 {
+			return "", "execution error: Can’t get item 2 of argv. (-1728)", &ExitError{Code: 1}
+		}
+		var kept []string
+		if vm.Notes != "" {
+			for _, line := range strings.Split(vm.Notes, "\n") {
+				if !strings.HasPrefix(line, args[1]) {
+					kept = append(kept, line)
+				}
+			}
+		}
+		if len(args) > 2 {
+			kept = append(kept, args[2])
+		}
+		vm.Notes = strings.Join(kept, "\n")
+		return "", "", nil
+	case "regenerate_mac_addresses.applescript":
+		for _, nic := range vm.NetworkInterfaces {
+			u.nextID++
+			nic.MacAddress = fmt.Sprintf("02:00:00:%02X:%02X:%02X", u.nextID>>16&0xff, u.nextID>>8&0xff, u.nextID&0xff)
+		}
+		return "", "", nil
+	case "add_port_forwards.applescript":
+		return u.addPortForwards(vm, args[1:])
+	case "clear_port_forwards.applescript":
+		return u.clearPortForwards(vm, args[1:])
+	case "export_vm.applescript":
+		if len(args) != 2 {
+			return "", "execution error: Can’t get item 2 of argv. (-1728)", &ExitError{Code: 1}
+		}
+		if err := copyDir(vm.BundlePath, args[1]); err != nil {
+			return "", fmt.Sprintf("execution error: UTM got an error: %s (-10000)", err), &ExitError{Code: 1}
+		}
+		return "", "", nil
+	}
+
+	return "", fmt.Sprintf("unknown script %q", script), &ExitError{Code: 1}
+}
+
+// findDisks lists the qcow2 disks in the bundle of the VM with the
+// given UUID, like findDisksScript.
+func (u *SimulatedUTM) findDisks(uuid string) (string, string, error) {
+	vm := u.findVM(uuid)
+	if vm == nil || vm.BundlePath == "" {
+		return "", fmt.Sprintf("no bundle found for VM %s\n", uuid), &ExitError{Code: 1}
+	}
+	disks, err := filepath.Glob(filepath.Join(vm.BundlePath, "Data", "*.qcow2"))
+	if err != nil {
+		return "", err.Error(), &ExitError{Code: 1}
+	}
+	var out strings.Builder
+	for _, disk := range disks {
+		fmt.Fprintln(&out, disk)
+	}
+	return out.String(), "", nil
+}
+
+// qemuImg implements qemu-img snapshot, keeping the snapshots in
+// memory. A disk in the bundle of a started VM is locked.
+func (u *SimulatedUTM) qemuImg(args []string) (string, string, error) {
+	if len(args) != 4 || args[0] != "snapshot" {
+		return "", "qemu-img: unsupported command\n", &ExitError{Code: 1}
+	}
+	op, name, disk := args[1], args[2], args[3]
+
+	data, err := os.ReadFile(disk)
+	if err != nil {
+		return "", fmt.Sprintf("qemu-img: Could not open '%s': %s\n", disk, err), &ExitError{Code: 1}
+	}
+	for _, vm := range u.vms {
+		if vm.Status != "stopped" && vm.BundlePath != "" && strings.HasPrefix(disk, vm.BundlePath+string(filepath.Separator)) {
+			return "", fmt.Sprintf("qemu-img: Could not open '%s': Failed to get \"write\" lock\n", disk), &ExitError{Code: 1}
+		}
+	}
+
+	if u.snapshots == nil {
+		u.snapshots = map[string]map[string][]byte{}
+	}
+	snapshots := u.snapshots[disk]
+	switch op {
+	case "-c":
+		if snapshots == nil {
+			snapshots = map[string][]byte{}
+			u.snapshots[disk] = snapshots
+		}
+		snapshots[name] = data
+		return "", "", nil
+	case "-a":
+		saved, ok := snapshots[name]
+		if !ok {
+			return "", fmt.Sprintf("qemu-img: Could not apply snapshot '%s': -2 (No such file or directory)\n", name),
+				&ExitError{Code: 1}
+		}
+		if err := os.WriteFile(disk, saved, 0644); err != nil {
+			return "", fmt.Sprintf("qemu-img: %s\n", err), &ExitError{Code: 1}
+		}
+		return "", "", nil
+	case "-d":
+		if _, ok := snapshots[name]; !ok {
+			return "", fmt.Sprintf("qemu-img: Could not delete snapshot '%s': snapshot not found\n", name),
+				&ExitError{Code: 1}
+		}
+		delete(snapshots, name)
+		return "", "", nil
+	}
+
+	return "", fmt.Sprintf("qemu-img: unknown option '%s'\n", op), &ExitError{Code: 1}
+}
+
+func (u *SimulatedUTM) addPortForwards(vm *SimulatedVM, args []string) (string, string, error) {
+	if len(args)%3 != 0 {
+		return "", "execution error: Can’t get item of argv. (-1728)", &ExitError{Code: 1}
+	}
+	for i := 0; i < len(args); i += 3 {
+		nic := nicAt(vm, args[i+1])
+		rule := strings.Split(args[i+2], ",")
+		if nic == nil || len(rule) != 5 {
+			return "", "execution error: UTM got an error: Invalid configuration. (-1703)", &ExitError{Code: 1}
+		}
+		guestPort, _ := strconv.Atoi(rule[2])
+		hostPort, _ := strconv.Atoi(rule[4])
+		nic.PortForwards = append(nic.PortForwards, SimulatedPortForward{
+			Protocol:     rule[0],
+			GuestAddress: rule[1],
+			GuestPort:    guestPort,
+			HostAddress:  rule[3],
+			HostPort:     hostPort,
+		})
+	}
+	return "", "", nil
+}
+
+func (u *SimulatedUTM) clearPortForwards(vm *SimulatedVM, args []string) (string, string, error) {
+	if len(args)%3 != 0 {
+		return "", "execution error: Can’t get item of argv. (-1728)", &ExitError{Code: 1}
+	}
+	for i := 0; i < len(args); i += 3 {
+		nic := nicAt(vm, args[i+1])
+		hostPort, err := strconv.Atoi(args[i+2])
+		if nic == nil || err != nil {
+			return "", "execution error: UTM got an error: Invalid configuration. (-1703)", &ExitError{Code: 1}
+		}
+		kept := nic.PortForwards[:0]
+		for _, pf := range nic.PortForwards {
+			if pf.HostPort != hostPort {
+				kept = append(kept, pf)
+			}
+		}
+		nic.PortForwards = kept
+	}
+	return "", "", nil
+}
+
+// appleEventError returns the error UTM would report if it can't
+// be scripted right now, along with its stderr.
+func (u *SimulatedUTM) appleEventError() (string, error) {
+	switch {
+	case !u.Installed || !u.Running:
+		return "UTM got an error: Application isn’t running. (-600)", &ExitError{Code: 1}
+	case u.AutomationDenied:
+		return "Not authorized to send Apple events to UTM. (-1743)", &ExitError{Code: 1}
+	}
+	return "", nil
+}
+
+func (u *SimulatedUTM) addVM(name string, bundlePath string) *SimulatedVM {
+	u.nextID++
+	vm := &SimulatedVM{
+		UUID:       fmt.Sprintf("00000000-0000-4000-8000-%012X", u.nextID),
+		Name:       name,
+		Status:     "stopped",
+		BundlePath: bundlePath,
+	}
+	u.addNetworkInterface(vm, "ShRd")
+	u.addNetworkInterface(vm, "EmUd")
+	u.vms = append(u.vms, vm)
+	return vm
+}
+
+func (u *SimulatedUTM) addNetworkInterface(vm *SimulatedVM, mode string) {
+	u.nextID++
+	vm.NetworkInterfaces = append(vm.NetworkInterfaces, &SimulatedNetworkInterface{
+		Index:      len(vm.NetworkInterfaces),
+		Mode:       mode,
+		MacAddress: fmt.Sprintf("52:54:00:%02X:%02X:%02X", u.nextID>>16&0xff, u.nextID>>8&0xff, u.nextID&0xff),
+	})
+}
+
+func (u *SimulatedUTM) findVM(identifier string) *SimulatedVM {
+	for _, vm := range u.vms {
+		if vm.Name == identifier || strings.EqualFold(vm.UUID, identifier) {
+			return vm
+		}
+	}
+	return nil
+}
+
+func nicAt(vm *SimulatedVM, index string) *SimulatedNetworkInterface {
+	i, err := strconv.Atoi(index)
+	if err != nil || i < 0 || i >= len(vm.NetworkInterfaces) {
+		return nil
+	}
+	return vm.NetworkInterfaces[i]
+}
+
+// bundleName returns the VM name stored in the config.plist of a UTM
+// bundle, falling back to the bundle name without the extension.
+func bundleName(bundlePath string) string {
+	if info, err := ReadBundleInfo(bundlePath); err == nil && info.Name != "" {
+		return info.Name
+	}
+	return strings.TrimSuffix(filepath.Base(bundlePath), filepath.Ext(bundlePath))
+}
+
+// copyDir copies the directory src to dst, like UTM exporting a bundle.
+func copyDir(src string, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, info.Mode().Perm())
+	})
+}
@@ -0,0 +1,316 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SimulatedUTMHost is an SSH server standing in for a remote macOS host
+// running UTM. utmctl and osascript are answered by UTM, other commands
+// (file operations) run on this machine, and port forwards requested by
+// the client connect to this machine.
+type SimulatedUTMHost struct {
+	UTM *SimulatedUTM
+	// The address the server listens on
+	Addr string
+	// The public key of the server, to add to known_hosts
+	HostKey ssh.PublicKey
+
+	clientKey ed25519.PrivateKey
+	config    *ssh.ServerConfig
+	listener  net.Listener
+	wg        sync.WaitGroup
+}
+
+// NewSimulatedUTMHost starts an SSH server on a random local port.
+// It only lets in the clients using the key written by RemoteConfig.
+func NewSimulatedUTMHost(utm *SimulatedUTM) (*SimulatedUTMHost, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	_, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	authorizedKey, err := ssh.NewPublicKey(clientKey.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), authorizedKey.Marshal()) {
+				return nil, fmt.Errorf("unknown public key for %s", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	h := &SimulatedUTMHost{
+		UTM:       utm,
+		Addr:      l.Addr().String(),
+		HostKey:   signer.PublicKey(),
+		clientKey: clientKey,
+		config:    config,
+		listener:  l,
+	}
+	h.wg.Add(1)
+	go h.serve()
+	return h, nil
+}
+
+// RemoteConfig writes the client private key and a known_hosts file
+// for the server to dir, and returns the config to connect to the server.
+func (h *SimulatedUTMHost) RemoteConfig(dir string) (*RemoteConfig, error) {
+	block, err := ssh.MarshalPrivateKey(h.clientKey, "")
+	if err != nil {
+		return nil, err
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{h.Addr}, h.HostKey) + "\n"
+	if err := os.WriteFile(knownHostsFile, []byte(line), 0600); err != nil {
+		return nil, err
+	}
+
+	host, port, err := net.SplitHostPort(h.Addr)
+	if err != nil {
+		return nil, err
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RemoteConfig{
+		UtmHost:               host,
+		UtmHostPort:           portNumber,
+		UtmHostUser:           "packer",
+		UtmHostPrivateKeyFile: keyFile,
+		UtmHostKnownHostsFile: knownHostsFile,
+		UtmHostUtmctlPath:     defaultUtmctlPath,
+	}, nil
+}
+
+// Close stops accepting connections.
+func (h *SimulatedUTMHost) Close() error {
+	err := h.listener.Close()
+	h.wg.Wait()
+	return err
+}
+
+func (h *SimulatedUTMHost) serve() {
+	defer h.wg.Done()
+	for {
+		conn, err := h.listener.Accept()
+		if err != nil {
+			return
+		}
+		go h.handleConn(conn)
+	}
+}
+
+func (h *SimulatedUTMHost) handleConn(conn net.Conn) {
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, h.config)
+	if err != nil {
+		log.Printf("Simulated UTM host: handshake failed: %s", err)
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "session":
+			go h.handleSession(newChannel)
+		case "direct-tcpip":
+			go h.handleForward(newChannel)
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+		}
+	}
+}
+
+func (h *SimulatedUTMHost) handleSession(newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+
+	for req := range requests {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+
+		status := h.exec(channel, payload.Command)
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+		return
+	}
+}
+
+// exec runs command, reading stdin from and writing output to channel,
+// and returns its exit status.
+func (h *SimulatedUTMHost) exec(channel ssh.Channel, command string) int {
+	args, err := shellSplit(command)
+	if err != nil || len(args) == 0 {
+		fmt.Fprintf(channel.Stderr(), "sh: %v\n", err)
+		return 2
+	}
+
+	simulated := false
+	switch path.Base(args[0]) {
+	case "utmctl", "osascript", "qemu-img":
+		simulated = true
+	case "sh":
+		// The script finding disks relies on bundles UTM does not have
+		simulated = len(args) > 2 && args[2] == findDisksScript
+	}
+	if simulated {
+		stdin, err := io.ReadAll(channel)
+		if err != nil {
+			return 1
+		}
+		if len(stdin) == 0 {
+			stdin = nil
+		}
+		stdout, stderr, err := h.UTM.Execute(context.Background(), stdin, args[0], args[1:]...)
+		io.WriteString(channel, stdout)
+		io.WriteString(channel.Stderr(), stderr)
+		var exitErr *ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.Code
+		}
+		if err != nil {
+			return 1
+		}
+		return 0
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = channel
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode()
+		}
+		return 127
+	}
+	return 0
+}
+
+func (h *SimulatedUTMHost) handleForward(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(conn, channel)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(channel, conn)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// shellSplit splits a command line quoted by shellQuote.
+func shellSplit(command string) ([]string, error) {
+	var args []string
+	var arg []byte
+	inArg, quoted := false, false
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case quoted && c == '\'':
+			quoted = false
+		case quoted:
+			arg = append(arg, c)
+		case c == '\'':
+			quoted, inArg = true, true
+		case c == '\\' && i+1 < len(command):
+			i++
+			arg, inArg = append(arg, command[i]), true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, string(arg))
+				arg, inArg = nil, false
+			}
+		default:
+			arg, inArg = append(arg, c), true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+	return args, nil
+}
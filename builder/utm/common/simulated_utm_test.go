@@ -0,0 +1,128 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testSimulatedDriver(t *testing.T, utm *SimulatedUTM) Driver {
+	driver, err := NewDriverWithExecutor(context.Background(), &DriverConfig{}, utm, "utmctl")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return driver
+}
+
+func TestSimulatedUTM_impl(t *testing.T) {
+	var _ Executor = new(SimulatedUTM)
+}
+
+func TestSimulatedUTM_PortForwards(t *testing.T) {
+	utm := NewSimulatedUTM("4.6.4")
+	vm := utm.AddVM("vm")
+	driver := testSimulatedDriver(t, utm)
+	ctx := context.Background()
+
+	if _, err := driver.ExecuteOsaScript(ctx, "add_port_forwards.applescript", "vm",
+		"--index", "1", "TcPp,,22,127.0.0.1,2222"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	forwards := vm.NetworkInterfaces[1].PortForwards
+	if len(forwards) != 1 || forwards[0].GuestPort != 22 || forwards[0].HostPort != 2222 {
+		t.Fatalf("bad: %#v", forwards)
+	}
+
+	if _, err := driver.ExecuteOsaScript(ctx, "clear_port_forwards.applescript", "vm",
+		"--index", "1", "2222"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if forwards := vm.NetworkInterfaces[1].PortForwards; len(forwards) != 0 {
+		t.Fatalf("bad: %#v", forwards)
+	}
+
+	last := utm.Calls[len(utm.Calls)-1]
+	if last[1] != "clear_port_forwards.applescript" {
+		t.Fatalf("scripts should be recorded by name: %#v", last)
+	}
+}
+
+func TestSimulatedUTM_VMNotFound(t *testing.T) {
+	driver := testSimulatedDriver(t, NewSimulatedUTM("4.6.4"))
+	ctx := context.Background()
+
+	if _, err := driver.Utmctl(ctx, "start", "missing"); !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("bad: %#v", err)
+	}
+	if _, err := driver.ExecuteOsaScript(ctx, "clear_network_interfaces.applescript", "missing"); !errors.Is(err, ErrVMNotFound) {
+		t.Fatalf("bad: %#v", err)
+	}
+}
+
+func TestSimulatedUTM_Version(t *testing.T) {
+	utm := NewSimulatedUTM("4.6.4")
+	utm.Installed = false
+
+	if _, err := NewDriverWithExecutor(context.Background(), &DriverConfig{}, utm, "utmctl"); err == nil ||
+		err.Error() != "UTM is not installed" {
+		t.Fatalf("bad: %v", err)
+	}
+
+	utm = NewSimulatedUTM("4.4.5")
+	if _, err := NewDriverWithExecutor(context.Background(), &DriverConfig{}, utm, "utmctl"); err == nil {
+		t.Fatal("should fail for unsupported versions")
+	}
+}
+
+func TestNewDriverWithExecutor_checks(t *testing.T) {
+	utm := NewSimulatedUTM("4.6.4")
+	if _, err := NewDriverWithExecutor(context.Background(), &DriverConfig{}, utm, "utmctl"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// The version is read once, to pick the driver
+	versions := 0
+	for _, call := range utm.Calls {
+		if call[0] == "osascript" && strings.Contains(call[len(call)-1], "return version of application") {
+			versions++
+		}
+	}
+	if len(utm.Calls) != 3 || versions != 1 {
+		t.Fatalf("bad calls: %#v", utm.Calls)
+	}
+
+	// Which fails with the specific errors
+	utm = NewSimulatedUTM("4.6.4")
+	utm.Running = false
+	if _, err := NewDriverWithExecutor(context.Background(), &DriverConfig{}, utm, "utmctl"); err == nil ||
+		!strings.Contains(err.Error(), "UTM is not running") {
+		t.Fatalf("bad: %v", err)
+	}
+	utm = NewSimulatedUTM("4.6.4")
+	utm.AutomationDenied = true
+	if _, err := NewDriverWithExecutor(context.Background(), &DriverConfig{}, utm, "utmctl"); err == nil ||
+		!strings.Contains(err.Error(), "not allowed to control UTM") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestUtm45Driver_List(t *testing.T) {
+	utm := NewSimulatedUTM("4.6.4")
+	utm.AddVM("Ubuntu 22.04  server")
+	utm.AddVM("debian").Status = "started"
+	driver := &Utm45Driver{UtmctlPath: "utmctl", Executor: utm}
+
+	vms, err := driver.List(context.Background())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := []VMInfo{
+		{UUID: utm.VM("debian").UUID, Status: "started", Name: "debian"},
+	}
+	if len(vms) != 2 || vms[0].Name != "Ubuntu 22.04  server" || vms[1] != expected[0] {
+		t.Fatalf("bad: %#v", vms)
+	}
+}
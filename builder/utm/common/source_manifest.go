@@ -0,0 +1,148 @@
+package common
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The checksum types of the manifests of the utm-zip post-processor,
+// strongest first.
+var manifestChecksums = []struct {
+	Name string
+	New  func() hash.Hash
+}{
+	{"sha512", sha512.New},
+	{"sha384", sha512.New384},
+	{"sha256", sha256.New},
+	{"sha224", sha256.New224},
+	{"sha1", sha1.New},
+	{"md5", md5.New},
+}
+
+// sourceManifest is the part of a manifest of the utm-zip post-processor
+// needed to check the files of a bundle.
+type sourceManifest struct {
+	Files []struct {
+		Name    string            `json:"name"`
+		Size    int64             `json:"size"`
+		Digests map[string]string `json:"digests"`
+	} `json:"files"`
+}
+
+// VerifyBundle checks that the files of the UTM bundle at path are the
+// ones listed in manifest, the content of a manifest written by the
+// utm-zip post-processor with manifest enabled: the same regular files,
+// with the same sizes and digests, and nothing else but directories.
+func VerifyBundle(path string, manifest []byte) error {
+	var m sourceManifest
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return fmt.Errorf("error parsing manifest: %s", err)
+	}
+
+	// The manifest names the files of a bundle after the bundle, pick the
+	// bundle by name when the archive held several
+	bundles := map[string]bool{}
+	for _, file := range m.Files {
+		// A name must not point out of the bundle
+		if !fs.ValidPath(file.Name) {
+			return fmt.Errorf("invalid file name in the manifest: %q", file.Name)
+		}
+		bundles[strings.SplitN(file.Name, "/", 2)[0]] = true
+	}
+	bundle := filepath.Base(path)
+	if !bundles[bundle] {
+		if len(bundles) != 1 {
+			return fmt.Errorf("the manifest does not list the files of %s", bundle)
+		}
+		for name := range bundles {
+			bundle = name
+		}
+	}
+
+	listed := map[string]bool{}
+	for _, file := range m.Files {
+		rel, ok := strings.CutPrefix(file.Name, bundle+"/")
+		if !ok {
+			continue
+		}
+		listed[rel] = true
+		if err := verifyManifestFile(filepath.Join(path, filepath.FromSlash(rel)), file.Size, file.Digests); err != nil {
+			return fmt.Errorf("%s does not match the manifest: %s", rel, err)
+		}
+	}
+
+	// Symlinks are not in the manifests, they could point anywhere
+	var unlisted []string
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(path, file)
+		if err != nil {
+			return err
+		}
+		if !listed[filepath.ToSlash(rel)] {
+			unlisted = append(unlisted, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(unlisted) > 0 {
+		sort.Strings(unlisted)
+		return fmt.Errorf("files not in the manifest: %s", strings.Join(unlisted, ", "))
+	}
+	return nil
+}
+
+// verifyManifestFile checks that the file at path is a regular file,
+// its size and its strongest digest in digests.
+func verifyManifestFile(path string, size int64, digests map[string]string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file")
+	}
+
+	for _, checksum := range manifestChecksums {
+		expected, ok := digests[checksum.Name]
+		if !ok {
+			continue
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h := checksum.New()
+		n, err := io.Copy(h, f)
+		if err != nil {
+			return err
+		}
+		if n != size {
+			return fmt.Errorf("size is %d bytes, expected %d", n, size)
+		}
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != strings.ToLower(expected) {
+			return fmt.Errorf("%s is %s, expected %s", checksum.Name, actual, expected)
+		}
+		return nil
+	}
+	return fmt.Errorf("no supported digest")
+}
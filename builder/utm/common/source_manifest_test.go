@@ -0,0 +1,144 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testManifestBundle creates the bundle vm.utm and returns its path
+// and the manifest the utm-zip post-processor writes for it.
+func testManifestBundle(t *testing.T) (string, []byte) {
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "vm.utm")
+	if err := os.MkdirAll(filepath.Join(bundle, "Data"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var files []map[string]interface{}
+	for name, content := range map[string]string{
+		"config.plist":    "plist",
+		"Data/disk.qcow2": "disk",
+	} {
+		if err := os.WriteFile(filepath.Join(bundle, filepath.FromSlash(name)), []byte(content), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		sha := sha256.Sum256([]byte(content))
+		sum := md5.Sum([]byte(content))
+		files = append(files, map[string]interface{}{
+			"name": "vm.utm/" + name,
+			"size": len(content),
+			"digests": map[string]string{
+				"sha256": hex.EncodeToString(sha[:]),
+				"md5":    hex.EncodeToString(sum[:]),
+			},
+		})
+	}
+
+	content, err := json.Marshal(map[string]interface{}{"build_name": "test", "files": files})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return bundle, content
+}
+
+func TestVerifyBundle(t *testing.T) {
+	bundle, manifest := testManifestBundle(t)
+	if err := VerifyBundle(bundle, manifest); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// A bundle imported under another name still matches
+	renamed := filepath.Join(filepath.Dir(bundle), "other.utm")
+	if err := os.Rename(bundle, renamed); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := VerifyBundle(renamed, manifest); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestVerifyBundle_Mismatch(t *testing.T) {
+	cases := map[string]struct {
+		change   func(bundle string) error
+		expected string
+	}{
+		"changed": {
+			change: func(bundle string) error {
+				return os.WriteFile(filepath.Join(bundle, "Data", "disk.qcow2"), []byte("DISK"), 0644)
+			},
+			expected: "sha256",
+		},
+		"resized": {
+			change: func(bundle string) error {
+				return os.WriteFile(filepath.Join(bundle, "config.plist"), []byte("plist2"), 0644)
+			},
+			expected: "size",
+		},
+		"missing": {
+			change: func(bundle string) error {
+				return os.Remove(filepath.Join(bundle, "config.plist"))
+			},
+			expected: "config.plist",
+		},
+		"added": {
+			change: func(bundle string) error {
+				return os.WriteFile(filepath.Join(bundle, "Data", "extra.qcow2"), nil, 0644)
+			},
+			expected: "not in the manifest: Data/extra.qcow2",
+		},
+		"symlink added": {
+			change: func(bundle string) error {
+				return os.Symlink("/etc", filepath.Join(bundle, "Data", "etc"))
+			},
+			expected: "not in the manifest: Data/etc",
+		},
+		"symlink listed": {
+			// The link has the content of the listed file
+			change: func(bundle string) error {
+				disk := filepath.Join(bundle, "Data", "disk.qcow2")
+				moved := filepath.Join(filepath.Dir(bundle), "disk.qcow2")
+				if err := os.Rename(disk, moved); err != nil {
+					return err
+				}
+				return os.Symlink(moved, disk)
+			},
+			expected: "not a regular file",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			bundle, manifest := testManifestBundle(t)
+			if err := tc.change(bundle); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			err := VerifyBundle(bundle, manifest)
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("bad: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyBundle_InvalidName(t *testing.T) {
+	bundle, _ := testManifestBundle(t)
+	for _, name := range []string{"vm.utm/../secret", "../vm.utm/config.plist", "/vm.utm/config.plist", "vm.utm/./config.plist"} {
+		manifest, err := json.Marshal(map[string]interface{}{
+			"files": []map[string]interface{}{{"name": name, "size": 0, "digests": map[string]string{"md5": ""}}},
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := VerifyBundle(bundle, manifest); err == nil || !strings.Contains(err.Error(), "invalid file name") {
+			t.Fatalf("bad %s: %v", name, err)
+		}
+	}
+}
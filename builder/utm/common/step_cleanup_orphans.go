@@ -0,0 +1,74 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// This step stops and deletes the VMs left behind by the builds which
+// could not clean up after themselves, e.g. because Packer was killed.
+// Such VMs carry the build tag of a process of this machine which is
+// gone. Failures are reported but do not stop the build.
+//
+// Uses:
+//
+//	driver Driver
+//	ui packersdk.Ui
+//
+// Produces:
+//
+//	<nothing>
+type StepCleanupOrphans struct {
+	// VMs younger than this are kept, even if their build is gone.
+	MinAge time.Duration
+}
+
+func (s *StepCleanupOrphans) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+
+	host, err := os.Hostname()
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error looking for orphaned VMs: %s", err))
+		return multistep.ActionContinue
+	}
+
+	ui.Say("Looking for VMs left behind by previous builds...")
+	vms, errs, err := ListTaggedVMs(ctx, driver)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error looking for orphaned VMs: %s", err))
+		return multistep.ActionContinue
+	}
+	for _, err := range errs {
+		log.Printf("Ignoring build tag: %s", err)
+	}
+
+	namespace := ProcessNamespace()
+	now := time.Now()
+	for _, vm := range vms {
+		orphaned, reason := vm.Tag.Orphaned(host, namespace, now, s.MinAge)
+		if !orphaned {
+			log.Printf("Keeping VM %s: %s", vm.UUID, reason)
+			continue
+		}
+
+		ui.Say(fmt.Sprintf("Deleting orphaned VM %s (created %s by process %d, which is gone)",
+			vm.UUID, vm.Tag.Created.Format(time.RFC3339), vm.Tag.PID))
+		if err := StopAndDelete(ctx, driver, vm.UUID); err != nil {
+			ui.Error(fmt.Sprintf("Error deleting orphaned VM %s: %s", vm.UUID, err))
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepCleanupOrphans) Cleanup(state multistep.StateBag) {}
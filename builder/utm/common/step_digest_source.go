@@ -0,0 +1,47 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// This step hashes the files of the source bundle for the provenance,
+// before UTM imports it and may change it.
+//
+// Uses:
+//
+//	ui packersdk.Ui
+//	vm_path string
+//
+// Produces:
+//
+//	source_digests map[string]string - The sha256 of the files of the bundle
+type StepDigestSource struct {
+	// Reads the bundle on the UTM host, on this machine when nil
+	Executor Executor
+}
+
+func (s *StepDigestSource) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	vmPath := state.Get("vm_path").(string)
+
+	ui.Say("Hashing the source bundle for the provenance...")
+	digests, err := FileDigests(ctx, s.Executor, vmPath)
+	if err != nil {
+		err := fmt.Errorf("Error hashing source bundle: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	state.Put("source_digests", digests)
+	return multistep.ActionContinue
+}
+
+func (s *StepDigestSource) Cleanup(state multistep.StateBag) {}
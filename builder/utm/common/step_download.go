@@ -44,6 +44,10 @@ type StepUtmDownload struct {
 	// extension on the URL is used. Otherwise, this will be forced
 	// on the downloaded file for every URL.
 	Extension string
+
+	// Checks if a source exists, e.g. on a remote UTM host.
+	// By default sources are looked up on this machine.
+	FileExists func(path string) (bool, error)
 }
 
 func (s *StepUtmDownload) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
@@ -67,7 +71,16 @@ func (s *StepUtmDownload) Run(ctx context.Context, state multistep.StateBag) mul
 		}
 		ui.Say(fmt.Sprintf("Trying %s", source))
 		// check is the source file exists
-		if _, err := os.Stat(source); err != nil {
+		if s.FileExists != nil {
+			exists, err := s.FileExists(source)
+			if err == nil && !exists {
+				err = fmt.Errorf("%s does not exist", source)
+			}
+			if err != nil {
+				state.Put("error", fmt.Errorf("file not found: %v", err))
+				return multistep.ActionHalt
+			}
+		} else if _, err := os.Stat(source); err != nil {
 			state.Put("error", fmt.Errorf("file not found: %v", err))
 			return multistep.ActionHalt
 		}
@@ -13,10 +13,15 @@ import (
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
 )
 
-// This step cleans up forwarded ports and (TODO) exports the VM to an UTM file.
+// This step cleans up forwarded ports and exports the VM to an UTM file.
+// UTM versions without scripted export need the user to export the VM.
 //
 // Uses:
 //
+//	driver Driver
+//	ui packersdk.Ui
+//	vmName string
+//
 // Produces:
 //
 //	exportPath string - The path to the resulting export.
@@ -70,7 +75,7 @@ func (s *StepExport) Run(ctx context.Context, state multistep.StateBag) multiste
 			"clear_port_forwards.applescript", vmName,
 			"--index", "1", strconv.Itoa(commPortInt),
 		}
-		if _, err := driver.ExecuteOsaScript(command...); err != nil {
+		if _, err := driver.ExecuteOsaScript(ctx, command...); err != nil {
 			err := fmt.Errorf("error deleting port forwarding rule: %s", err)
 			state.Put("error", err)
 			ui.Error(err.Error())
@@ -82,10 +87,23 @@ func (s *StepExport) Run(ctx context.Context, state multistep.StateBag) multiste
 	outputPath := filepath.Join(s.OutputDir, s.OutputFilename+"."+s.Format)
 	ui.Say("Exporting virtual machine...")
 
-	// TODO: Actually export the VM when UTM API supports it
-	// Till then ask the user to manually export the VM
+	if driver.Features().ScriptedExport {
+		ui.Message(fmt.Sprintf("Exporting to %s", outputPath))
+		if err := driver.Export(ctx, vmName, outputPath); err != nil {
+			err := fmt.Errorf("error exporting VM: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+
+		state.Put("exportPath", outputPath)
+		return multistep.ActionContinue
+	}
+
+	// This UTM version can't export through AppleScript,
+	// so ask the user to export the VM
 	// using Share action in UTM VM in output Path
-	ui.Say("UTM API does not support exporting VMs yet.")
+	ui.Say("This UTM version does not support exporting VMs through its API.")
 	ui.Say("Please manually export the VM using 'Share...' action in UTM VM menu.")
 	ui.Say(fmt.Sprintf("Please make sure the VM is exported to the path %s ", outputPath))
 	ui.Say("The exported UTM file in the output directory will be passed as build Artifact.")
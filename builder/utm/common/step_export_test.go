@@ -1,9 +1,3 @@
-//go:build exclude
-// +build exclude
-
-// we disable this test as it is not possible to test
-// the export step without actually exporting the VM
-
 // Copyright (c) HashiCorp, Inc.
 // SPDX-License-Identifier: MPL-2.0
 
@@ -15,8 +9,19 @@ import (
 	"testing"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
 )
 
+// answerUi answers every question with the same answer.
+type answerUi struct {
+	packersdk.Ui
+	answer string
+}
+
+func (u *answerUi) Ask(string) (string, error) {
+	return u.answer, nil
+}
+
 func TestStepExport_impl(t *testing.T) {
 	var _ multistep.Step = new(StepExport)
 }
@@ -28,7 +33,8 @@ func TestStepExport(t *testing.T) {
 	state.Put("vmName", "foo")
 	// We use the commHostPort to clear the forwarded ports
 	state.Put("commHostPort", 1234)
-	// driver := state.Get("driver").(*DriverMock)
+	driver := state.Get("driver").(*DriverMock)
+	driver.FeaturesResult.ScriptedExport = true
 
 	// Test the run
 	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
@@ -44,10 +50,36 @@ func TestStepExport(t *testing.T) {
 	}
 
 	// Test driver
-	// TODO: Test calls to driver
-	// Currently our export step doesn't call the driver
-	// It asks for manual intervention to export the VM
-	// and just sets the exportPath in the state bag
+	if len(driver.ExecuteOsaCalls) != 1 || driver.ExecuteOsaCalls[0][0] != "clear_port_forwards.applescript" {
+		t.Fatalf("should clear port forwards: %#v", driver.ExecuteOsaCalls)
+	}
+	if !driver.ExportCalled {
+		t.Fatal("export should be called")
+	}
+	if driver.ExportName != "foo" {
+		t.Fatalf("bad: %#v", driver.ExportName)
+	}
+}
+
+func TestStepExport_Manual(t *testing.T) {
+	state := testState(t)
+	step := new(StepExport)
+
+	state.Put("vmName", "foo")
+	state.Put("commHostPort", 1234)
+	state.Put("ui", &answerUi{Ui: state.Get("ui").(packersdk.Ui), answer: "y"})
+	driver := state.Get("driver").(*DriverMock)
+
+	// Test the run
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("exportPath"); !ok {
+		t.Fatal("should set exportPath")
+	}
+	if driver.ExportCalled {
+		t.Fatal("export should not be called without scripted export")
+	}
 }
 
 func TestStepExport_OutputPath(t *testing.T) {
@@ -81,6 +113,8 @@ func TestStepExport_OutputPath(t *testing.T) {
 		state.Put("vmName", "foo")
 		// We use the commHostPort to clear the forwarded ports
 		state.Put("commHostPort", 1234)
+		driver := state.Get("driver").(*DriverMock)
+		driver.FeaturesResult.ScriptedExport = true
 		// Test the run
 		if action := tc.Step.Run(context.Background(), state); action != multistep.ActionContinue {
 			t.Fatalf("bad action: %#v", action)
@@ -104,7 +138,7 @@ func TestStepExport_SkipExport(t *testing.T) {
 	state.Put("vmName", "foo")
 	// We use the commHostPort to clear the forwarded ports
 	state.Put("commHostPort", 1234)
-	// driver := state.Get("driver").(*DriverMock)
+	driver := state.Get("driver").(*DriverMock)
 
 	// Test the run
 	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
@@ -113,10 +147,9 @@ func TestStepExport_SkipExport(t *testing.T) {
 	if _, ok := state.GetOk("error"); ok {
 		t.Fatal("should NOT have error")
 	}
-	// Test driver
-	// TODO: Test calls to driver
-	// Currently our export step doesn't call the driver
-	// It asks for manual intervention to export the VM
-	// and just sets the exportPath in the state bag
 
+	// Test driver
+	if driver.ExportCalled {
+		t.Fatal("export should not be called")
+	}
 }
@@ -0,0 +1,108 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// StepOutputDir sets up the output directory by creating it if it does
+// not exist, deleting it if it does exist and we're forcing, and cleaning
+// it up when we're done with it. Unlike commonsteps.StepOutputDir it
+// works on the UTM host, which may not be the machine running Packer.
+//
+// Uses:
+//
+//	checkpoint_phase string (optional, keeps the directory on failure)
+//	ui packersdk.Ui
+//
+// Produces:
+//
+//	<nothing>
+type StepOutputDir struct {
+	Force     bool
+	OutputDir OutputDir
+	// Reuse the directory of the interrupted build being resumed
+	Resume bool
+
+	cleanup bool
+}
+
+func (s *StepOutputDir) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+
+	exists, err := s.OutputDir.DirExists()
+	if err != nil {
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	if exists && s.Resume {
+		ui.Say(fmt.Sprintf("Resuming the build in output directory %s...", s.OutputDir))
+		return multistep.ActionContinue
+	}
+
+	if exists {
+		if !s.Force {
+			err := fmt.Errorf(
+				"Output directory exists: %s\n\n"+
+					"Use the force flag to delete it prior to building.",
+				s.OutputDir)
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+
+		ui.Say("Deleting previous output directory...")
+		if err := s.OutputDir.RemoveAll(); err != nil {
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+	}
+
+	// Enable cleanup
+	s.cleanup = true
+
+	// Create the directory
+	if err := s.OutputDir.MkdirAll(); err != nil {
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepOutputDir) Cleanup(state multistep.StateBag) {
+	if !s.cleanup {
+		return
+	}
+
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	_, halted := state.GetOk(multistep.StateHalted)
+
+	if cancelled || halted {
+		ui := state.Get("ui").(packersdk.Ui)
+
+		if _, ok := state.GetOk("checkpoint_phase"); ok {
+			ui.Say("Keeping output directory with the checkpoint to resume the build (checkpoint = true)")
+			return
+		}
+
+		ui.Say("Deleting output directory...")
+		for i := 0; i < 5; i++ {
+			err := s.OutputDir.RemoveAll()
+			if err == nil {
+				break
+			}
+
+			log.Printf("Error removing output dir: %s", err)
+			time.Sleep(2 * time.Second)
+		}
+	}
+}
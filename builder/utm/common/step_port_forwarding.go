@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strconv"
 
 	"github.com/hashicorp/packer-plugin-sdk/communicator"
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
@@ -26,8 +27,15 @@ type StepPortForwarding struct {
 	HostPortMin    int
 	HostPortMax    int
 	SkipNatMapping bool
-
-	l *net.Listener
+	// Remove the port forward when done, for VMs which outlive the build.
+	// StepExport removes it before exporting anyway.
+	ClearOnCleanup bool
+	// UTM runs on another host, so the port is picked there, by the driver
+	RemoteHost bool
+
+	l        *net.Listener
+	vmName   string
+	hostPort int
 }
 
 func (s *StepPortForwarding) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
@@ -43,7 +51,18 @@ func (s *StepPortForwarding) Run(ctx context.Context, state multistep.StateBag)
 
 	guestPort := s.CommConfig.Port()
 	commHostPort := guestPort
-	if !s.SkipNatMapping {
+	if !s.SkipNatMapping && s.RemoteHost {
+		var err error
+		commHostPort, err = driver.ForwardFreePort(ctx, vmName, guestPort, s.HostPortMin, s.HostPortMax)
+		if err != nil {
+			err := fmt.Errorf("error adding port forwarding rule: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		ui.Say(fmt.Sprintf("Created forwarded port mapping for communicator (SSH, WinRM, etc) (port %d of the UTM host)", commHostPort))
+		s.vmName, s.hostPort = vmName, commHostPort
+	} else if !s.SkipNatMapping {
 		log.Printf("Looking for available communicator (SSH, WinRM, etc) port between %d and %d",
 			s.HostPortMin, s.HostPortMax)
 
@@ -106,13 +125,13 @@ func (s *StepPortForwarding) Run(ctx context.Context, state multistep.StateBag)
 			"--index", "1",
 			fmt.Sprintf("TcPp,,%d,127.0.0.1,%d", guestPort, commHostPort),
 		}
-		if _, err := driver.ExecuteOsaScript(command...); err != nil {
+		if _, err := driver.ExecuteOsaScript(ctx, command...); err != nil {
 			err := fmt.Errorf("error adding port forwarding rule: %s", err)
 			state.Put("error", err)
 			ui.Error(err.Error())
 			return multistep.ActionHalt
 		}
-
+		s.vmName, s.hostPort = vmName, commHostPort
 	}
 	// Save the port we're using so that future steps can use it
 	state.Put("commHostPort", commHostPort)
@@ -121,6 +140,20 @@ func (s *StepPortForwarding) Run(ctx context.Context, state multistep.StateBag)
 }
 
 func (s *StepPortForwarding) Cleanup(state multistep.StateBag) {
+	if s.ClearOnCleanup && s.vmName != "" {
+		driver := state.Get("driver").(Driver)
+		ui := state.Get("ui").(packersdk.Ui)
+
+		// Removing a port forward which is gone is harmless
+		command := []string{
+			"clear_port_forwards.applescript", s.vmName,
+			"--index", "1", strconv.Itoa(s.hostPort),
+		}
+		if _, err := driver.ExecuteOsaScript(context.Background(), command...); err != nil {
+			ui.Error(fmt.Sprintf("Error deleting port forwarding rule: %s", err))
+		}
+	}
+
 	if s.l != nil {
 		err := s.l.Close()
 		if err != nil {
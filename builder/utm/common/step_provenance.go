@@ -0,0 +1,123 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// This step writes the provenance of the exported files in the output
+// directory: what the build started from, the versions of the tools,
+// when the provisioners ran, and the digests of the files.
+//
+// Uses:
+//
+//	driver Driver
+//	source_digests map[string]string (optional)
+//	ui packersdk.Ui
+//	vm_path string (optional)
+//
+// Produces:
+//
+//	provenance_path string - The path of the provenance file
+type StepProvenance struct {
+	OutputDir OutputDir
+	// Hashes the files on the UTM host, on this machine when nil
+	Executor Executor
+	// Records the runs of the provisioners
+	Hook *ProvenanceHook
+
+	StartedOn time.Time
+	// The source_path of the build and its checksum, no URI when the
+	// build does not import a bundle
+	Source ResourceDescriptor
+	// The options of the build, and of the machine running it
+	ExternalParameters map[string]interface{}
+	InternalParameters map[string]interface{}
+
+	PluginVersion string
+	PackerVersion string
+}
+
+func (s *StepProvenance) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+
+	ui.Say("Writing the provenance of the build...")
+	p, err := s.provenance(ctx, state, driver)
+	if err != nil {
+		err := fmt.Errorf("Error collecting provenance: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	path, err := WriteProvenance(s.OutputDir, p)
+	if err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	state.Put("provenance_path", path)
+	return multistep.ActionContinue
+}
+
+func (s *StepProvenance) provenance(ctx context.Context, state multistep.StateBag, driver Driver) (*Provenance, error) {
+	utmVersion, err := driver.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+	digests, err := FileDigests(ctx, s.Executor, s.OutputDir.String())
+	if err != nil {
+		return nil, err
+	}
+	// A provenance left by an earlier build is not one of the files
+	delete(digests, ProvenanceFilename)
+
+	p := &Provenance{
+		Type:          provenanceStatementType,
+		Subject:       descriptors("", digests),
+		PredicateType: provenancePredicateType,
+	}
+
+	definition := &p.Predicate.BuildDefinition
+	definition.BuildType = provenanceBuildType
+	definition.ExternalParameters = s.ExternalParameters
+	definition.InternalParameters = s.InternalParameters
+	if s.Source.URI != "" {
+		definition.ResolvedDependencies = append(definition.ResolvedDependencies, s.Source)
+	}
+	if sourceDigests, ok := state.GetOk("source_digests"); ok {
+		prefix := filepath.Base(state.Get("vm_path").(string)) + "/"
+		definition.ResolvedDependencies = append(definition.ResolvedDependencies,
+			descriptors(prefix, sourceDigests.(map[string]string))...)
+	}
+
+	run := &p.Predicate.RunDetails
+	run.Builder.ID = BuilderId
+	run.Builder.Version = map[string]string{
+		"packer-plugin-utm": s.PluginVersion,
+		"utm":               utmVersion,
+	}
+	if s.PackerVersion != "" {
+		run.Builder.Version["packer"] = s.PackerVersion
+	}
+	run.Metadata.StartedOn = s.StartedOn.UTC()
+	run.Metadata.FinishedOn = time.Now().UTC()
+	if runs := s.Hook.Runs(); len(runs) > 0 {
+		run.Byproducts = append(run.Byproducts, ResourceDescriptor{
+			Name:        "provisioners",
+			Annotations: map[string]interface{}{"runs": runs},
+		})
+	}
+	return p, nil
+}
+
+func (s *StepProvenance) Cleanup(state multistep.StateBag) {}
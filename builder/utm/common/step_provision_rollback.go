@@ -0,0 +1,156 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// This step goes right before StepProvision, which must stay a step of
+// its own for -on-error=run-cleanup-provisioner to find it. It wraps the
+// hook StepProvision runs, so that when the provisioners run again after
+// failing, which happens when the user picks retry with -on-error=ask,
+// the user is offered to revert the disks to the snapshot of
+// StepSnapshotDisks first: the VM is stopped, rolled back and started
+// again.
+//
+// Uses:
+//
+//	communicator packersdk.Communicator
+//	disk_snapshot_disks []string
+//	driver Driver
+//	hook packersdk.Hook
+//	ui packersdk.Ui
+//	vmName string
+//
+// Produces:
+//
+//	hook packersdk.Hook - The hook, rolling back before a retry
+type StepProvisionRollback struct {
+	Snapshotter *DiskSnapshotter
+	// How long to wait for the guest to accept commands after the rollback
+	ConnectTimeout time.Duration
+
+	hook packersdk.Hook
+}
+
+func (s *StepProvisionRollback) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	s.hook = state.Get("hook").(packersdk.Hook)
+	state.Put("hook", &rollbackHook{Hook: s.hook, step: s, state: state})
+	return multistep.ActionContinue
+}
+
+// rollbackHook offers to roll back before running the provisioners
+// again after they failed.
+type rollbackHook struct {
+	packersdk.Hook
+	step  *StepProvisionRollback
+	state multistep.StateBag
+
+	failed bool
+}
+
+func (h *rollbackHook) Run(ctx context.Context, name string, ui packersdk.Ui, comm packersdk.Communicator, data interface{}) error {
+	if name != packersdk.HookProvision {
+		return h.Hook.Run(ctx, name, ui, comm, data)
+	}
+
+	if h.failed {
+		answer, err := ui.Ask("Roll the VM disks back to the snapshot taken before provisioning? [y/N]")
+		if err != nil {
+			log.Printf("Error asking for input: %s", err)
+		}
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "y") {
+			if err := h.step.rollback(ctx, h.state); err != nil {
+				return fmt.Errorf("Error rolling back: %s", err)
+			}
+		}
+		// The retry decides whether the build fails
+		h.state.Remove("error")
+	}
+
+	err := h.Hook.Run(ctx, name, ui, comm, data)
+	h.failed = err != nil
+	return err
+}
+
+func (s *StepProvisionRollback) rollback(ctx context.Context, state multistep.StateBag) error {
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+	vmName := state.Get("vmName").(string)
+	disks := state.Get("disk_snapshot_disks").([]string)
+
+	ui.Say("Stopping the virtual machine...")
+	if err := driver.Stop(ctx, vmName); err != nil {
+		return err
+	}
+	for {
+		running, err := driver.IsRunning(ctx, vmName)
+		if err != nil {
+			return err
+		}
+		if !running {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+
+	ui.Say(fmt.Sprintf("Rolling back to snapshot %s...", provisioningSnapshotName))
+	if err := s.Snapshotter.Apply(ctx, disks, provisioningSnapshotName); err != nil {
+		return err
+	}
+
+	ui.Say("Starting the virtual machine...")
+	if _, err := driver.Utmctl(ctx, "start", vmName); err != nil {
+		return err
+	}
+
+	return s.waitForGuest(ctx, state)
+}
+
+// waitForGuest waits until the communicator can run a command
+// in the guest again. The communicator reconnects by itself.
+func (s *StepProvisionRollback) waitForGuest(ctx context.Context, state multistep.StateBag) error {
+	comm, ok := state.Get("communicator").(packersdk.Communicator)
+	if !ok || comm == nil {
+		return nil
+	}
+	ui := state.Get("ui").(packersdk.Ui)
+
+	ui.Say("Waiting for the guest...")
+	ctx, cancel := withTimeout(ctx, s.ConnectTimeout)
+	defer cancel()
+	for {
+		cmd := &packersdk.RemoteCmd{Command: "echo"}
+		err := comm.Start(ctx, cmd)
+		if err == nil {
+			cmd.Wait()
+			return nil
+		}
+		log.Printf("Guest not ready: %s", err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timeout waiting for the guest: %s", err)
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (s *StepProvisionRollback) Cleanup(state multistep.StateBag) {
+	if s.hook != nil {
+		state.Put("hook", s.hook)
+	}
+}
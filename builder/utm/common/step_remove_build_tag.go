@@ -0,0 +1,44 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// This step removes the build tag from the (stopped) VM once the build
+// succeeded, so neither the exported bundle nor a VM kept registered is
+// taken for an orphan later.
+//
+// Uses:
+//
+//	driver Driver
+//	ui packersdk.Ui
+//	vmName string
+//
+// Produces:
+//
+//	<nothing>
+type StepRemoveBuildTag struct{}
+
+func (s *StepRemoveBuildTag) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+	vmName := state.Get("vmName").(string)
+
+	if err := SetBuildTag(ctx, driver, vmName, nil); err != nil {
+		err := fmt.Errorf("Error removing the build tag of the VM: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepRemoveBuildTag) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,44 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// This step removes the snapshot of StepSnapshotDisks from the disks
+// of the (stopped) VM, so it does not end up in the exported bundle.
+//
+// Uses:
+//
+//	disk_snapshot_disks []string
+//	ui packersdk.Ui
+//
+// Produces:
+//
+//	<nothing>
+type StepRemoveDiskSnapshot struct {
+	Snapshotter *DiskSnapshotter
+}
+
+func (s *StepRemoveDiskSnapshot) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	disks := state.Get("disk_snapshot_disks").([]string)
+
+	ui.Say(fmt.Sprintf("Removing snapshot %s...", provisioningSnapshotName))
+	if err := s.Snapshotter.Delete(ctx, disks, provisioningSnapshotName); err != nil {
+		err := fmt.Errorf("Error removing snapshot: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepRemoveDiskSnapshot) Cleanup(state multistep.StateBag) {}
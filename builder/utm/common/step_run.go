@@ -5,6 +5,7 @@ package common
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
@@ -21,6 +22,9 @@ import (
 //
 // Produces:
 type StepRun struct {
+	// Start the VM as a snapshot, discarding the changes to its disks
+	Disposable bool
+
 	vmName string
 }
 
@@ -29,9 +33,14 @@ func (s *StepRun) Run(ctx context.Context, state multistep.StateBag) multistep.S
 	ui := state.Get("ui").(packersdk.Ui)
 	vmName := state.Get("vmName").(string)
 
-	ui.Say("Starting the virtual machine...")
 	command := []string{"start", vmName}
-	if _, err := driver.Utmctl(command...); err != nil {
+	if s.Disposable {
+		ui.Say("Starting the virtual machine in disposable mode, changes to its disks will be discarded...")
+		command = append(command, "--disposable")
+	} else {
+		ui.Say("Starting the virtual machine...")
+	}
+	if _, err := driver.Utmctl(ctx, command...); err != nil {
 		err := fmt.Errorf("error starting VM: %s", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
@@ -54,8 +63,11 @@ func (s *StepRun) Cleanup(state multistep.StateBag) {
 	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packersdk.Ui)
 
-	if running, _ := driver.IsRunning(s.vmName); running {
-		if _, err := driver.Utmctl("stop", s.vmName); err != nil {
+	// The build context may already be cancelled, but we still want
+	// to stop the VM, so use a fresh one bound by the driver timeouts.
+	ctx := context.Background()
+	if running, _ := driver.IsRunning(ctx, s.vmName); running {
+		if _, err := driver.Utmctl(ctx, "stop", s.vmName); err != nil && !errors.Is(err, ErrVMNotFound) {
 			ui.Error(fmt.Sprintf("Error shutting down VM: %s", err))
 		}
 	}
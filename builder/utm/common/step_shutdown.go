@@ -53,7 +53,7 @@ func (s *StepShutdown) Run(ctx context.Context, state multistep.StateBag) multis
 
 		} else {
 			ui.Say("Halting the virtual machine...")
-			if err := driver.Stop(vmName); err != nil {
+			if err := driver.Stop(ctx, vmName); err != nil {
 				err := fmt.Errorf("error stopping VM: %s", err)
 				state.Put("error", err)
 				ui.Error(err.Error())
@@ -68,7 +68,7 @@ func (s *StepShutdown) Run(ctx context.Context, state multistep.StateBag) multis
 	log.Printf("Waiting max %s for shutdown to complete", s.Timeout)
 	shutdownTimer := time.After(s.Timeout)
 	for {
-		running, _ := driver.IsRunning(vmName)
+		running, _ := driver.IsRunning(ctx, vmName)
 		if !running {
 
 			if s.Delay.Nanoseconds() > 0 {
@@ -80,6 +80,11 @@ func (s *StepShutdown) Run(ctx context.Context, state multistep.StateBag) multis
 		}
 
 		select {
+		case <-ctx.Done():
+			err := fmt.Errorf("interrupted while waiting for machine to shutdown: %w", ctx.Err())
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
 		case <-shutdownTimer:
 			err := errors.New("timeout while waiting for machine to shutdown")
 			state.Put("error", err)
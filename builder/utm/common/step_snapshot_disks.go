@@ -0,0 +1,96 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// This step takes an internal snapshot of every qcow2 disk of the
+// (stopped) VM before its first boot, so StepProvisionRollback can
+// revert the disks when provisioning fails.
+//
+// Uses:
+//
+//	driver Driver
+//	ui packersdk.Ui
+//	vmName string
+//	vm_path string (optional, the bundle UTM 4.5 opened in place)
+//
+// Produces:
+//
+//	disk_snapshot_disks []string - The disks with a snapshot
+type StepSnapshotDisks struct {
+	Snapshotter *DiskSnapshotter
+	// Remove the snapshot when the build fails, for VMs which outlive
+	// the build. StepRemoveDiskSnapshot removes it when the build succeeds.
+	RemoveOnCleanup bool
+
+	disks []string
+}
+
+func (s *StepSnapshotDisks) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+	vmName := state.Get("vmName").(string)
+
+	disks, err := s.findDisks(ctx, driver, state, vmName)
+	if err != nil {
+		err := fmt.Errorf("Error finding the disks to snapshot: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	ui.Say(fmt.Sprintf("Taking snapshot %s of %d disk(s)...", provisioningSnapshotName, len(disks)))
+	if err := s.Snapshotter.Create(ctx, disks, provisioningSnapshotName); err != nil {
+		err := fmt.Errorf("Error taking snapshot: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	s.disks = disks
+	state.Put("disk_snapshot_disks", disks)
+	return multistep.ActionContinue
+}
+
+func (s *StepSnapshotDisks) findDisks(ctx context.Context, driver Driver, state multistep.StateBag, vmName string) ([]string, error) {
+	vms, err := driver.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, vm := range vms {
+		if vm.Name != vmName {
+			continue
+		}
+		var bundles []string
+		if path, ok := state.GetOk("vm_path"); ok {
+			bundles = append(bundles, path.(string))
+		}
+		return s.Snapshotter.Disks(ctx, vm.UUID, bundles...)
+	}
+	return nil, fmt.Errorf("VM %s not found", vmName)
+}
+
+func (s *StepSnapshotDisks) Cleanup(state multistep.StateBag) {
+	if !s.RemoveOnCleanup || s.disks == nil {
+		return
+	}
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	_, halted := state.GetOk(multistep.StateHalted)
+	if !cancelled && !halted {
+		return
+	}
+
+	ui := state.Get("ui").(packersdk.Ui)
+	ui.Say(fmt.Sprintf("Removing snapshot %s...", provisioningSnapshotName))
+	if err := s.Snapshotter.Delete(context.Background(), s.disks, provisioningSnapshotName); err != nil {
+		ui.Error(fmt.Sprintf("Error removing snapshot: %s", err))
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// A Forwarder forwards connections to a local port
+// to an address on the UTM host, like SSHExecutor.
+type Forwarder interface {
+	Forward(remoteAddr string) (net.Listener, error)
+}
+
+// This step tunnels the communicator port forwarded on a remote UTM host
+// to a local port, so the communicator can reach the guest.
+//
+// Uses:
+//
+//	commHostPort int
+//	ui packersdk.Ui
+//
+// Produces:
+//
+//	commTunnelPort int - The local port the communicator connects to.
+type StepSSHTunnel struct {
+	Forwarder Forwarder
+
+	l net.Listener
+}
+
+func (s *StepSSHTunnel) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	commHostPort := state.Get("commHostPort").(int)
+
+	if commHostPort == 0 {
+		log.Printf("No communicator port, skipping the tunnel to the UTM host...")
+		return multistep.ActionContinue
+	}
+
+	var err error
+	s.l, err = s.Forwarder.Forward(fmt.Sprintf("127.0.0.1:%d", commHostPort))
+	if err != nil {
+		err := fmt.Errorf("error tunnelling to the UTM host: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	tunnelPort := s.l.Addr().(*net.TCPAddr).Port
+	ui.Say(fmt.Sprintf("Tunnelling local port %d to port %d on the UTM host", tunnelPort, commHostPort))
+	state.Put("commTunnelPort", tunnelPort)
+
+	return multistep.ActionContinue
+}
+
+func (s *StepSSHTunnel) Cleanup(state multistep.StateBag) {
+	if s.l != nil {
+		s.l.Close()
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/naveenrajm7/packer-plugin-utm/signature"
+	"golang.org/x/crypto/ssh"
+)
+
+// This step checks the source bundle against the manifest the utm-zip
+// post-processor wrote when it was archived, after checking the
+// signature of the manifest when a public key is set.
+//
+// Uses:
+//
+//	ui packersdk.Ui
+//	vm_path string
+//
+// Produces:
+//
+//	<nothing>
+type StepVerifySource struct {
+	Manifest  string
+	PublicKey ssh.PublicKey
+}
+
+func (s *StepVerifySource) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	vmPath := state.Get("vm_path").(string)
+
+	// The manifest is read once, so the one checked
+	// is the one which was signed
+	manifest, err := os.ReadFile(s.Manifest)
+	if err != nil {
+		err := fmt.Errorf("Error reading source manifest: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	if s.PublicKey != nil {
+		ui.Say("Verifying the signature of the source manifest...")
+		if err := verifyManifestSignature(s.PublicKey, s.Manifest, manifest); err != nil {
+			err := fmt.Errorf("Error verifying source manifest: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	ui.Say("Verifying the source bundle against its manifest...")
+	if err := VerifyBundle(vmPath, manifest); err != nil {
+		err := fmt.Errorf("Error verifying source bundle: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+// verifyManifestSignature checks the signature next to the manifest at
+// path against its content.
+func verifyManifestSignature(key ssh.PublicKey, path string, manifest []byte) error {
+	sig, err := os.ReadFile(path + signature.Extension)
+	if err != nil {
+		return err
+	}
+	if err := signature.Verify(key, bytes.NewReader(manifest), sig); err != nil {
+		return fmt.Errorf("bad signature of %s: %s", path, err)
+	}
+	return nil
+}
+
+func (s *StepVerifySource) Cleanup(state multistep.StateBag) {}
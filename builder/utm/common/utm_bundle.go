@@ -0,0 +1,148 @@
+package common
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BundleInfo is what we know about a UTM bundle (a .utm directory)
+// from its config.plist, without importing it into UTM.
+type BundleInfo struct {
+	Path string
+	// "QEMU" or "Apple"
+	Backend      string
+	Name         string
+	UUID         string
+	Architecture string
+	CPUCount     int
+	// In MiB
+	MemorySize int
+	// The mode of each network interface, e.g. "Shared" or "Emulated"
+	NetworkModes []string
+}
+
+// ReadBundleInfo reads the config.plist of the UTM bundle at path.
+func ReadBundleInfo(path string) (*BundleInfo, error) {
+	f, err := os.Open(filepath.Join(path, "config.plist"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading UTM bundle: %s", err)
+	}
+	defer f.Close()
+
+	root, err := decodePlist(f)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config.plist of %s: %s", path, err)
+	}
+	config, ok := root.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("error parsing config.plist of %s: not a dictionary", path)
+	}
+
+	info := &BundleInfo{Path: path}
+	info.Backend, _ = config["Backend"].(string)
+	if information, ok := config["Information"].(map[string]interface{}); ok {
+		info.Name, _ = information["Name"].(string)
+		info.UUID, _ = information["UUID"].(string)
+	}
+	if system, ok := config["System"].(map[string]interface{}); ok {
+		info.Architecture, _ = system["Architecture"].(string)
+		info.CPUCount, _ = system["CPUCount"].(int)
+		info.MemorySize, _ = system["MemorySize"].(int)
+	}
+	if network, ok := config["Network"].([]interface{}); ok {
+		for _, nic := range network {
+			if nic, ok := nic.(map[string]interface{}); ok {
+				mode, _ := nic["Mode"].(string)
+				info.NetworkModes = append(info.NetworkModes, mode)
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// decodePlist decodes an XML property list into maps, slices,
+// strings, ints, floats and bools. Data and dates are kept as strings.
+func decodePlist(r io.Reader) (interface{}, error) {
+	d := xml.NewDecoder(r)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := tok.(xml.StartElement); ok && start.Name.Local != "plist" {
+			return decodePlistValue(d, start)
+		}
+	}
+}
+
+func decodePlistValue(d *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	switch start.Name.Local {
+	case "dict":
+		dict := map[string]interface{}{}
+		key := ""
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch tok := tok.(type) {
+			case xml.StartElement:
+				if tok.Name.Local == "key" {
+					if err := d.DecodeElement(&key, &tok); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				value, err := decodePlistValue(d, tok)
+				if err != nil {
+					return nil, err
+				}
+				dict[key] = value
+			case xml.EndElement:
+				return dict, nil
+			}
+		}
+	case "array":
+		array := []interface{}{}
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch tok := tok.(type) {
+			case xml.StartElement:
+				value, err := decodePlistValue(d, tok)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, value)
+			case xml.EndElement:
+				return array, nil
+			}
+		}
+	case "true", "false":
+		if err := d.Skip(); err != nil {
+			return nil, err
+		}
+		return start.Name.Local == "true", nil
+	}
+
+	var text string
+	if err := d.DecodeElement(&text, &start); err != nil {
+		return nil, err
+	}
+	text = strings.TrimSpace(text)
+	switch start.Name.Local {
+	case "integer":
+		return strconv.Atoi(text)
+	case "real":
+		return strconv.ParseFloat(text, 64)
+	}
+	return text, nil
+}
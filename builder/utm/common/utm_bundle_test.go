@@ -0,0 +1,88 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testConfigPlist = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Backend</key>
+	<string>QEMU</string>
+	<key>ConfigurationVersion</key>
+	<integer>4</integer>
+	<key>Information</key>
+	<dict>
+		<key>IconCustom</key>
+		<false/>
+		<key>Name</key>
+		<string>debian</string>
+		<key>UUID</key>
+		<string>6A3B8F1E-3F5C-4B0E-9C7D-2E1F0A9B8C7D</string>
+	</dict>
+	<key>Network</key>
+	<array>
+		<dict>
+			<key>Hardware</key>
+			<string>virtio-net-pci</string>
+			<key>Mode</key>
+			<string>Shared</string>
+		</dict>
+		<dict>
+			<key>Mode</key>
+			<string>Emulated</string>
+			<key>PortForward</key>
+			<array/>
+		</dict>
+	</array>
+	<key>System</key>
+	<dict>
+		<key>Architecture</key>
+		<string>aarch64</string>
+		<key>CPUCount</key>
+		<integer>4</integer>
+		<key>MemorySize</key>
+		<integer>4096</integer>
+	</dict>
+</dict>
+</plist>
+`
+
+func TestReadBundleInfo(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "config.plist"), []byte(testConfigPlist), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	info, err := ReadBundleInfo(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := &BundleInfo{
+		Path:         dir,
+		Backend:      "QEMU",
+		Name:         "debian",
+		UUID:         "6A3B8F1E-3F5C-4B0E-9C7D-2E1F0A9B8C7D",
+		Architecture: "aarch64",
+		CPUCount:     4,
+		MemorySize:   4096,
+		NetworkModes: []string{"Shared", "Emulated"},
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("bad: %#v", info)
+	}
+}
+
+func TestReadBundleInfo_missing(t *testing.T) {
+	if _, err := ReadBundleInfo(t.TempDir()); err == nil {
+		t.Fatal("should fail without config.plist")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
+	"time"
 
 	"github.com/hashicorp/hcl/v2/hcldec"
 	"github.com/hashicorp/packer-plugin-sdk/communicator"
@@ -11,6 +13,7 @@ import (
 	"github.com/hashicorp/packer-plugin-sdk/multistep/commonsteps"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
 	utmcommon "github.com/naveenrajm7/packer-plugin-utm/builder/utm/common"
+	"github.com/naveenrajm7/packer-plugin-utm/version"
 )
 
 // Builder implements packersdk.Builder and builds the actual UTM
@@ -18,6 +21,10 @@ import (
 type Builder struct {
 	config Config
 	runner multistep.Runner
+
+	// Runs utmctl and osascript, on this machine when nil.
+	// Tests set it to a SimulatedUTM.
+	executor utmcommon.Executor
 }
 
 func (b *Builder) ConfigSpec() hcldec.ObjectSpec { return b.config.FlatMapstructure().HCL2Spec() }
@@ -34,12 +41,61 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, []string, error) {
 // Run executes a Packer build and returns a packersdk.Artifact representing
 // a UTM appliance.
 func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook) (packersdk.Artifact, error) {
+	if b.config.DryRun {
+		return nil, b.dryRun(ctx, ui)
+	}
+	startedOn := time.Now()
+
+	// Connect to the UTM host, if UTM runs on another machine
+	executor, utmctlPath := b.executor, "utmctl"
+	var sshExecutor *utmcommon.SSHExecutor
+	if b.config.UtmHost != "" {
+		var err error
+		sshExecutor, err = utmcommon.NewSSHExecutor(&b.config.RemoteConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Failed connecting to UTM host: %s", err)
+		}
+		defer sshExecutor.Close()
+		executor, utmctlPath = sshExecutor, b.config.UtmHostUtmctlPath
+	}
+
 	// Create the driver that we'll use to communicate with UTM
-	driver, err := utmcommon.NewDriver()
+	driver, err := b.newDriver(ctx, executor, utmctlPath)
 	if err != nil {
 		return nil, fmt.Errorf("Failed creating UTM driver: %s", err)
 	}
 
+	// The output directory and the source live on the UTM host
+	var dir utmcommon.OutputDir = &utmcommon.LocalOutputDir{}
+	var fileExists func(string) (bool, error)
+	var hostExecutor utmcommon.Executor
+	if sshExecutor != nil {
+		hostExecutor = sshExecutor
+		dir = &utmcommon.RemoteOutputDir{Executor: sshExecutor}
+		fileExists = func(path string) (bool, error) {
+			return utmcommon.RemoteFileExists(sshExecutor, path)
+		}
+	}
+	dir.SetOutputDir(b.config.OutputDir)
+
+	// Resume the interrupted build recorded in the output directory
+	var resume *utmcommon.Checkpoint
+	if b.config.Checkpoint {
+		resume, err = b.readCheckpoint(ctx, ui, driver, dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Record when the provisioners run for the provenance
+	var provenanceHook *utmcommon.ProvenanceHook
+	var digestSource *utmcommon.StepDigestSource
+	if b.config.Provenance {
+		provenanceHook = &utmcommon.ProvenanceHook{Hook: hook}
+		hook = provenanceHook
+		digestSource = &utmcommon.StepDigestSource{Executor: hostExecutor}
+	}
+
 	// Set up the state
 	state := new(multistep.BasicStateBag)
 	state.Put("config", &b.config)
@@ -48,36 +104,82 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 	state.Put("hook", hook)
 	state.Put("ui", ui)
 
-	// Build the steps
-	steps := []multistep.Step{
-		&commonsteps.StepOutputDir{
-			Force: b.config.PackerForce,
-			Path:  b.config.OutputDir,
-		},
+	// Build the steps, nothing is written to the output
+	// directory in disposable mode
+	var steps []multistep.Step
+	if !b.config.Disposable {
+		steps = append(steps, &utmcommon.StepOutputDir{
+			Force:     b.config.PackerForce,
+			OutputDir: dir,
+			Resume:    resume != nil,
+		})
+	}
+	steps = append(steps,
 		&utmcommon.StepSshKeyPair{
 			Debug:        b.config.PackerDebug,
 			DebugKeyPath: fmt.Sprintf("%s.pem", b.config.PackerBuildName),
 			Comm:         &b.config.Comm,
 		},
-		&utmcommon.StepUtmDownload{
-			Checksum:    b.config.Checksum,
-			Description: "UTM",
-			Extension:   "utm",
-			ResultKey:   "vm_path",
-			TargetPath:  b.config.TargetPath,
-			Url:         []string{b.config.SourcePath},
-		},
-		&StepImport{
-			Name:           b.config.VMName,
+	)
+	if resume != nil {
+		steps = append(steps, &StepResume{
+			Checkpoint:     resume,
 			KeepRegistered: b.config.KeepRegistered,
-		},
+		})
+	} else {
+		steps = append(steps, b.vmSteps(fileExists, digestSource)...)
+		if b.config.Checkpoint {
+			steps = append(steps, b.checkpointStep(dir, utmcommon.CheckpointImported))
+		}
+	}
+
+	// The disks are snapshotted where UTM runs
+	var provision []multistep.Step
+	snapshotter := &utmcommon.DiskSnapshotter{
+		Executor:    executor,
+		QemuImgPath: b.config.QemuImgPath,
+		Timeout:     b.config.ImportExportTimeout,
+	}
+	if b.config.SnapshotBeforeProvisioning {
+		steps = append(steps, &utmcommon.StepSnapshotDisks{
+			Snapshotter:     snapshotter,
+			RemoveOnCleanup: b.config.Attaching(),
+		})
+		connectTimeout := b.config.CommConfig.Comm.SSHTimeout
+		if b.config.CommConfig.Comm.Type == "winrm" {
+			connectTimeout = b.config.CommConfig.Comm.WinRMTimeout
+		}
+		provision = append(provision, &utmcommon.StepProvisionRollback{
+			Snapshotter:    snapshotter,
+			ConnectTimeout: connectTimeout,
+		})
+	}
+	// StepProvision must not be wrapped, -on-error=run-cleanup-provisioner
+	// looks for it by type
+	if resume != nil && resume.Reached(utmcommon.CheckpointProvisioned) {
+		provision = append(provision, new(StepSkipProvision))
+	}
+	provision = append(provision, new(commonsteps.StepProvision))
+
+	steps = append(steps,
 		&utmcommon.StepPortForwarding{
 			CommConfig:     &b.config.CommConfig.Comm,
 			HostPortMin:    b.config.HostPortMin,
 			HostPortMax:    b.config.HostPortMax,
 			SkipNatMapping: b.config.SkipNatMapping,
+			ClearOnCleanup: b.config.Attaching() || b.config.Checkpoint,
+			RemoteHost:     sshExecutor != nil,
 		},
-		&utmcommon.StepRun{},
+		&utmcommon.StepRun{
+			Disposable: b.config.Disposable,
+		},
+	)
+	if sshExecutor != nil {
+		steps = append(steps, &utmcommon.StepSSHTunnel{
+			Forwarder: sshExecutor,
+		})
+	}
+	steps = append(steps,
 		&communicator.StepConnect{
 			Config:    &b.config.CommConfig.Comm,
 			Host:      utmcommon.CommHost(b.config.CommConfig.Comm.Host()),
@@ -88,7 +190,12 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 		&utmcommon.StepUploadVersion{
 			Path: *b.config.UtmVersionFile,
 		},
-		new(commonsteps.StepProvision),
+	)
+	steps = append(steps, provision...)
+	if b.config.Checkpoint && (resume == nil || !resume.Reached(utmcommon.CheckpointProvisioned)) {
+		steps = append(steps, b.checkpointStep(dir, utmcommon.CheckpointProvisioned))
+	}
+	steps = append(steps,
 		&commonsteps.StepCleanupTempKeys{
 			Comm: &b.config.CommConfig.Comm,
 		},
@@ -98,13 +205,31 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 			Delay:           b.config.PostShutdownDelay,
 			DisableShutdown: b.config.DisableShutdown,
 		},
+	)
+	if b.config.SnapshotBeforeProvisioning {
+		steps = append(steps, &utmcommon.StepRemoveDiskSnapshot{
+			Snapshotter: snapshotter,
+		})
+	}
+	if !b.config.Attaching() {
+		steps = append(steps, new(utmcommon.StepRemoveBuildTag))
+	}
+	steps = append(steps,
 		&utmcommon.StepExport{
 			Format:         b.config.Format,
 			OutputDir:      b.config.OutputDir,
 			OutputFilename: b.config.OutputFilename,
 			SkipNatMapping: b.config.SkipNatMapping,
-			SkipExport:     b.config.SkipExport,
+			SkipExport:     b.config.SkipExport || b.config.Disposable,
 		},
+	)
+	if b.config.Checkpoint {
+		steps = append(steps, &StepRemoveCheckpoint{
+			OutputDir: dir,
+		})
+	}
+	if b.config.Provenance {
+		steps = append(steps, b.provenanceStep(dir, hostExecutor, provenanceHook, startedOn))
 	}
 
 	// Run the steps.
@@ -126,5 +251,159 @@ func (b *Builder) Run(ctx context.Context, ui packersdk.Ui, hook packersdk.Hook)
 	}
 
 	generatedData := map[string]interface{}{"generated_data": state.Get("generated_data")}
-	return utmcommon.NewArtifact(b.config.OutputDir, b.config.VMName, generatedData)
+	// The zip post-processor records it in its manifest
+	if utmVersion, err := driver.Version(ctx); err != nil {
+		log.Printf("Error reading the UTM version for the artifact: %s", err)
+	} else {
+		generatedData["utm_version"] = utmVersion
+	}
+	// Post-processors can ship it along the image
+	if path, ok := state.GetOk("provenance_path"); ok {
+		generatedData["provenance"] = path
+	}
+	// The files are on the UTM host, post-processors can't open them here
+	if b.config.UtmHost != "" {
+		generatedData["utm_host"] = b.config.UtmHost
+	}
+	if b.config.Disposable {
+		return utmcommon.NewDisposableArtifact(state.Get("vmName").(string), generatedData), nil
+	}
+	return utmcommon.NewArtifact(dir, state.Get("vmName").(string), generatedData)
+}
+
+// readCheckpoint returns the checkpoint of the interrupted build to
+// resume, if any. With -force, the checkpoint and its VM are discarded.
+func (b *Builder) readCheckpoint(ctx context.Context, ui packersdk.Ui, driver utmcommon.Driver, dir utmcommon.OutputDir) (*utmcommon.Checkpoint, error) {
+	checkpoint, err := utmcommon.ReadCheckpoint(dir)
+	if err != nil || checkpoint == nil {
+		return nil, err
+	}
+
+	if b.config.PackerForce {
+		ui.Say(fmt.Sprintf("Discarding the checkpoint of the interrupted build and its VM %s...", checkpoint.VMName))
+		err := utmcommon.StopAndDelete(ctx, driver, checkpoint.VMName)
+		if err != nil && !errors.Is(err, utmcommon.ErrVMNotFound) {
+			return nil, fmt.Errorf("Error deleting VM %s: %s", checkpoint.VMName, err)
+		}
+		return nil, nil
+	}
+
+	if reason := checkpoint.Matches(b.config.PackerBuildName, b.config.checkpointSource()); reason != "" {
+		return nil, fmt.Errorf(
+			"Output directory %s has a checkpoint of another build: %s\n\n"+
+				"Use the force flag to discard it.", dir, reason)
+	}
+	return checkpoint, nil
+}
+
+// checkpointStep returns the step recording that the build completed phase.
+func (b *Builder) checkpointStep(dir utmcommon.OutputDir, phase string) multistep.Step {
+	return &StepCheckpoint{
+		OutputDir: dir,
+		BuildName: b.config.PackerBuildName,
+		Source:    b.config.checkpointSource(),
+		Phase:     phase,
+	}
+}
+
+// provenanceStep returns the step writing the provenance of the build
+// started at startedOn, whose provisioners run through hook.
+func (b *Builder) provenanceStep(dir utmcommon.OutputDir, executor utmcommon.Executor, hook *utmcommon.ProvenanceHook, startedOn time.Time) multistep.Step {
+	step := &utmcommon.StepProvenance{
+		OutputDir: dir,
+		Executor:  executor,
+		Hook:      hook,
+		StartedOn: startedOn,
+		ExternalParameters: map[string]interface{}{
+			"build_name": b.config.PackerBuildName,
+			"vm_name":    b.config.VMName,
+			// As typed in the template, nothing checks they are the ones run
+			"declared_provisioners": append([]string{}, b.config.ProvenanceProvisioners...),
+		},
+		InternalParameters: map[string]interface{}{},
+		PluginVersion:      version.PluginVersion.String(),
+		PackerVersion:      b.config.PackerCoreVersion,
+	}
+
+	params := step.ExternalParameters
+	switch {
+	case b.config.Attaching():
+		params["attach_vm_name"], params["attach_vm_uuid"] = b.config.AttachVMName, b.config.AttachVMUUID
+	case b.config.Cloning():
+		params["clone_vm_name"], params["clone_vm_uuid"] = b.config.CloneVMName, b.config.CloneVMUUID
+	default:
+		params["source_path"] = b.config.SourcePath
+		step.Source = utmcommon.ResourceDescriptor{
+			URI:    b.config.SourcePath,
+			Digest: utmcommon.ChecksumDigest(b.config.Checksum),
+		}
+	}
+	if b.config.UtmHost != "" {
+		step.InternalParameters["utm_host"] = b.config.UtmHost
+	}
+	return step
+}
+
+// vmSteps returns the steps registering the VM to build with UTM,
+// by importing or cloning, or finding it when attaching to an existing VM.
+// The source bundle is hashed with digestSource when it is set.
+func (b *Builder) vmSteps(fileExists func(string) (bool, error), digestSource *utmcommon.StepDigestSource) []multistep.Step {
+	if b.config.Attaching() {
+		return []multistep.Step{
+			&StepAttach{
+				Name: b.config.AttachVMName,
+				UUID: b.config.AttachVMUUID,
+			},
+		}
+	}
+
+	var steps []multistep.Step
+	if !b.config.Cloning() {
+		steps = append(steps, &utmcommon.StepUtmDownload{
+			Checksum:    b.config.Checksum,
+			Description: "UTM",
+			Extension:   "utm",
+			ResultKey:   "vm_path",
+			TargetPath:  b.config.TargetPath,
+			Url:         []string{b.config.SourcePath},
+			FileExists:  fileExists,
+		})
+		if b.config.SourceManifest != "" {
+			steps = append(steps, &utmcommon.StepVerifySource{
+				Manifest:  b.config.SourceManifest,
+				PublicKey: b.config.sourcePublicKey,
+			})
+		}
+		if digestSource != nil {
+			steps = append(steps, digestSource)
+		}
+	}
+	if b.config.CleanupOrphans {
+		steps = append(steps, &utmcommon.StepCleanupOrphans{
+			MinAge: b.config.OrphanMinAge,
+		})
+	}
+	if b.config.Cloning() {
+		return append(steps, &StepClone{
+			SourceName:     b.config.CloneVMName,
+			SourceUUID:     b.config.CloneVMUUID,
+			Name:           b.config.VMName,
+			KeepRegistered: b.config.KeepRegistered,
+			Force:          b.config.PackerForce,
+		})
+	}
+	return append(steps, &StepImport{
+		Name:           b.config.VMName,
+		KeepRegistered: b.config.KeepRegistered,
+		Force:          b.config.PackerForce,
+	})
+}
+
+// newDriver creates the driver that runs commands through executor,
+// or on this machine if it is nil.
+func (b *Builder) newDriver(ctx context.Context, executor utmcommon.Executor, utmctlPath string) (utmcommon.Driver, error) {
+	if executor == nil {
+		return utmcommon.NewDriver(ctx, &b.config.DriverConfig)
+	}
+	return utmcommon.NewDriverWithExecutor(ctx, &b.config.DriverConfig, executor, utmctlPath)
 }
@@ -0,0 +1,994 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package utm
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	utmcommon "github.com/naveenrajm7/packer-plugin-utm/builder/utm/common"
+	"github.com/naveenrajm7/packer-plugin-utm/signature"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSourceBundle creates a minimal UTM bundle named after vmName.
+func testSourceBundle(t *testing.T, vmName string) string {
+	dir := filepath.Join(t.TempDir(), vmName+".utm")
+	if err := os.MkdirAll(filepath.Join(dir, "Data"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	plist := "<plist><dict><key>Information</key><dict>" +
+		"<key>Name</key><string>" + vmName + "</string></dict></dict></plist>"
+	if err := os.WriteFile(filepath.Join(dir, "config.plist"), []byte(plist), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Data", "disk.qcow2"), []byte("disk"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return dir
+}
+
+// testBuilderConfig returns a config building vmName from a fresh
+// bundle without a communicator, so no guest is needed.
+func testBuilderConfig(t *testing.T, vmName string) map[string]interface{} {
+	return map[string]interface{}{
+		"communicator":        "none",
+		"utm_version_file":    "",
+		"checksum":            "none",
+		"source_path":         testSourceBundle(t, vmName),
+		"vm_name":             vmName,
+		"output_directory":    filepath.Join(t.TempDir(), "output"),
+		"post_shutdown_delay": "1ms",
+	}
+}
+
+func testBuild(t *testing.T, utm *utmcommon.SimulatedUTM, cfg map[string]interface{}) (packersdk.Artifact, error) {
+	artifact, _, err := testBuildOutput(t, utm, cfg)
+	return artifact, err
+}
+
+// testBuildOutput runs a build against utm and returns what was written to the UI.
+func testBuildOutput(t *testing.T, utm *utmcommon.SimulatedUTM, cfg map[string]interface{}) (packersdk.Artifact, string, error) {
+	return testBuildHook(t, utm, cfg, &packersdk.MockHook{})
+}
+
+// testBuildHook is testBuildOutput running the provisioners with hook.
+func testBuildHook(t *testing.T, utm *utmcommon.SimulatedUTM, cfg map[string]interface{}, hook packersdk.Hook) (packersdk.Artifact, string, error) {
+	b := &Builder{executor: utm}
+	if _, _, err := b.Prepare(cfg); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	out := new(bytes.Buffer)
+	ui := &packersdk.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: out,
+	}
+	artifact, err := b.Run(context.Background(), ui, hook)
+	return artifact, out.String(), err
+}
+
+func TestBuilder_impl(t *testing.T) {
+	var _ packersdk.Builder = new(Builder)
+}
+
+func TestBuilderRun_UTM46(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	cfg := testBuilderConfig(t, "packer-test")
+
+	artifact, err := testBuild(t, utm, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	exported := filepath.Join(cfg["output_directory"].(string), "packer-test.utm", "config.plist")
+	found := false
+	for _, f := range artifact.Files() {
+		found = found || f == exported
+	}
+	if !found {
+		t.Fatalf("exported bundle not in artifact files: %#v", artifact.Files())
+	}
+	if version := artifact.State("utm_version"); version != "4.6.4" {
+		t.Fatalf("bad utm_version: %#v", version)
+	}
+
+	// The imported VM is deleted once exported
+	if vms := utm.VMs(); len(vms) != 0 {
+		t.Fatalf("VMs should be deleted: %#v", vms)
+	}
+
+	var ops []string
+	for _, call := range utm.Calls {
+		if call[0] == "utmctl" || strings.HasSuffix(call[1], ".applescript") {
+			ops = append(ops, call[0]+" "+call[1])
+		}
+	}
+	expected := []string{
+		"utmctl list",
+		"osascript import_vm.applescript",
+		"osascript rename_vm.applescript",
+		"osascript set_build_tag.applescript",
+		"utmctl start",
+		"utmctl stop",
+		"utmctl status",
+		"osascript set_build_tag.applescript",
+		"osascript export_vm.applescript",
+		"utmctl status",
+		"utmctl delete",
+	}
+	if strings.Join(ops, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("bad operations:\n%s", strings.Join(ops, "\n"))
+	}
+}
+
+func TestBuilderRun_UTM45KeepRegistered(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.5.4")
+	cfg := testBuilderConfig(t, "packer-test")
+	cfg["skip_export"] = true
+	cfg["keep_registered"] = true
+
+	if _, err := testBuild(t, utm, cfg); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	vm := utm.VM("packer-test")
+	if vm == nil {
+		t.Fatal("VM should be kept registered")
+	}
+	if vm.Status != "stopped" {
+		t.Fatalf("VM should be stopped: %s", vm.Status)
+	}
+	if vm.BundlePath != cfg["source_path"] {
+		t.Fatalf("bad bundle: %s", vm.BundlePath)
+	}
+	// A VM kept on purpose is no orphan
+	if vm.Notes != "" {
+		t.Fatalf("build tag should be removed: %q", vm.Notes)
+	}
+}
+
+func TestBuilderRun_CleanupOrphans(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	// The pid of a process which is gone
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	deadPID := cmd.Process.Pid
+	old := time.Now().Add(-2 * time.Hour)
+
+	namespace := utmcommon.ProcessNamespace()
+	if namespace == "" {
+		t.Skip("the PID namespace of this process is unknown")
+	}
+
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	tag := func(name, host, namespace string, pid int, created time.Time) {
+		vm := utm.AddVM(name)
+		vm.Notes = "user notes\n" + (&utmcommon.BuildTag{
+			Host: host, Namespace: namespace, PID: pid, Created: created}).String()
+	}
+	tag("orphan", host, namespace, deadPID, old)
+	tag("recent", host, namespace, deadPID, time.Now())
+	tag("alive", host, namespace, os.Getpid(), old)
+	tag("elsewhere", "other-machine", namespace, deadPID, old)
+	tag("container", host, "other-namespace", deadPID, old)
+	tag("unknown", host, "", deadPID, old)
+	utm.AddVM("untagged")
+	utm.VM("orphan").Status = "started"
+
+	cfg := testBuilderConfig(t, "packer-test")
+	cfg["cleanup_orphans"] = true
+	_, out, err := testBuildOutput(t, utm, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var names []string
+	for _, vm := range utm.VMs() {
+		names = append(names, vm.Name)
+	}
+	if strings.Join(names, ",") != "recent,alive,elsewhere,container,unknown,untagged" {
+		t.Fatalf("bad VMs: %#v", names)
+	}
+	if !strings.Contains(out, "Deleting orphaned VM") {
+		t.Fatalf("deletion should be logged:\n%s", out)
+	}
+}
+
+func TestBuilderRun_Attach(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	vm := utm.AddVM("dev vm")
+	vm.Notes = "my notes"
+
+	cfg := testBuilderConfig(t, "packer-test")
+	delete(cfg, "source_path")
+	delete(cfg, "vm_name")
+	cfg["attach_vm_name"] = "dev vm"
+	cfg["skip_export"] = true
+
+	artifact, err := testBuild(t, utm, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if artifact.Id() != "dev vm" {
+		t.Fatalf("bad: %s", artifact.Id())
+	}
+
+	if vms := utm.VMs(); len(vms) != 1 || vms[0] != vm {
+		t.Fatalf("the VM should be kept: %#v", vms)
+	}
+	if vm.Status != "stopped" || vm.Notes != "my notes" {
+		t.Fatalf("bad: %#v", vm)
+	}
+	for _, call := range utm.Calls {
+		if call[0] == "osascript" && (call[1] == "import_vm.applescript" || call[1] == "set_build_tag.applescript") {
+			t.Fatalf("bad call: %#v", call)
+		}
+	}
+}
+
+func TestBuilderRun_AttachByUUIDExport(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	vm := utm.AddVM("dev vm")
+	vm.BundlePath = testSourceBundle(t, "dev vm")
+
+	cfg := testBuilderConfig(t, "packer-test")
+	delete(cfg, "source_path")
+	delete(cfg, "vm_name")
+	cfg["attach_vm_uuid"] = vm.UUID
+
+	if _, err := testBuild(t, utm, cfg); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	exported := filepath.Join(cfg["output_directory"].(string), "dev vm.utm", "config.plist")
+	if _, err := os.Stat(exported); err != nil {
+		t.Fatalf("should be exported: %s", err)
+	}
+	if utm.VM(vm.UUID) == nil {
+		t.Fatal("the VM should be kept")
+	}
+}
+
+func TestBuilderRun_AttachDisposable(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	vm := utm.AddVM("golden")
+
+	cfg := testBuilderConfig(t, "packer-test")
+	delete(cfg, "source_path")
+	cfg["attach_vm_name"] = "golden"
+	cfg["disposable"] = true
+
+	artifact, err := testBuild(t, utm, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !vm.Disposable {
+		t.Fatal("the VM should be started in disposable mode")
+	}
+	if len(artifact.Files()) != 0 || !strings.Contains(artifact.String(), "No image was produced") {
+		t.Fatalf("bad artifact: %s %#v", artifact, artifact.Files())
+	}
+	if _, err := os.Stat(cfg["output_directory"].(string)); !os.IsNotExist(err) {
+		t.Fatalf("output directory should not be created: %v", err)
+	}
+	for _, call := range utm.Calls {
+		if call[0] == "osascript" && call[1] == "export_vm.applescript" {
+			t.Fatalf("should not export: %#v", call)
+		}
+	}
+}
+
+func TestBuilderRun_Clone(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	base := utm.AddVM("base")
+	base.BundlePath = testSourceBundle(t, "base")
+	base.Notes = "base notes"
+
+	cfg := testBuilderConfig(t, "packer-test")
+	delete(cfg, "source_path")
+	cfg["clone_vm_name"] = "base"
+
+	if _, err := testBuild(t, utm, cfg); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	exported := filepath.Join(cfg["output_directory"].(string), "packer-test.utm", "config.plist")
+	if _, err := os.Stat(exported); err != nil {
+		t.Fatalf("should be exported: %s", err)
+	}
+	// The clone is deleted, the base VM is untouched
+	if vms := utm.VMs(); len(vms) != 1 || vms[0] != base || base.Notes != "base notes" {
+		t.Fatalf("bad VMs: %#v", vms)
+	}
+}
+
+func TestBuilderRun_CloneKeepRegistered(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	base := utm.AddVM("base")
+
+	cfg := testBuilderConfig(t, "packer-test")
+	delete(cfg, "source_path")
+	cfg["clone_vm_uuid"] = base.UUID
+	cfg["skip_export"] = true
+	cfg["keep_registered"] = true
+
+	if _, err := testBuild(t, utm, cfg); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	clone := utm.VM("packer-test")
+	if clone == nil {
+		t.Fatal("the clone should be kept registered")
+	}
+	if clone.UUID == base.UUID {
+		t.Fatal("the clone should have a new UUID")
+	}
+	for i, nic := range clone.NetworkInterfaces {
+		if nic.MacAddress == base.NetworkInterfaces[i].MacAddress {
+			t.Fatalf("the clone should have new MAC addresses: %s", nic.MacAddress)
+		}
+	}
+}
+
+func TestBuilderRun_CloneForceSourceNamedLikeClone(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	base := utm.AddVM("packer-test")
+
+	cfg := testBuilderConfig(t, "packer-test")
+	delete(cfg, "source_path")
+	cfg["clone_vm_uuid"] = base.UUID
+	cfg["packer_force"] = true
+
+	_, err := testBuild(t, utm, cfg)
+	if err == nil || !strings.Contains(err.Error(), "named like the clone") {
+		t.Fatalf("bad: %v", err)
+	}
+	// The VM to clone is neither deleted nor cloned
+	if vms := utm.VMs(); len(vms) != 1 || vms[0] != base {
+		t.Fatalf("bad VMs: %#v", vms)
+	}
+	for _, call := range utm.Calls {
+		if call[0] == "utmctl" && (call[1] == "delete" || call[1] == "clone") {
+			t.Fatalf("should not change the VM to clone: %#v", call)
+		}
+	}
+}
+
+// testTTY answers the questions of a BasicUi in order.
+type testTTY struct {
+	answers []string
+}
+
+func (t *testTTY) ReadString() (string, error) {
+	if len(t.answers) == 0 {
+		return "", io.EOF
+	}
+	answer := t.answers[0]
+	t.answers = t.answers[1:]
+	return answer + "\n", nil
+}
+
+func (t *testTTY) Close() error { return nil }
+
+func TestBuilderRun_SnapshotRollback(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	cfg := testBuilderConfig(t, "packer-test")
+	cfg["snapshot_before_provisioning"] = true
+	cfg["packer_on_error"] = "ask"
+	disk := filepath.Join(cfg["source_path"].(string), "Data", "disk.qcow2")
+
+	b := &Builder{executor: utm}
+	if _, _, err := b.Prepare(cfg); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The first provisioning run breaks the disk and fails,
+	// the retry must start from the snapshot
+	runs := 0
+	hook := &packersdk.MockHook{
+		RunFunc: func(context.Context) error {
+			runs++
+			data, err := os.ReadFile(disk)
+			if err != nil {
+				return err
+			}
+			if string(data) != "disk" {
+				return fmt.Errorf("disk not rolled back: %q", data)
+			}
+			if runs == 1 {
+				os.WriteFile(disk, []byte("broken"), 0644)
+				return errors.New("provisioner failed")
+			}
+			return nil
+		},
+	}
+	ui := &packersdk.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: new(bytes.Buffer),
+		TTY:    &testTTY{answers: []string{"r", "y"}},
+	}
+	if _, err := b.Run(context.Background(), ui, hook); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if runs != 2 {
+		t.Fatalf("provisioning should be retried once, ran %d times", runs)
+	}
+
+	// The snapshot is not exported
+	if snapshots := utm.Snapshots(disk); len(snapshots) != 0 {
+		t.Fatalf("snapshot should be removed: %#v", snapshots)
+	}
+	var ops []string
+	for _, call := range utm.Calls {
+		if call[0] == "qemu-img" {
+			ops = append(ops, strings.Join(call[:3], " "))
+		}
+		if call[0] == "osascript" && call[1] == "export_vm.applescript" {
+			ops = append(ops, "export")
+		}
+	}
+	expected := []string{
+		"qemu-img snapshot -c",
+		"qemu-img snapshot -a",
+		"qemu-img snapshot -d",
+		"export",
+	}
+	if strings.Join(ops, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("bad operations:\n%s", strings.Join(ops, "\n"))
+	}
+}
+
+// testNamedHook records the names of the hooks it runs.
+type testNamedHook struct {
+	Names []string
+	Err   error
+}
+
+func (h *testNamedHook) Run(ctx context.Context, name string, ui packersdk.Ui, comm packersdk.Communicator, data interface{}) error {
+	h.Names = append(h.Names, name)
+	if name == packersdk.HookProvision {
+		return h.Err
+	}
+	return nil
+}
+
+func TestBuilderRun_SnapshotCleanupProvisioner(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	cfg := testBuilderConfig(t, "packer-test")
+	cfg["snapshot_before_provisioning"] = true
+	cfg["packer_on_error"] = "run-cleanup-provisioner"
+
+	// The provisioners fail, the cleanup provisioner must run
+	hook := &testNamedHook{Err: errors.New("provisioner failed")}
+	if _, _, err := testBuildHook(t, utm, cfg, hook); err == nil {
+		t.Fatal("should error")
+	}
+	expected := []string{packersdk.HookProvision, packersdk.HookCleanupProvision}
+	if !reflect.DeepEqual(hook.Names, expected) {
+		t.Fatalf("bad hooks: %#v", hook.Names)
+	}
+}
+
+func TestBuilderRun_CheckpointResume(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	cfg := testBuilderConfig(t, "packer-test")
+	cfg["checkpoint"] = true
+	checkpointPath := filepath.Join(cfg["output_directory"].(string), utmcommon.CheckpointFilename)
+
+	// The provisioners fail, the VM and the checkpoint are kept
+	hook := &packersdk.MockHook{
+		RunFunc: func(context.Context) error { return errors.New("network is flaky") },
+	}
+	if _, _, err := testBuildHook(t, utm, cfg, hook); err == nil {
+		t.Fatal("should error")
+	}
+	vms := utm.VMs()
+	if len(vms) != 1 || vms[0].Name != "packer-test" {
+		t.Fatalf("the VM should be kept: %#v", vms)
+	}
+	if vms[0].Notes != "" {
+		t.Fatalf("the kept VM should not look like an orphan: %q", vms[0].Notes)
+	}
+	data, err := os.ReadFile(checkpointPath)
+	if err != nil || !strings.Contains(string(data), `"phase": "imported"`) {
+		t.Fatalf("bad checkpoint: %s %s", data, err)
+	}
+
+	// The next run resumes in the same VM
+	hook = &packersdk.MockHook{}
+	artifact, _, err := testBuildHook(t, utm, cfg, hook)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !hook.RunCalled {
+		t.Fatal("the provisioners should run")
+	}
+	imports := 0
+	for _, call := range utm.Calls {
+		if call[0] == "osascript" && call[1] == "import_vm.applescript" {
+			imports++
+		}
+	}
+	if imports != 1 {
+		t.Fatalf("the VM should be imported once, not %d times", imports)
+	}
+	if vms := utm.VMs(); len(vms) != 0 {
+		t.Fatalf("VMs should be deleted: %#v", vms)
+	}
+	for _, f := range artifact.Files() {
+		if f == checkpointPath {
+			t.Fatalf("the checkpoint should be removed: %#v", artifact.Files())
+		}
+	}
+}
+
+func TestBuilderRun_CheckpointProvisioned(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	cfg := testBuilderConfig(t, "packer-test")
+	cfg["checkpoint"] = true
+	vm := utm.AddVM("packer-old")
+	vm.BundlePath = cfg["source_path"].(string)
+	vm.Status = "started"
+
+	// An interrupted build ran the provisioners in packer-old
+	outputDir := cfg["output_directory"].(string)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	dir := &utmcommon.LocalOutputDir{}
+	dir.SetOutputDir(outputDir)
+	checkpoint := &utmcommon.Checkpoint{
+		Source: cfg["source_path"].(string),
+		VMName: "packer-old",
+		Phase:  utmcommon.CheckpointProvisioned,
+	}
+	if err := utmcommon.WriteCheckpoint(dir, checkpoint); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	hook := &packersdk.MockHook{}
+	if _, _, err := testBuildHook(t, utm, cfg, hook); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if hook.RunCalled {
+		t.Fatal("the provisioners should not run again")
+	}
+	// The bundle is named after the VM of the interrupted build
+	exported := filepath.Join(outputDir, "packer-old.utm", "config.plist")
+	if _, err := os.Stat(exported); err != nil {
+		t.Fatalf("should be exported: %s", err)
+	}
+	if vms := utm.VMs(); len(vms) != 0 {
+		t.Fatalf("VMs should be deleted: %#v", vms)
+	}
+
+	// A checkpoint of another source is not resumed
+	if err := utmcommon.WriteCheckpoint(dir, checkpoint); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cfg["source_path"] = testSourceBundle(t, "other")
+	if _, err := testBuild(t, utm, cfg); err == nil || !strings.Contains(err.Error(), "checkpoint of another build") {
+		t.Fatalf("should error: %v", err)
+	}
+
+	// Unless forced
+	utm.AddVM("packer-old")
+	cfg["packer_force"] = true
+	if _, err := testBuild(t, utm, cfg); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if vms := utm.VMs(); len(vms) != 0 {
+		t.Fatalf("VMs should be deleted: %#v", vms)
+	}
+}
+
+func TestBuilderRun_CheckpointCleanupProvisioner(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	cfg := testBuilderConfig(t, "packer-test")
+	cfg["checkpoint"] = true
+	cfg["packer_on_error"] = "run-cleanup-provisioner"
+	// The export fails, the bundle of the VM is gone
+	vm := utm.AddVM("packer-old")
+	vm.BundlePath = filepath.Join(t.TempDir(), "missing.utm")
+
+	// An interrupted build ran the provisioners in packer-old
+	outputDir := cfg["output_directory"].(string)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	dir := &utmcommon.LocalOutputDir{}
+	dir.SetOutputDir(outputDir)
+	checkpoint := &utmcommon.Checkpoint{
+		Source: cfg["source_path"].(string),
+		VMName: "packer-old",
+		Phase:  utmcommon.CheckpointProvisioned,
+	}
+	if err := utmcommon.WriteCheckpoint(dir, checkpoint); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The provisioners are skipped, the cleanup provisioner still runs
+	hook := &testNamedHook{}
+	if _, _, err := testBuildHook(t, utm, cfg, hook); err == nil {
+		t.Fatal("should error")
+	}
+	expected := []string{packersdk.HookCleanupProvision}
+	if !reflect.DeepEqual(hook.Names, expected) {
+		t.Fatalf("bad hooks: %#v", hook.Names)
+	}
+}
+
+func TestBuilderRun_UTMNotRunning(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	utm.Running = false
+
+	_, err := testBuild(t, utm, testBuilderConfig(t, "packer-test"))
+	if err == nil || !strings.Contains(err.Error(), "UTM is not running") {
+		t.Fatalf("bad: %v", err)
+	}
+	if len(utm.VMs()) != 0 {
+		t.Fatal("nothing should be imported")
+	}
+}
+
+func TestBuilderRun_AutomationDenied(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	utm.AutomationDenied = true
+
+	_, err := testBuild(t, utm, testBuilderConfig(t, "packer-test"))
+	if err == nil || !strings.Contains(err.Error(), "Automation") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestBuilderRun_DryRun(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	cfg := testBuilderConfig(t, "packer-test")
+	cfg["dry_run"] = true
+
+	artifact, out, err := testBuildOutput(t, utm, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if artifact != nil {
+		t.Fatalf("dry run should not produce an artifact: %#v", artifact)
+	}
+	if len(utm.Calls) != 0 {
+		t.Fatalf("UTM should not be touched: %#v", utm.Calls)
+	}
+	if _, err := os.Stat(cfg["output_directory"].(string)); !os.IsNotExist(err) {
+		t.Fatalf("output directory should not be created: %v", err)
+	}
+
+	source, _ := filepath.Abs(cfg["source_path"].(string))
+	exported, _ := filepath.Abs(filepath.Join(cfg["output_directory"].(string), "packer-test.utm"))
+	for _, expected := range []string{
+		"osascript import_vm.applescript " + source,
+		"osascript rename_vm.applescript",
+		"utmctl start packer-test",
+		"utmctl stop packer-test",
+		"osascript export_vm.applescript packer-test " + exported,
+		"utmctl delete packer-test",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("plan should contain %q:\n%s", expected, out)
+		}
+	}
+}
+
+func TestBuilderRun_DryRunClone(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	cfg := testBuilderConfig(t, "packer-test")
+	delete(cfg, "source_path")
+	cfg["clone_vm_name"] = "base"
+	cfg["dry_run"] = true
+
+	_, out, err := testBuildOutput(t, utm, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(utm.Calls) != 0 {
+		t.Fatalf("UTM should not be touched: %#v", utm.Calls)
+	}
+	for _, expected := range []string{
+		"Would clone the registered VM base",
+		"utmctl start packer-test",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("plan should contain %q:\n%s", expected, out)
+		}
+	}
+}
+
+func TestBuilderRun_RemoteHost(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	host, err := utmcommon.NewSimulatedUTMHost(utm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer host.Close()
+	remote, err := host.RemoteConfig(t.TempDir())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cfg := testBuilderConfig(t, "packer-test")
+	cfg["utm_host"] = remote.UtmHost
+	cfg["utm_host_port"] = remote.UtmHostPort
+	cfg["utm_host_user"] = remote.UtmHostUser
+	cfg["utm_host_private_key_file"] = remote.UtmHostPrivateKeyFile
+	cfg["utm_host_known_hosts_file"] = remote.UtmHostKnownHostsFile
+	cfg["provenance"] = true
+
+	// The builder has no local executor, everything goes through SSH
+	b := &Builder{}
+	if _, _, err := b.Prepare(cfg); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ui := &packersdk.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: new(bytes.Buffer),
+	}
+	artifact, err := b.Run(context.Background(), ui, &packersdk.MockHook{})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	exported := filepath.Join(cfg["output_directory"].(string), "packer-test.utm", "config.plist")
+	found := false
+	for _, f := range artifact.Files() {
+		found = found || f == exported
+	}
+	if !found {
+		t.Fatalf("exported bundle not in artifact files: %#v", artifact.Files())
+	}
+	// The post-processors can't read the files here
+	if host := artifact.State("utm_host"); host != remote.UtmHost {
+		t.Fatalf("bad utm_host: %#v", host)
+	}
+
+	// The provenance hashes the files on the UTM host
+	p := testReadProvenance(t, artifact)
+	if len(p.Subject) == 0 || len(p.Predicate.BuildDefinition.ResolvedDependencies) < 2 {
+		t.Fatalf("bad provenance: %#v", p)
+	}
+
+	if len(utm.Calls) == 0 {
+		t.Fatal("the build should run on the UTM host")
+	}
+	if vms := utm.VMs(); len(vms) != 0 {
+		t.Fatalf("VMs should be deleted: %#v", vms)
+	}
+}
+
+func TestBuilderPrepare_RemoteHostRelativePaths(t *testing.T) {
+	cfg := testBuilderConfig(t, "packer-test")
+	cfg["utm_host"] = "mac-mini"
+	cfg["utm_host_user"] = "packer"
+	cfg["utm_host_skip_host_key_check"] = true
+	cfg["source_path"] = "source.utm"
+	cfg["output_directory"] = "output"
+
+	var c Config
+	_, err := c.Prepare(cfg)
+	if err == nil || !strings.Contains(err.Error(), "source_path must be an absolute path") ||
+		!strings.Contains(err.Error(), "output_directory must be an absolute path") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestBuilderPrepare_RemoteHostSkipNatMapping(t *testing.T) {
+	cfg := testBuilderConfig(t, "packer-test")
+	cfg["utm_host"] = "mac-mini"
+	cfg["utm_host_user"] = "packer"
+	cfg["utm_host_skip_host_key_check"] = true
+	cfg["communicator"] = "ssh"
+	cfg["ssh_username"] = "packer"
+	cfg["skip_nat_mapping"] = true
+
+	var c Config
+	_, err := c.Prepare(cfg)
+	if err == nil || !strings.Contains(err.Error(), "skip_nat_mapping can't be used with utm_host") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+// testSignedManifest writes the manifest of the bundle of testSourceBundle
+// as the utm-zip post-processor does, signs it with a new key, and returns
+// the paths of the manifest and of the public key.
+func testSignedManifest(t *testing.T, bundle string) (string, string) {
+	var files []map[string]interface{}
+	for _, name := range []string{"Data/disk.qcow2", "config.plist"} {
+		content, err := os.ReadFile(filepath.Join(bundle, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		sum := sha256.Sum256(content)
+		files = append(files, map[string]interface{}{
+			"name":    filepath.Base(bundle) + "/" + name,
+			"size":    len(content),
+			"digests": map[string]string{"sha256": hex.EncodeToString(sum[:])},
+		})
+	}
+	content, err := json.Marshal(map[string]interface{}{"files": files})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "source.zip.manifest.json")
+	if err := os.WriteFile(manifest, content, 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	private, public := filepath.Join(dir, "key"), filepath.Join(dir, "key.pub")
+	if err := os.WriteFile(private, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	signer, err := signature.LoadSigner(private, "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.WriteFile(public, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := signer.SignFile(manifest); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return manifest, public
+}
+
+func TestBuilderRun_SourceManifest(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	cfg := testBuilderConfig(t, "packer-test")
+	cfg["source_manifest"], cfg["source_public_key_file"] = testSignedManifest(t, cfg["source_path"].(string))
+
+	_, out, err := testBuildOutput(t, utm, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(out, "Verifying the source bundle") {
+		t.Fatalf("the source should be verified:\n%s", out)
+	}
+}
+
+func TestBuilderRun_SourceManifestMismatch(t *testing.T) {
+	cases := map[string]func(bundle string, manifest string) error{
+		"bundle": func(bundle string, manifest string) error {
+			return os.WriteFile(filepath.Join(bundle, "Data", "disk.qcow2"), []byte("tampered"), 0644)
+		},
+		"manifest": func(bundle string, manifest string) error {
+			return os.WriteFile(manifest, []byte(`{"files": []}`), 0644)
+		},
+	}
+	for name, tamper := range cases {
+		t.Run(name, func(t *testing.T) {
+			utm := utmcommon.NewSimulatedUTM("4.6.4")
+			cfg := testBuilderConfig(t, "packer-test")
+			manifest, public := testSignedManifest(t, cfg["source_path"].(string))
+			cfg["source_manifest"], cfg["source_public_key_file"] = manifest, public
+			if err := tamper(cfg["source_path"].(string), manifest); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			_, err := testBuild(t, utm, cfg)
+			if err == nil || !strings.Contains(err.Error(), "Error verifying source") {
+				t.Fatalf("bad: %v", err)
+			}
+			if len(utm.VMs()) != 0 {
+				t.Fatal("nothing should be imported")
+			}
+		})
+	}
+}
+
+// testReadProvenance reads the provenance of the artifact.
+func testReadProvenance(t *testing.T, artifact packersdk.Artifact) *utmcommon.Provenance {
+	path, ok := artifact.State("provenance").(string)
+	if !ok {
+		t.Fatalf("bad provenance state: %#v", artifact.State("provenance"))
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var p utmcommon.Provenance
+	if err := json.Unmarshal(content, &p); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return &p
+}
+
+func TestBuilderRun_Provenance(t *testing.T) {
+	utm := utmcommon.NewSimulatedUTM("4.6.4")
+	cfg := testBuilderConfig(t, "packer-test")
+	sum := sha256.Sum256([]byte("disk"))
+	diskDigest := hex.EncodeToString(sum[:])
+	cfg["checksum"] = "sha256:" + diskDigest
+	cfg["provenance"] = true
+	cfg["provenance_provisioners"] = []string{"shell", "ansible"}
+
+	artifact, err := testBuild(t, utm, cfg)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	provenance := filepath.Join(cfg["output_directory"].(string), utmcommon.ProvenanceFilename)
+	if artifact.State("provenance") != provenance {
+		t.Fatalf("bad provenance state: %#v", artifact.State("provenance"))
+	}
+	found := false
+	for _, f := range artifact.Files() {
+		found = found || f == provenance
+	}
+	if !found {
+		t.Fatalf("provenance not in artifact files: %#v", artifact.Files())
+	}
+
+	p := testReadProvenance(t, artifact)
+	subjects := map[string]string{}
+	for _, subject := range p.Subject {
+		subjects[subject.Name] = subject.Digest["sha256"]
+	}
+	if subjects["packer-test.utm/Data/disk.qcow2"] != diskDigest {
+		t.Fatalf("bad subjects: %#v", subjects)
+	}
+	if _, ok := subjects[utmcommon.ProvenanceFilename]; ok {
+		t.Fatal("the provenance should not be a subject")
+	}
+
+	definition := p.Predicate.BuildDefinition
+	source := definition.ResolvedDependencies[0]
+	if source.URI != cfg["source_path"] || source.Digest["sha256"] != diskDigest {
+		t.Fatalf("bad source: %#v", source)
+	}
+	if file := definition.ResolvedDependencies[1]; file.Name != "packer-test.utm/Data/disk.qcow2" ||
+		file.Digest["sha256"] != diskDigest {
+		t.Fatalf("bad source file: %#v", file)
+	}
+	if provisioners := definition.ExternalParameters["declared_provisioners"]; fmt.Sprint(provisioners) != "[shell ansible]" {
+		t.Fatalf("bad provisioners: %#v", provisioners)
+	}
+
+	run := p.Predicate.RunDetails
+	if run.Builder.Version["utm"] != "4.6.4" || run.Builder.Version["packer-plugin-utm"] == "" {
+		t.Fatalf("bad versions: %#v", run.Builder.Version)
+	}
+	if run.Metadata.StartedOn.IsZero() || run.Metadata.FinishedOn.Before(run.Metadata.StartedOn) {
+		t.Fatalf("bad times: %#v", run.Metadata)
+	}
+	if len(run.Byproducts) != 1 || len(run.Byproducts[0].Annotations["runs"].([]interface{})) != 1 {
+		t.Fatalf("the provisioners should have run once: %#v", run.Byproducts)
+	}
+}
@@ -5,12 +5,16 @@ package utm
 
 import (
 	"fmt"
+	"path/filepath"
+	"time"
 
 	"github.com/hashicorp/packer-plugin-sdk/common"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
 	"github.com/hashicorp/packer-plugin-sdk/template/config"
 	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
 	utmcommon "github.com/naveenrajm7/packer-plugin-utm/builder/utm/common"
+	"github.com/naveenrajm7/packer-plugin-utm/signature"
+	"golang.org/x/crypto/ssh"
 )
 
 // Config is the configuration structure for the builder.
@@ -24,6 +28,8 @@ type Config struct {
 	utmcommon.CommConfig       `mapstructure:",squash"`
 	utmcommon.ShutdownConfig   `mapstructure:",squash"`
 	utmcommon.UtmVersionConfig `mapstructure:",squash"`
+	utmcommon.DriverConfig     `mapstructure:",squash"`
+	utmcommon.RemoteConfig     `mapstructure:",squash"`
 	// The checksum for the source_path file. The type of the checksum is
 	// specified within the checksum field as a prefix, ex: "md5:{$checksum}".
 	// The type of the checksum can also be omitted and Packer will try to
@@ -52,20 +58,107 @@ type Config struct {
 	// after download. By default, it will go in the packer cache, with a hash of
 	// the original filename as its name.
 	TargetPath string `mapstructure:"target_path" required:"false"`
+	// The path to the manifest the utm-zip post-processor wrote, with
+	// `manifest` enabled, when it archived the source bundle. Packer checks
+	// that the files of the bundle are the ones of the manifest, with the
+	// same sizes and digests, and that it holds no symlink, before
+	// importing it.
+	SourceManifest string `mapstructure:"source_manifest" required:"false"`
+	// The path to the public key, in authorized_keys or PEM format, of
+	// the key the utm-zip post-processor signed the archive with
+	// (`signing_key_file`). Packer checks the signature of source_manifest,
+	// in the `.sig` file next to it, before trusting the manifest.
+	// Requires source_manifest.
+	SourcePublicKeyFile string `mapstructure:"source_public_key_file" required:"false"`
 	// This is the name of the UTM file for the new virtual machine, without
 	// the file extension. Make sure VMName in UTM after import is same
 	// as the UTM file name, By default this is packer-BUILDNAME,
-	// where "BUILDNAME" is the name of the build.
+	// where "BUILDNAME" is the name of the build. If a VM with this name is
+	// already registered with UTM, the build fails, unless it is run with
+	// -force, which stops and deletes that VM first.
 	VMName string `mapstructure:"vm_name" required:"false"`
+	// The name of a VM registered with UTM to build in, instead of
+	// importing source_path. The VM must be stopped. Packer still sets up
+	// port forwarding, starts the VM, runs the provisioners and shuts it
+	// down, but never deletes it. Use skip_export to leave it at that.
+	// Useful to iterate on provisioning scripts.
+	AttachVMName string `mapstructure:"attach_vm_name" required:"false"`
+	// Like attach_vm_name, but finds the VM by its UUID.
+	AttachVMUUID string `mapstructure:"attach_vm_uuid" required:"false"`
+	// The name of a VM registered with UTM to clone, instead of importing
+	// source_path. The clone, named vm_name, gets new MAC addresses and is
+	// built, exported and deleted like an imported VM, so the source VM
+	// stays as is. The source VM must be stopped. Cloning is much faster
+	// than importing large bundles.
+	CloneVMName string `mapstructure:"clone_vm_name" required:"false"`
+	// Like clone_vm_name, but finds the VM to clone by its UUID.
+	CloneVMUUID string `mapstructure:"clone_vm_uuid" required:"false"`
 	// Set this to true if you would like to keep
 	// the VM registered with UTM. Defaults to false.
 	KeepRegistered bool `mapstructure:"keep_registered" required:"false"`
+	// Defaults to false. When enabled, Packer stops and deletes the VMs
+	// left behind by the builds which were killed before they could clean
+	// up, prior to importing the VM. Every build tags the VM it imports
+	// in the VM notes with the machine and the process running Packer, and
+	// removes the tag once the build succeeds. Only the VMs tagged by a
+	// process of this machine, boot and PID namespace (container) which
+	// is gone are deleted. It can't be used with attach_vm_name or
+	// attach_vm_uuid.
+	CleanupOrphans bool `mapstructure:"cleanup_orphans" required:"false"`
+	// The minimum age of a tagged VM for cleanup_orphans to delete it,
+	// as a safety net. Defaults to 1h or one hour.
+	OrphanMinAge time.Duration `mapstructure:"orphan_min_age" required:"false"`
 	// Defaults to false. When enabled, Packer will
 	// not export the VM. Useful if the build output is not the resultant image,
 	// but created inside the VM.
 	SkipExport bool `mapstructure:"skip_export" required:"false"`
+	// Defaults to false. When enabled, Packer starts the VM in disposable
+	// mode, so the changes made by the provisioners are not written to its
+	// disks, and does not export it. No image is produced, which is useful
+	// to validate an image with test provisioners.
+	Disposable bool `mapstructure:"disposable" required:"false"`
+	// Defaults to false. When enabled, Packer takes an internal snapshot of
+	// every qcow2 disk of the VM with qemu-img before its first boot. When a
+	// provisioner fails and retry is picked with `-on-error=ask`, Packer
+	// offers to roll the disks back to the snapshot before retrying. The
+	// snapshot is removed before the VM is exported.
+	SnapshotBeforeProvisioning bool `mapstructure:"snapshot_before_provisioning" required:"false"`
+	// The path of qemu-img on the UTM host, used by
+	// snapshot_before_provisioning. Defaults to `qemu-img`.
+	QemuImgPath string `mapstructure:"qemu_img_path" required:"false"`
+	// Defaults to false. When enabled, Packer records the progress of the
+	// build in a checkpoint file in the output directory once the VM is
+	// imported and once the provisioners ran. A failed or interrupted build
+	// keeps its VM and output directory, and the next run of the same build
+	// from the same source resumes in that VM after the last recorded phase.
+	// There is no phase between two provisioners, a build resumed after the
+	// import runs all of them again. Use `-force` to discard the checkpoint
+	// and start over.
+	Checkpoint bool `mapstructure:"checkpoint" required:"false"`
+	// Defaults to false. When enabled, Packer inspects the source bundle,
+	// prints the UTM operations (utmctl commands and AppleScripts with
+	// their arguments) the build would run, and exits without touching UTM.
+	// No artifact is produced.
+	DryRun bool `mapstructure:"dry_run" required:"false"`
+	// Defaults to false. When enabled, Packer writes the provenance of the
+	// build to `packer-provenance.json` in the output directory: an in-toto
+	// statement with a SLSA provenance recording the source bundle and its
+	// checksum, the versions of the plugin, of UTM and of Packer, when the
+	// build and its provisioners ran, and the sha256 digest of every file
+	// of the output directory. Its path is in the `provenance` state of the
+	// artifact.
+	Provenance bool `mapstructure:"provenance" required:"false"`
+	// The provisioners to record in the provenance, in the order they run,
+	// such as `["shell", "ansible"]`. Packer does not tell builders which
+	// provisioners a build runs, only when they run, so they must be
+	// listed here to be recorded. They are recorded as
+	// `declared_provisioners`, user input which is not checked against the
+	// provisioners which ran.
+	ProvenanceProvisioners []string `mapstructure:"provenance_provisioners" required:"false"`
 
 	ctx interpolate.Context
+	// The key of source_public_key_file
+	sourcePublicKey ssh.PublicKey
 }
 
 func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
@@ -89,6 +182,14 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 			"packer-%s-%d", c.PackerBuildName, interpolate.InitTime.Unix())
 	}
 
+	if c.OrphanMinAge == 0 {
+		c.OrphanMinAge = time.Hour
+	}
+
+	if c.QemuImgPath == "" {
+		c.QemuImgPath = "qemu-img"
+	}
+
 	// Prepare the errors
 	var errs *packersdk.MultiError
 	errs = packersdk.MultiErrorAppend(errs, c.ExportConfig.Prepare(&c.ctx)...)
@@ -98,11 +199,94 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 	errs = packersdk.MultiErrorAppend(errs, c.ShutdownConfig.Prepare(&c.ctx)...)
 	errs = packersdk.MultiErrorAppend(errs, c.CommConfig.Prepare(&c.ctx)...)
 	errs = packersdk.MultiErrorAppend(errs, c.UtmVersionConfig.Prepare(c.CommConfig.Comm.Type)...)
+	errs = packersdk.MultiErrorAppend(errs, c.DriverConfig.Prepare(&c.ctx)...)
+	errs = packersdk.MultiErrorAppend(errs, c.RemoteConfig.Prepare(&c.ctx)...)
 
-	if c.SourcePath == "" {
+	sources := 0
+	for _, source := range []string{c.AttachVMName, c.AttachVMUUID, c.CloneVMName, c.CloneVMUUID} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		errs = packersdk.MultiErrorAppend(errs,
+			fmt.Errorf("only one of attach_vm_name, attach_vm_uuid, clone_vm_name and clone_vm_uuid can be set"))
+	}
+	// With -force the clone would replace the VM it is cloned from
+	if c.CloneVMName != "" && c.CloneVMName == c.VMName {
+		errs = packersdk.MultiErrorAppend(errs,
+			fmt.Errorf("vm_name must differ from clone_vm_name, the cloned VM is not changed"))
+	}
+	if c.SourcePath == "" && !c.Attaching() && !c.Cloning() {
 		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("source_path is required"))
 	}
 
+	if c.SnapshotBeforeProvisioning && c.Disposable {
+		errs = packersdk.MultiErrorAppend(errs,
+			fmt.Errorf("snapshot_before_provisioning can't be used with disposable, the disks are not changed"))
+	}
+
+	if c.Checkpoint && (c.Attaching() || c.Disposable || c.SnapshotBeforeProvisioning) {
+		errs = packersdk.MultiErrorAppend(errs,
+			fmt.Errorf("checkpoint can't be used with attach_vm_name, attach_vm_uuid, disposable "+
+				"or snapshot_before_provisioning"))
+	}
+
+	if c.Provenance && (c.Disposable || c.SkipExport) {
+		errs = packersdk.MultiErrorAppend(errs,
+			fmt.Errorf("provenance can't be used with disposable or skip_export, no image is produced"))
+	}
+
+	if len(c.ProvenanceProvisioners) > 0 && !c.Provenance {
+		errs = packersdk.MultiErrorAppend(errs,
+			fmt.Errorf("provenance_provisioners requires provenance"))
+	}
+
+	if c.CleanupOrphans && c.Attaching() {
+		errs = packersdk.MultiErrorAppend(errs,
+			fmt.Errorf("cleanup_orphans can't be used with attach_vm_name or attach_vm_uuid, "+
+				"no VM is imported"))
+	}
+
+	if c.OrphanMinAge < 0 {
+		errs = packersdk.MultiErrorAppend(errs, fmt.Errorf("orphan_min_age must not be negative"))
+	}
+
+	if c.SourceManifest != "" && (c.Attaching() || c.Cloning() || c.UtmHost != "") {
+		errs = packersdk.MultiErrorAppend(errs,
+			fmt.Errorf("source_manifest can't be used with attach_vm_name, attach_vm_uuid, "+
+				"clone_vm_name, clone_vm_uuid or utm_host"))
+	}
+	if c.SourcePublicKeyFile != "" {
+		if c.SourceManifest == "" {
+			errs = packersdk.MultiErrorAppend(errs,
+				fmt.Errorf("source_public_key_file requires source_manifest"))
+		} else if key, err := signature.LoadPublicKey(c.SourcePublicKeyFile); err != nil {
+			errs = packersdk.MultiErrorAppend(errs,
+				fmt.Errorf("source_public_key_file could not be read: %s", err))
+		} else {
+			c.sourcePublicKey = key
+		}
+	}
+
+	// Relative paths would be resolved on this machine, not the UTM host
+	if c.UtmHost != "" {
+		if c.SourcePath != "" && !c.Attaching() && !c.Cloning() && !filepath.IsAbs(c.SourcePath) {
+			errs = packersdk.MultiErrorAppend(errs,
+				fmt.Errorf("source_path must be an absolute path on the UTM host when utm_host is set"))
+		}
+		if !filepath.IsAbs(c.OutputDir) {
+			errs = packersdk.MultiErrorAppend(errs,
+				fmt.Errorf("output_directory must be an absolute path on the UTM host when utm_host is set"))
+		}
+	}
+	// The tunnel through utm_host reaches forwarded ports, not the guest
+	if c.UtmHost != "" && c.SkipNatMapping {
+		errs = packersdk.MultiErrorAppend(errs,
+			fmt.Errorf("skip_nat_mapping can't be used with utm_host, the communicator "+
+				"reaches the guest through a port forwarded on the UTM host"))
+	}
+
 	// Warnings
 	var warnings []string
 	if c.ShutdownCommand == "" {
@@ -111,6 +295,17 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 				"will forcibly halt the virtual machine, which may result in data loss.")
 	}
 
+	if (c.Attaching() || c.Cloning()) && c.SourcePath != "" {
+		warnings = append(warnings,
+			"source_path is ignored when attaching to or cloning a registered VM.")
+	}
+
+	if c.Checkpoint {
+		warnings = append(warnings,
+			"checkpoint does not record a phase between two provisioners. A build\n"+
+				"failing in a provisioner runs all of them again when resumed.")
+	}
+
 	// Check for any errors.
 	if errs != nil && len(errs.Errors) > 0 {
 		return warnings, errs
@@ -118,3 +313,27 @@ func (c *Config) Prepare(raws ...interface{}) ([]string, error) {
 
 	return warnings, nil
 }
+
+// Attaching tells whether the build uses a VM registered with UTM
+// instead of importing one.
+func (c *Config) Attaching() bool {
+	return c.AttachVMName != "" || c.AttachVMUUID != ""
+}
+
+// checkpointSource describes what the build starts from, which
+// a resumed build must match.
+func (c *Config) checkpointSource() string {
+	switch {
+	case c.CloneVMUUID != "":
+		return "clone of VM " + c.CloneVMUUID
+	case c.CloneVMName != "":
+		return "clone of VM " + c.CloneVMName
+	}
+	return c.SourcePath
+}
+
+// Cloning tells whether the build clones a VM registered with UTM
+// instead of importing one.
+func (c *Config) Cloning() bool {
+	return c.CloneVMName != "" || c.CloneVMUUID != ""
+}
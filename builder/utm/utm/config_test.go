@@ -6,6 +6,7 @@ package utm
 import (
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -85,3 +86,162 @@ func TestNewConfig_shutdown_timeout(t *testing.T) {
 		t.Fatalf("bad: %s", err)
 	}
 }
+
+func TestNewConfig_attach(t *testing.T) {
+	// No source_path needed
+	cfg := testConfig(t)
+	delete(cfg, "source_path")
+	cfg["attach_vm_name"] = "foo"
+	var c Config
+	warns, err := c.Prepare(cfg)
+	if len(warns) > 0 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// source_path is ignored
+	cfg = testConfig(t)
+	cfg["attach_vm_uuid"] = "foo"
+	c = Config{}
+	warns, err = c.Prepare(cfg)
+	if len(warns) != 1 {
+		t.Fatalf("bad: %#v", warns)
+	}
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// Only one way to find the VM
+	cfg = testConfig(t)
+	cfg["attach_vm_name"] = "foo"
+	cfg["attach_vm_uuid"] = "foo"
+	c = Config{}
+	if _, err := c.Prepare(cfg); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestNewConfig_snapshotBeforeProvisioning(t *testing.T) {
+	cfg := testConfig(t)
+	cfg["snapshot_before_provisioning"] = true
+	var c Config
+	if _, err := c.Prepare(cfg); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if c.QemuImgPath != "qemu-img" {
+		t.Fatalf("bad qemu_img_path: %s", c.QemuImgPath)
+	}
+
+	// The disks of a disposable VM are not changed
+	cfg["disposable"] = true
+	c = Config{}
+	if _, err := c.Prepare(cfg); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestNewConfig_checkpoint(t *testing.T) {
+	cfg := testConfig(t)
+	cfg["checkpoint"] = true
+	var c Config
+	warns, err := c.Prepare(cfg)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	// Provisioners are not resumed one by one
+	if len(warns) != 1 {
+		t.Fatalf("bad: %#v", warns)
+	}
+
+	// An attached VM is not the build's to keep
+	delete(cfg, "source_path")
+	cfg["attach_vm_name"] = "foo"
+	c = Config{}
+	if _, err := c.Prepare(cfg); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestNewConfig_cleanupOrphans(t *testing.T) {
+	cfg := testConfig(t)
+	cfg["cleanup_orphans"] = true
+	var c Config
+	if _, err := c.Prepare(cfg); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// Attaching does not import a VM, so there is no sweep before it
+	delete(cfg, "source_path")
+	cfg["attach_vm_uuid"] = "foo"
+	c = Config{}
+	if _, err := c.Prepare(cfg); err == nil || !strings.Contains(err.Error(), "cleanup_orphans") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestNewConfig_sourceManifest(t *testing.T) {
+	cfg := testConfig(t)
+	cfg["source_public_key_file"] = "config_test.go"
+	var c Config
+	if _, err := c.Prepare(cfg); err == nil || !strings.Contains(err.Error(), "requires source_manifest") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	cfg["source_manifest"] = "manifest.json"
+	c = Config{}
+	if _, err := c.Prepare(cfg); err == nil || !strings.Contains(err.Error(), "source_public_key_file could not be read") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// A cloned VM is not imported from source_path
+	delete(cfg, "source_public_key_file")
+	cfg["clone_vm_name"] = "foo"
+	c = Config{}
+	if _, err := c.Prepare(cfg); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestNewConfig_cloneVMName(t *testing.T) {
+	cfg := testConfig(t)
+	delete(cfg, "source_path")
+	cfg["clone_vm_name"] = "base"
+	var c Config
+	if _, err := c.Prepare(cfg); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// The clone would replace the VM it is cloned from
+	cfg["vm_name"] = "base"
+	c = Config{}
+	if _, err := c.Prepare(cfg); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestNewConfig_provenance(t *testing.T) {
+	cfg := testConfig(t)
+	cfg["provenance"] = true
+	var c Config
+	if _, err := c.Prepare(cfg); err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+
+	// Nothing is exported to describe
+	cfg["skip_export"] = true
+	c = Config{}
+	if _, err := c.Prepare(cfg); err == nil {
+		t.Fatal("should error")
+	}
+
+	// Only recorded in the provenance
+	delete(cfg, "skip_export")
+	cfg["provenance"] = false
+	cfg["provenance_provisioners"] = []string{"shell"}
+	c = Config{}
+	if _, err := c.Prepare(cfg); err == nil {
+		t.Fatal("should error")
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package utm
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/sdk-internals/communicator/none"
+	utmcommon "github.com/naveenrajm7/packer-plugin-utm/builder/utm/common"
+)
+
+// dryRun walks the steps that talk to UTM with a driver that only
+// records the commands, and prints them. Steps that need a guest
+// are described instead of run.
+func (b *Builder) dryRun(ctx context.Context, ui packersdk.Ui) error {
+	ui.Say("Dry run: UTM will not be touched, nothing will be built.")
+
+	// The dry run does not connect to a remote UTM host
+	var fileExists func(string) (bool, error)
+	if b.config.Attaching() || b.config.Cloning() {
+		ui.Say("Using a registered VM, there is no source bundle to inspect.")
+	} else if b.config.UtmHost != "" {
+		ui.Say(fmt.Sprintf("Source bundle on UTM host %s: %s (not inspected)",
+			b.config.UtmHost, b.config.SourcePath))
+		fileExists = func(string) (bool, error) { return true, nil }
+	} else {
+		info, err := utmcommon.ReadBundleInfo(b.config.SourcePath)
+		if err != nil {
+			return fmt.Errorf("Error inspecting source bundle: %s", err)
+		}
+		ui.Say(fmt.Sprintf("Source bundle: %s", info.Path))
+		ui.Message(fmt.Sprintf("Name in bundle: %s", info.Name))
+		ui.Message(fmt.Sprintf("UUID in bundle: %s", info.UUID))
+		ui.Message(fmt.Sprintf("Backend: %s, architecture: %s, CPUs: %d, memory: %d MiB",
+			info.Backend, info.Architecture, info.CPUCount, info.MemorySize))
+		ui.Message(fmt.Sprintf("Network interfaces: %s", strings.Join(info.NetworkModes, ", ")))
+	}
+	if !b.config.Attaching() {
+		ui.Say(fmt.Sprintf("VM name: %s", b.config.VMName))
+	}
+
+	comm, err := none.New("none")
+	if err != nil {
+		return err
+	}
+	executor := &utmcommon.RecordingExecutor{}
+
+	state := new(multistep.BasicStateBag)
+	state.Put("config", &b.config)
+	state.Put("communicator", comm)
+	state.Put("driver", utmcommon.NewDryRunDriver(executor))
+	state.Put("ui", ui)
+
+	// The VM settings are not changed by this builder,
+	// so there are no hardware changes to plan.
+	var shutdown multistep.Step = &utmcommon.StepShutdown{
+		Timeout:         b.config.ShutdownTimeout,
+		DisableShutdown: b.config.DisableShutdown,
+	}
+	if b.config.ShutdownCommand != "" && !b.config.DisableShutdown {
+		shutdown = &stepNote{
+			Message: fmt.Sprintf("Would halt the guest with: %s", b.config.ShutdownCommand),
+		}
+	}
+
+	steps := b.vmSteps(fileExists, nil)
+	if b.config.Cloning() {
+		// Finding the VM to clone needs UTM, the plan starts at the clone
+		source := b.config.CloneVMName
+		if source == "" {
+			source = b.config.CloneVMUUID
+		}
+		state.Put("vmName", b.config.VMName)
+		steps = append(steps[:len(steps)-1], &stepNote{
+			Message: fmt.Sprintf("Would clone the registered VM %s (it must be stopped) into %s, "+
+				"with new MAC addresses", source, b.config.VMName),
+		})
+	} else if b.config.Attaching() {
+		// Finding the VM needs UTM, use what identifies it instead
+		vmName := b.config.AttachVMName
+		if vmName == "" {
+			vmName = b.config.AttachVMUUID
+		}
+		state.Put("vmName", vmName)
+		steps = []multistep.Step{
+			&stepNote{
+				Message: fmt.Sprintf("Would attach to the registered VM %s (it must be stopped)", vmName),
+			},
+		}
+	}
+	if b.config.SnapshotBeforeProvisioning {
+		// Finding the disks needs the VM UUID, which UTM assigns
+		steps = append(steps, &stepNote{
+			Message: fmt.Sprintf("Would snapshot the qcow2 disks of the VM with %s snapshot -c", b.config.QemuImgPath),
+		})
+	}
+	steps = append(steps,
+		&utmcommon.StepPortForwarding{
+			CommConfig:     &b.config.CommConfig.Comm,
+			HostPortMin:    b.config.HostPortMin,
+			HostPortMax:    b.config.HostPortMax,
+			SkipNatMapping: b.config.SkipNatMapping,
+			ClearOnCleanup: b.config.Attaching(),
+		},
+		&utmcommon.StepRun{
+			Disposable: b.config.Disposable,
+		},
+		&stepNote{
+			Message: fmt.Sprintf("Would connect to the guest (communicator %q) and run the provisioners",
+				b.config.CommConfig.Comm.Type),
+		},
+		shutdown,
+	)
+	if b.config.SnapshotBeforeProvisioning {
+		steps = append(steps, &stepNote{
+			Message: fmt.Sprintf("Would remove the snapshot of the disks with %s snapshot -d", b.config.QemuImgPath),
+		})
+	}
+	if !b.config.Attaching() {
+		steps = append(steps, new(utmcommon.StepRemoveBuildTag))
+	}
+	steps = append(steps,
+		&utmcommon.StepExport{
+			Format:         b.config.Format,
+			OutputDir:      b.config.OutputDir,
+			OutputFilename: b.config.OutputFilename,
+			SkipNatMapping: b.config.SkipNatMapping,
+			SkipExport:     b.config.SkipExport || b.config.Disposable,
+		},
+	)
+
+	runner := &multistep.BasicRunner{Steps: steps}
+	runner.Run(ctx, state)
+
+	if rawErr, ok := state.GetOk("error"); ok {
+		return rawErr.(error)
+	}
+
+	ui.Say("Planned UTM operations:")
+	for _, command := range executor.Commands {
+		ui.Message(formatCommand(command))
+	}
+
+	return nil
+}
+
+// formatCommand joins a command line, quoting the arguments
+// that would not survive being pasted into a shell.
+func formatCommand(command []string) string {
+	args := make([]string, len(command))
+	for i, arg := range command {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\$") {
+			arg = strconv.Quote(arg)
+		}
+		args[i] = arg
+	}
+	return strings.Join(args, " ")
+}
+
+// stepNote tells what a step that can't be dry run would do,
+// or why a step is skipped.
+type stepNote struct {
+	Message string
+}
+
+func (s *stepNote) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	ui.Say(s.Message)
+	return multistep.ActionContinue
+}
+
+func (s *stepNote) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,87 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package utm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	utmcommon "github.com/naveenrajm7/packer-plugin-utm/builder/utm/common"
+)
+
+// This step finds a VM already registered with UTM to build in,
+// by name or by UUID. The VM is never deleted.
+//
+// Uses:
+//
+//	driver Driver
+//	ui packersdk.Ui
+//
+// Produces:
+//
+//	vmName string
+type StepAttach struct {
+	Name string
+	UUID string
+}
+
+func (s *StepAttach) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(utmcommon.Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+
+	vm, err := findVM(ctx, driver, s.Name, s.UUID)
+	if err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	// The configuration of a running VM can't be changed
+	if vm.Status != "stopped" {
+		err := fmt.Errorf("VM %s (%s) is %s, shut it down first", vm.Name, vm.UUID, vm.Status)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	ui.Say(fmt.Sprintf("Attaching to registered VM %s (%s)", vm.Name, vm.UUID))
+	state.Put("vmName", vm.Name)
+	return multistep.ActionContinue
+}
+
+// findVM returns the VM with the given UUID, or else name. The other
+// steps find the VM by name, so its name must be unique even when
+// looking for a UUID.
+func findVM(ctx context.Context, driver utmcommon.Driver, name string, uuid string) (*utmcommon.VMInfo, error) {
+	vms, err := driver.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing VMs: %s", err)
+	}
+
+	var found *utmcommon.VMInfo
+	for i, vm := range vms {
+		if (uuid != "" && vm.UUID == uuid) || (uuid == "" && vm.Name == name) {
+			found = &vms[i]
+			break
+		}
+	}
+	if found == nil {
+		if uuid != "" {
+			return nil, fmt.Errorf("No VM with UUID %s is registered with UTM", uuid)
+		}
+		return nil, fmt.Errorf("No VM named %q is registered with UTM", name)
+	}
+
+	for _, vm := range vms {
+		if vm.Name == found.Name && vm.UUID != found.UUID {
+			return nil, fmt.Errorf("Several VMs are named %q (%s and %s), rename the one to use",
+				found.Name, found.UUID, vm.UUID)
+		}
+	}
+	return found, nil
+}
+
+func (s *StepAttach) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,59 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package utm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	utmcommon "github.com/naveenrajm7/packer-plugin-utm/builder/utm/common"
+)
+
+func TestStepAttach_impl(t *testing.T) {
+	var _ multistep.Step = new(StepAttach)
+}
+
+func TestStepAttach(t *testing.T) {
+	vms := []utmcommon.VMInfo{
+		{UUID: "UUID-1", Status: "stopped", Name: "foo"},
+		{UUID: "UUID-2", Status: "started", Name: "bar"},
+		{UUID: "UUID-3", Status: "stopped", Name: "dup"},
+		{UUID: "UUID-4", Status: "stopped", Name: "dup"},
+	}
+
+	cases := []struct {
+		step  StepAttach
+		name  string
+		error string
+	}{
+		{step: StepAttach{Name: "foo"}, name: "foo"},
+		{step: StepAttach{UUID: "UUID-1"}, name: "foo"},
+		{step: StepAttach{Name: "missing"}, error: `No VM named "missing"`},
+		{step: StepAttach{UUID: "UUID-9"}, error: "No VM with UUID UUID-9"},
+		{step: StepAttach{Name: "bar"}, error: "is started, shut it down first"},
+		{step: StepAttach{UUID: "UUID-4"}, error: `Several VMs are named "dup"`},
+	}
+	for _, tc := range cases {
+		state := testState(t)
+		driver := state.Get("driver").(*utmcommon.DriverMock)
+		driver.ListResult = vms
+
+		action := tc.step.Run(context.Background(), state)
+		if tc.error != "" {
+			err, ok := state.GetOk("error")
+			if action != multistep.ActionHalt || !ok || !strings.Contains(err.(error).Error(), tc.error) {
+				t.Fatalf("%#v: should fail with %q: %v", tc.step, tc.error, err)
+			}
+			continue
+		}
+		if action != multistep.ActionContinue {
+			t.Fatalf("%#v: bad action: %#v", tc.step, action)
+		}
+		if name := state.Get("vmName"); name != tc.name {
+			t.Fatalf("%#v: bad: %#v", tc.step, name)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package utm
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	utmcommon "github.com/naveenrajm7/packer-plugin-utm/builder/utm/common"
+)
+
+// This step records in the output directory that the build completed
+// Phase, so the next run can resume after it. Once a checkpoint is
+// recorded, a failed build keeps its VM and its output directory.
+//
+// Uses:
+//
+//	ui packersdk.Ui
+//	vmName string
+//
+// Produces:
+//
+//	checkpoint_phase string - The last completed phase
+type StepCheckpoint struct {
+	OutputDir utmcommon.OutputDir
+	BuildName string
+	Source    string
+	Phase     string
+}
+
+func (s *StepCheckpoint) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+	vmName := state.Get("vmName").(string)
+
+	ui.Say(fmt.Sprintf("Recording checkpoint: %s", s.Phase))
+	checkpoint := &utmcommon.Checkpoint{
+		BuildName: s.BuildName,
+		Source:    s.Source,
+		VMName:    vmName,
+		Phase:     s.Phase,
+	}
+	if err := utmcommon.WriteCheckpoint(s.OutputDir, checkpoint); err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	state.Put("checkpoint_phase", s.Phase)
+	return multistep.ActionContinue
+}
+
+func (s *StepCheckpoint) Cleanup(state multistep.StateBag) {}
+
+// This step removes the checkpoint once the build is done, so it does
+// not end up in the artifact.
+//
+// Uses:
+//
+//	ui packersdk.Ui
+//
+// Produces:
+//
+//	<nothing>
+type StepRemoveCheckpoint struct {
+	OutputDir utmcommon.OutputDir
+}
+
+func (s *StepRemoveCheckpoint) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+
+	path := filepath.Join(s.OutputDir.String(), utmcommon.CheckpointFilename)
+	if err := s.OutputDir.Remove(path); err != nil {
+		err := fmt.Errorf("Error removing checkpoint: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	state.Remove("checkpoint_phase")
+	return multistep.ActionContinue
+}
+
+func (s *StepRemoveCheckpoint) Cleanup(state multistep.StateBag) {}
+
+// This step finds the VM of the interrupted build being resumed, and
+// stops it if it was left running. Unlike an attached VM, it belongs
+// to the build and is deleted like an imported one.
+//
+// Uses:
+//
+//	driver Driver
+//	ui packersdk.Ui
+//
+// Produces:
+//
+//	checkpoint_phase string - The last completed phase
+//	vmName string
+type StepResume struct {
+	Checkpoint     *utmcommon.Checkpoint
+	KeepRegistered bool
+
+	vmName string
+}
+
+func (s *StepResume) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(utmcommon.Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+
+	vm, err := findVM(ctx, driver, s.Checkpoint.VMName, "")
+	if err != nil {
+		err := fmt.Errorf("Error finding the VM of the interrupted build: %s\n\n"+
+			"Use the force flag to discard the checkpoint.", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	ui.Say(fmt.Sprintf("Resuming the build in VM %s (%s) after phase %s",
+		vm.Name, vm.UUID, s.Checkpoint.Phase))
+	s.vmName = vm.Name
+	state.Put("checkpoint_phase", s.Checkpoint.Phase)
+
+	if vm.Status != "stopped" {
+		ui.Say("Stopping the VM left running by the interrupted build...")
+		if err := driver.Stop(ctx, vm.Name); err != nil {
+			err := fmt.Errorf("Error stopping VM: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	if err := tagVM(ctx, driver, vm.Name); err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	state.Put("vmName", vm.Name)
+	return multistep.ActionContinue
+}
+
+func (s *StepResume) Cleanup(state multistep.StateBag) {
+	if s.vmName == "" {
+		return
+	}
+	deleteVM(state, s.vmName, s.KeepRegistered)
+}
+
+// This step goes right before StepProvision when the interrupted build
+// being resumed ran the provisioners. StepProvision must stay a step of
+// its own for -on-error=run-cleanup-provisioner to find it, so this step
+// wraps the hook it runs instead, to skip the provisioners.
+//
+// Uses:
+//
+//	hook packersdk.Hook
+//	ui packersdk.Ui
+//
+// Produces:
+//
+//	hook packersdk.Hook - The hook, skipping the provisioners
+type StepSkipProvision struct {
+	hook packersdk.Hook
+}
+
+func (s *StepSkipProvision) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	s.hook = state.Get("hook").(packersdk.Hook)
+	state.Put("hook", &skipProvisionHook{Hook: s.hook})
+	return multistep.ActionContinue
+}
+
+func (s *StepSkipProvision) Cleanup(state multistep.StateBag) {
+	if s.hook != nil {
+		state.Put("hook", s.hook)
+	}
+}
+
+// skipProvisionHook runs the hooks but the provisioners.
+type skipProvisionHook struct {
+	packersdk.Hook
+}
+
+func (h *skipProvisionHook) Run(ctx context.Context, name string, ui packersdk.Ui, comm packersdk.Communicator, data interface{}) error {
+	if name == packersdk.HookProvision {
+		ui.Say("Skipping the provisioners, the interrupted build ran them")
+		return nil
+	}
+	return h.Hook.Run(ctx, name, ui, comm, data)
+}
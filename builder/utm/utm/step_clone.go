@@ -0,0 +1,115 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package utm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	utmcommon "github.com/naveenrajm7/packer-plugin-utm/builder/utm/common"
+)
+
+// This step clones a VM registered with UTM, found by name or UUID,
+// into a new VM with fresh MAC addresses. The source VM is left as is.
+//
+// Uses:
+//
+//	driver Driver
+//	ui packersdk.Ui
+//
+// Produces:
+//
+//	vmName string
+type StepClone struct {
+	SourceName     string
+	SourceUUID     string
+	Name           string
+	KeepRegistered bool
+	// Delete the VMs already registered under Name instead of failing
+	Force bool
+
+	vmName string
+}
+
+func (s *StepClone) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(utmcommon.Driver)
+	ui := state.Get("ui").(packersdk.Ui)
+
+	source, err := findVM(ctx, driver, s.SourceName, s.SourceUUID)
+	if err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	if source.Status != "stopped" {
+		err := fmt.Errorf("VM %s (%s) is %s, shut it down first", source.Name, source.UUID, source.Status)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	// The source could be named like the clone when found by UUID
+	if source.Name == s.Name {
+		err := fmt.Errorf("VM %s (%s) to clone is named like the clone, change vm_name",
+			source.Name, source.UUID)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	if err := freeVMName(ctx, driver, ui, s.Name, s.Force); err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	ui.Say(fmt.Sprintf("Cloning VM %s (%s) into %s...", source.Name, source.UUID, s.Name))
+	if err := driver.Clone(ctx, source.UUID, s.Name); err != nil {
+		err := fmt.Errorf("Error cloning VM: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	s.vmName = s.Name
+
+	clone, err := findVM(ctx, driver, s.Name, "")
+	if err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	if clone.UUID == source.UUID {
+		err := fmt.Errorf("The clone has the UUID of the source VM %s", source.UUID)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	ui.Message(fmt.Sprintf("Clone UUID: %s", clone.UUID))
+
+	// Both VMs could not be on the same network otherwise
+	if _, err := driver.ExecuteOsaScript(ctx, "regenerate_mac_addresses.applescript", s.Name); err != nil {
+		err := fmt.Errorf("Error changing the MAC addresses of the clone: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	if err := tagVM(ctx, driver, s.Name); err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	state.Put("vmName", s.Name)
+	return multistep.ActionContinue
+}
+
+func (s *StepClone) Cleanup(state multistep.StateBag) {
+	if s.vmName == "" {
+		return
+	}
+	deleteVM(state, s.vmName, s.KeepRegistered)
+}
@@ -0,0 +1,36 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package utm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	utmcommon "github.com/naveenrajm7/packer-plugin-utm/builder/utm/common"
+)
+
+func TestStepClone_impl(t *testing.T) {
+	var _ multistep.Step = new(StepClone)
+}
+
+func TestStepClone_sourceRunning(t *testing.T) {
+	state := testState(t)
+	driver := state.Get("driver").(*utmcommon.DriverMock)
+	driver.ListResult = []utmcommon.VMInfo{{UUID: "UUID-1", Status: "started", Name: "base"}}
+
+	step := &StepClone{SourceName: "base", Name: "packer-test"}
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if driver.CloneCalled {
+		t.Fatal("clone should not be called")
+	}
+
+	// Nothing to clean up
+	step.Cleanup(state)
+	if driver.DeleteCalled {
+		t.Fatal("delete should not be called")
+	}
+}
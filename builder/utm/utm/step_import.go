@@ -5,7 +5,9 @@ package utm
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
@@ -17,6 +19,8 @@ type StepImport struct {
 	Name           string
 	ImportFlags    []string
 	KeepRegistered bool
+	// Delete the VMs already registered under Name instead of failing
+	Force bool
 
 	vmName string
 }
@@ -26,8 +30,14 @@ func (s *StepImport) Run(ctx context.Context, state multistep.StateBag) multiste
 	ui := state.Get("ui").(packersdk.Ui)
 	vmPath := state.Get("vm_path").(string)
 
+	if err := freeVMName(ctx, driver, ui, s.Name, s.Force); err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
 	ui.Say(fmt.Sprintf("Importing VM: %s", vmPath))
-	if err := driver.Import(s.Name, vmPath); err != nil {
+	if err := driver.Import(ctx, s.Name, vmPath); err != nil {
 		err := fmt.Errorf("Error importing VM: %s", err)
 		state.Put("error", err)
 		ui.Error(err.Error())
@@ -35,6 +45,13 @@ func (s *StepImport) Run(ctx context.Context, state multistep.StateBag) multiste
 	}
 
 	s.vmName = s.Name
+
+	if err := tagVM(ctx, driver, s.Name); err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
 	state.Put("vmName", s.Name)
 	return multistep.ActionContinue
 }
@@ -43,19 +60,80 @@ func (s *StepImport) Cleanup(state multistep.StateBag) {
 	if s.vmName == "" {
 		return
 	}
+	deleteVM(state, s.vmName, s.KeepRegistered)
+}
 
+// freeVMName makes sure no VM is registered under name, deleting them
+// if force is set. Steps find the VM by name, so it must be the only
+// one with that name.
+func freeVMName(ctx context.Context, driver utmcommon.Driver, ui packersdk.Ui, name string, force bool) error {
+	vms, err := driver.List(ctx)
+	if err != nil {
+		return fmt.Errorf("Error listing VMs: %s", err)
+	}
+	for _, vm := range vms {
+		if vm.Name != name {
+			continue
+		}
+
+		if !force {
+			return fmt.Errorf(
+				"A VM named %q is already registered with UTM (UUID %s)\n\n"+
+					"Use the force flag to delete it prior to building, or change vm_name.",
+				name, vm.UUID)
+		}
+
+		ui.Say(fmt.Sprintf("Deleting previously registered VM %s (%s)...", name, vm.UUID))
+		if err := utmcommon.StopAndDelete(ctx, driver, vm.UUID); err != nil {
+			return fmt.Errorf("Error deleting VM %s: %s", vm.UUID, err)
+		}
+	}
+	return nil
+}
+
+// tagVM tags the VM with this process, so it can be found
+// if we die without cleaning up.
+func tagVM(ctx context.Context, driver utmcommon.Driver, name string) error {
+	tag, err := utmcommon.NewBuildTag()
+	if err == nil {
+		err = utmcommon.SetBuildTag(ctx, driver, name, tag)
+	}
+	if err != nil {
+		return fmt.Errorf("Error tagging VM: %s", err)
+	}
+	return nil
+}
+
+// deleteVM deletes the VM created by the build, unless the build
+// succeeded and keepRegistered is set, or the build failed after
+// recording a checkpoint.
+func deleteVM(state multistep.StateBag, vmName string, keepRegistered bool) {
 	driver := state.Get("driver").(utmcommon.Driver)
 	ui := state.Get("ui").(packersdk.Ui)
 
 	_, cancelled := state.GetOk(multistep.StateCancelled)
 	_, halted := state.GetOk(multistep.StateHalted)
-	if (s.KeepRegistered) && (!cancelled && !halted) {
+	if (keepRegistered) && (!cancelled && !halted) {
 		ui.Say("Keeping virtual machine registered with UTM host (keep_registered = true)")
 		return
 	}
 
-	ui.Say("Deregistering and deleting imported VM...")
-	if err := driver.Delete(s.vmName); err != nil {
+	if _, ok := state.GetOk("checkpoint_phase"); ok && (cancelled || halted) {
+		ui.Say("Keeping virtual machine registered to resume the build (checkpoint = true)")
+		// The next run resumes the build, the VM is no orphan
+		if err := utmcommon.SetBuildTag(context.Background(), driver, vmName, nil); err != nil {
+			ui.Error(fmt.Sprintf("Error removing build tag: %s", err))
+		}
+		return
+	}
+
+	ui.Say("Deregistering and deleting VM...")
+	if err := driver.Delete(context.Background(), vmName); err != nil {
+		// Someone (or something) already deleted it, which is what we wanted
+		if errors.Is(err, utmcommon.ErrVMNotFound) {
+			log.Printf("VM %s was already deleted", vmName)
+			return
+		}
 		ui.Error(fmt.Sprintf("Error deleting VM: %s", err))
 	}
 }
@@ -4,10 +4,13 @@
 package utm
 
 import (
+	"bytes"
 	"context"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
 	utmcommon "github.com/naveenrajm7/packer-plugin-utm/builder/utm/common"
 )
 
@@ -48,6 +51,59 @@ func TestStepImport(t *testing.T) {
 	}
 }
 
+func TestStepImport_NameConflict(t *testing.T) {
+	state := testState(t)
+	state.Put("vm_path", "foo")
+
+	step := new(StepImport)
+	step.Name = "bar"
+
+	driver := state.Get("driver").(*utmcommon.DriverMock)
+	driver.ListResult = []utmcommon.VMInfo{
+		{UUID: "A8C3F4D2-0000-4000-8000-000000000001", Status: "stopped", Name: "bar"},
+	}
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	err, ok := state.GetOk("error")
+	if !ok || !strings.Contains(err.(error).Error(), "A8C3F4D2-0000-4000-8000-000000000001") {
+		t.Fatalf("error should name the conflicting VM: %v", err)
+	}
+	if driver.ImportCalled || driver.DeleteCalled {
+		t.Fatal("nothing should be imported or deleted")
+	}
+}
+
+func TestStepImport_NameConflictForce(t *testing.T) {
+	state := testState(t)
+	state.Put("vm_path", "foo")
+
+	step := new(StepImport)
+	step.Name = "bar"
+	step.Force = true
+
+	driver := state.Get("driver").(*utmcommon.DriverMock)
+	driver.ListResult = []utmcommon.VMInfo{
+		{UUID: "A8C3F4D2-0000-4000-8000-000000000001", Status: "started", Name: "bar"},
+		{UUID: "A8C3F4D2-0000-4000-8000-000000000002", Status: "stopped", Name: "baz"},
+	}
+	driver.IsRunningReturn = true
+
+	if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if driver.StopName != "A8C3F4D2-0000-4000-8000-000000000001" {
+		t.Fatalf("bad: %#v", driver.StopName)
+	}
+	if driver.DeleteName != "A8C3F4D2-0000-4000-8000-000000000001" {
+		t.Fatalf("bad: %#v", driver.DeleteName)
+	}
+	if !driver.ImportCalled {
+		t.Fatal("import should be called")
+	}
+}
+
 func TestStepImport_Cleanup(t *testing.T) {
 	state := testState(t)
 	state.Put("vm_path", "foo")
@@ -72,3 +128,34 @@ func TestStepImport_Cleanup(t *testing.T) {
 		t.Fatalf("bad: %#v", driver.DeleteName)
 	}
 }
+
+func TestStepImport_CleanupAlreadyDeleted(t *testing.T) {
+	state := testState(t)
+	state.Put("vm_path", "foo")
+
+	step := new(StepImport)
+	step.vmName = "bar"
+
+	driver := state.Get("driver").(*utmcommon.DriverMock)
+	driver.DeleteErr = &utmcommon.UtmctlError{
+		Args:   []string{"delete", "bar"},
+		Stderr: "Error: Virtual machine not found.",
+		Err:    utmcommon.ErrVMNotFound,
+	}
+
+	ui := &packersdk.BasicUi{
+		Reader:      new(bytes.Buffer),
+		Writer:      new(bytes.Buffer),
+		ErrorWriter: new(bytes.Buffer),
+	}
+	state.Put("ui", ui)
+
+	state.Put(multistep.StateHalted, true)
+	step.Cleanup(state)
+	if !driver.DeleteCalled {
+		t.Fatal("delete should be called")
+	}
+	if ui.ErrorWriter.(*bytes.Buffer).Len() != 0 {
+		t.Fatalf("should not report an error: %s", ui.ErrorWriter)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/hashicorp/packer-plugin-sdk/plugin"
 
 	"github.com/naveenrajm7/packer-plugin-utm/builder/utm/utm"
+	utmPPvagrant "github.com/naveenrajm7/packer-plugin-utm/post-processor/vagrant"
 	utmPPzip "github.com/naveenrajm7/packer-plugin-utm/post-processor/zip"
 	"github.com/naveenrajm7/packer-plugin-utm/version"
 )
@@ -18,6 +19,7 @@ func main() {
 	pps := plugin.NewSet()
 	pps.RegisterBuilder("utm", new(utm.Builder))
 	pps.RegisterPostProcessor("zip", new(utmPPzip.PostProcessor))
+	pps.RegisterPostProcessor("vagrant", new(utmPPvagrant.PostProcessor))
 	pps.SetVersion(version.PluginVersion)
 	err := pps.Run()
 	if err != nil {
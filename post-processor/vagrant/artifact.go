@@ -0,0 +1,43 @@
+package vagrant
+
+import (
+	"fmt"
+	"os"
+)
+
+// The BuilderId of the boxes of the Vagrant post-processors, which the
+// vagrant-cloud and vagrant-registry post-processors accept.
+const BuilderId = "mitchellh.post-processor.vagrant"
+
+// Artifact is the result of running the UTM vagrant post-processor,
+// namely a Vagrant box for the utm provider.
+type Artifact struct {
+	Path     string
+	Provider string
+}
+
+func (a *Artifact) BuilderId() string {
+	return BuilderId
+}
+
+// Id returns the provider of the box, as expected by the
+// post-processors uploading boxes.
+func (a *Artifact) Id() string {
+	return a.Provider
+}
+
+func (a *Artifact) Files() []string {
+	return []string{a.Path}
+}
+
+func (a *Artifact) String() string {
+	return fmt.Sprintf("'%s' provider box: %s", a.Provider, a.Path)
+}
+
+func (*Artifact) State(name string) interface{} {
+	return nil
+}
+
+func (a *Artifact) Destroy() error {
+	return os.Remove(a.Path)
+}
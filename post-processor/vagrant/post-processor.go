@@ -0,0 +1,319 @@
+//go:generate packer-sdc struct-markdown
+//go:generate packer-sdc mapstructure-to-hcl2 -type Config
+
+package vagrant
+
+import (
+	"archive/tar"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/common"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+)
+
+// The provider of the boxes, as registered by the Vagrant UTM plugin.
+const provider = "utm"
+
+// The name of the VM bundle in the box, where the Vagrant UTM
+// plugin imports the VM from.
+const boxBundleName = "box.utm"
+
+// The compression level gzip uses by default.
+const defaultCompressionLevel = 6
+
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+
+	// The full path to the box file that will be created by this
+	// post-processor. This is a template engine, the variables `BuildName`,
+	// `BuilderType` and `Provider` are available, along with the data the
+	// builder generated. Defaults to `packer_{{.BuildName}}_{{.Provider}}.box`.
+	OutputPath string `mapstructure:"output"`
+	// The path to a Vagrantfile to embed in the box. It is a template as
+	// well, with the same variables as `output`. By default the box has no
+	// Vagrantfile, the Vagrant UTM plugin needs none.
+	VagrantfileTemplate string `mapstructure:"vagrantfile_template"`
+	// Paths to files to include in the box, at its root. Useful to ship
+	// a README or scripts the embedded Vagrantfile refers to.
+	Include []string `mapstructure:"include"`
+	// The gzip compression level of the box, from 0 (no compression, the
+	// box is a plain tar archive) to 9 (best compression). Defaults to 6.
+	CompressionLevel *int `mapstructure:"compression_level"`
+
+	ctx interpolate.Context
+}
+
+// PostProcessor implements packersdk.PostProcessor
+// Creates a Vagrant box for the utm provider from a UTM VM bundle
+type PostProcessor struct {
+	config Config
+}
+
+func (p *PostProcessor) ConfigSpec() hcldec.ObjectSpec { return p.config.FlatMapstructure().HCL2Spec() }
+
+func (p *PostProcessor) Configure(raws ...interface{}) error {
+	err := config.Decode(&p.config, &config.DecodeOpts{
+		PluginType:         "vagrant",
+		Interpolate:        true,
+		InterpolateContext: &p.config.ctx,
+		InterpolateFilter: &interpolate.RenderFilter{
+			Exclude: []string{"output"},
+		},
+	}, raws...)
+	if err != nil {
+		return err
+	}
+
+	errs := new(packersdk.MultiError)
+
+	if p.config.OutputPath == "" {
+		p.config.OutputPath = "packer_{{.BuildName}}_{{.Provider}}.box"
+	}
+
+	if err = interpolate.Validate(p.config.OutputPath, &p.config.ctx); err != nil {
+		errs = packersdk.MultiErrorAppend(
+			errs, fmt.Errorf("Error parsing output template: %s", err))
+	}
+
+	if p.config.CompressionLevel == nil {
+		level := defaultCompressionLevel
+		p.config.CompressionLevel = &level
+	} else if *p.config.CompressionLevel < flate.NoCompression || *p.config.CompressionLevel > flate.BestCompression {
+		errs = packersdk.MultiErrorAppend(
+			errs, fmt.Errorf("compression_level must be between %d and %d", flate.NoCompression, flate.BestCompression))
+	}
+
+	if p.config.VagrantfileTemplate != "" {
+		if _, err := os.Stat(p.config.VagrantfileTemplate); err != nil {
+			errs = packersdk.MultiErrorAppend(
+				errs, fmt.Errorf("vagrantfile_template could not be read: %s", err))
+		}
+	}
+
+	for _, path := range p.config.Include {
+		if _, err := os.Stat(path); err != nil {
+			errs = packersdk.MultiErrorAppend(
+				errs, fmt.Errorf("include file could not be read: %s", err))
+		}
+	}
+
+	if len(errs.Errors) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+func (p *PostProcessor) PostProcess(
+	ctx context.Context,
+	ui packersdk.Ui,
+	artifact packersdk.Artifact,
+) (packersdk.Artifact, bool, bool, error) {
+	if host, ok := artifact.State("utm_host").(string); ok && host != "" {
+		return nil, false, false, fmt.Errorf(
+			"The files of the artifact are on the UTM host %s, they can't be read to create the box. "+
+				"Run Packer on the UTM host to post-process them.", host)
+	}
+
+	var generatedData map[interface{}]interface{}
+	stateData := artifact.State("generated_data")
+	if stateData != nil {
+		// Make sure it's not a nil map so we can assign to it later.
+		generatedData = stateData.(map[interface{}]interface{})
+	}
+	// If stateData has a nil map generatedData will be nil
+	// and we need to make sure it's not
+	if generatedData == nil {
+		generatedData = make(map[interface{}]interface{})
+	}
+
+	// These are extra variables that will be made available for interpolation.
+	generatedData["BuildName"] = p.config.PackerBuildName
+	generatedData["BuilderType"] = p.config.PackerBuilderType
+	generatedData["Provider"] = provider
+	p.config.ctx.Data = generatedData
+
+	target, err := interpolate.Render(p.config.OutputPath, &p.config.ctx)
+	if err != nil {
+		return nil, false, false, fmt.Errorf("Error interpolating output value: %s", err)
+	}
+
+	bundle, err := findBundle(artifact)
+	if err != nil {
+		return nil, false, false, err
+	}
+
+	var vagrantfile []byte
+	if p.config.VagrantfileTemplate != "" {
+		content, err := os.ReadFile(p.config.VagrantfileTemplate)
+		if err != nil {
+			return nil, false, false, fmt.Errorf("Error reading Vagrantfile template: %s", err)
+		}
+		rendered, err := interpolate.Render(string(content), &p.config.ctx)
+		if err != nil {
+			return nil, false, false, fmt.Errorf("Error rendering Vagrantfile template: %s", err)
+		}
+		vagrantfile = []byte(rendered)
+	}
+
+	ui.Say(fmt.Sprintf("Creating Vagrant box for '%s' provider: %s", provider, target))
+	if dir := filepath.Dir(target); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, false, false, fmt.Errorf("Error creating box directory: %s", err)
+		}
+	}
+	if err := p.writeBox(ctx, target, bundle, vagrantfile); err != nil {
+		os.Remove(target)
+		return nil, false, false, fmt.Errorf("Error creating box: %s", err)
+	}
+
+	return &Artifact{Path: target, Provider: provider}, false, false, nil
+}
+
+// findBundle returns the UTM VM bundle among the files of artifact.
+func findBundle(artifact packersdk.Artifact) (string, error) {
+	bundle := ""
+	for _, file := range artifact.Files() {
+		idx := strings.Index(file, ".utm/")
+		if idx == -1 {
+			continue
+		}
+		if found := file[:idx+4]; bundle == "" {
+			bundle = found
+		} else if found != bundle {
+			return "", fmt.Errorf("the artifact has several UTM bundles: %s and %s", bundle, found)
+		}
+	}
+	if bundle == "" {
+		return "", errors.New("the artifact has no UTM bundle (.utm directory), was it exported?")
+	}
+	return bundle, nil
+}
+
+// writeBox writes the box: metadata.json, the Vagrantfile if any, the
+// included files and the VM bundle as box.utm, in a tar archive which
+// is gzipped unless compression is disabled.
+func (p *PostProcessor) writeBox(ctx context.Context, target string, bundle string, vagrantfile []byte) error {
+	file, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var w io.Writer = file
+	level := *p.config.CompressionLevel
+	if level != flate.NoCompression {
+		gz, err := gzip.NewWriterLevel(file, level)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	metadata, err := json.Marshal(map[string]string{"provider": provider})
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "metadata.json", metadata); err != nil {
+		return err
+	}
+	if vagrantfile != nil {
+		if err := writeTarFile(tw, "Vagrantfile", vagrantfile); err != nil {
+			return err
+		}
+	}
+	for _, path := range p.config.Include {
+		if err := addTarPath(ctx, tw, path, filepath.Base(path)); err != nil {
+			return err
+		}
+	}
+	if err := addTarPath(ctx, tw, bundle, boxBundleName); err != nil {
+		return err
+	}
+
+	// Close explicitly to catch the errors of the last writes
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gz, ok := w.(*gzip.Writer); ok {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+	return file.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		Typeflag: tar.TypeReg,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// addTarPath adds the file or directory at path to the archive as name.
+func addTarPath(ctx context.Context, tw *tar.Writer, path string, name string) error {
+	return filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(path, file)
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join(name, rel))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
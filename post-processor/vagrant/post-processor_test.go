@@ -0,0 +1,200 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package vagrant
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// testArtifact creates a UTM bundle and returns an artifact with its files.
+func testArtifact(t *testing.T) *packersdk.MockArtifact {
+	bundle := filepath.Join(t.TempDir(), "packer-test.utm")
+	if err := os.MkdirAll(filepath.Join(bundle, "Data"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	files := []string{filepath.Join(bundle, "config.plist"), filepath.Join(bundle, "Data", "disk.qcow2")}
+	for _, file := range files {
+		if err := os.WriteFile(file, []byte(filepath.Base(file)), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	return &packersdk.MockArtifact{FilesValue: files}
+}
+
+// readBox returns the contents of the regular files of a box by name.
+func readBox(t *testing.T, path string, compressed bool) map[string]string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if compressed {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("box should be gzipped: %s", err)
+		}
+		r = gz
+	}
+	files := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			files[header.Name] = string(data)
+		}
+	}
+	return files
+}
+
+func TestPostProcessor_impl(t *testing.T) {
+	var _ packersdk.PostProcessor = new(PostProcessor)
+}
+
+func TestPostProcessor_Configure(t *testing.T) {
+	var p PostProcessor
+	if err := p.Configure(map[string]interface{}{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if *p.config.CompressionLevel != 6 {
+		t.Fatalf("bad compression_level: %d", *p.config.CompressionLevel)
+	}
+
+	p = PostProcessor{}
+	if err := p.Configure(map[string]interface{}{"compression_level": 10}); err == nil {
+		t.Fatal("should error")
+	}
+
+	p = PostProcessor{}
+	if err := p.Configure(map[string]interface{}{"vagrantfile_template": "missing"}); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestPostProcessor_PostProcess(t *testing.T) {
+	dir := t.TempDir()
+	template := filepath.Join(dir, "Vagrantfile.tpl")
+	if err := os.WriteFile(template, []byte("# {{.BuildName}} for {{.Provider}}\n"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	readme := filepath.Join(dir, "README.md")
+	if err := os.WriteFile(readme, []byte("readme"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var p PostProcessor
+	err := p.Configure(map[string]interface{}{
+		"packer_build_name":    "ubuntu",
+		"output":               filepath.Join(dir, "{{.BuildName}}_{{.Provider}}.box"),
+		"vagrantfile_template": template,
+		"include":              []string{readme},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ui := &packersdk.BasicUi{Reader: new(bytes.Buffer), Writer: new(bytes.Buffer)}
+	artifact, keep, _, err := p.PostProcess(context.Background(), ui, testArtifact(t))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if keep {
+		t.Fatal("should not keep the input artifact")
+	}
+	if artifact.BuilderId() != "mitchellh.post-processor.vagrant" || artifact.Id() != "utm" {
+		t.Fatalf("bad artifact: %s %s", artifact.BuilderId(), artifact.Id())
+	}
+	box := filepath.Join(dir, "ubuntu_utm.box")
+	if !reflect.DeepEqual(artifact.Files(), []string{box}) {
+		t.Fatalf("bad files: %#v", artifact.Files())
+	}
+
+	files := readBox(t, box, true)
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	expected := []string{"README.md", "Vagrantfile", "box.utm/Data/disk.qcow2", "box.utm/config.plist", "metadata.json"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("bad box files: %#v", names)
+	}
+	if files["metadata.json"] != `{"provider":"utm"}` {
+		t.Fatalf("bad metadata: %s", files["metadata.json"])
+	}
+	if files["Vagrantfile"] != "# ubuntu for utm\n" {
+		t.Fatalf("bad Vagrantfile: %q", files["Vagrantfile"])
+	}
+	if files["box.utm/Data/disk.qcow2"] != "disk.qcow2" {
+		t.Fatalf("bad disk: %q", files["box.utm/Data/disk.qcow2"])
+	}
+}
+
+func TestPostProcessor_PostProcessNoCompression(t *testing.T) {
+	dir := t.TempDir()
+	var p PostProcessor
+	err := p.Configure(map[string]interface{}{
+		"output":            filepath.Join(dir, "test.box"),
+		"compression_level": 0,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ui := &packersdk.BasicUi{Reader: new(bytes.Buffer), Writer: new(bytes.Buffer)}
+	if _, _, _, err := p.PostProcess(context.Background(), ui, testArtifact(t)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if files := readBox(t, filepath.Join(dir, "test.box"), false); files["metadata.json"] == "" {
+		t.Fatalf("bad box: %#v", files)
+	}
+
+	// There is nothing to box without a bundle
+	_, _, _, err = p.PostProcess(context.Background(), ui, &packersdk.MockArtifact{FilesValue: []string{}})
+	if err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestPostProcessor_RemoteArtifact(t *testing.T) {
+	var p PostProcessor
+	output := filepath.Join(t.TempDir(), "test.box")
+	if err := p.Configure(map[string]interface{}{"output": output}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The files are on the UTM host, not here
+	source := testArtifact(t)
+	source.StateValues = map[string]interface{}{"utm_host": "mac.example.com"}
+	_, _, _, err := p.PostProcess(context.Background(), &packersdk.BasicUi{Reader: new(bytes.Buffer), Writer: new(bytes.Buffer)}, source)
+	if err == nil || !strings.Contains(err.Error(), "mac.example.com") {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatalf("should not exist: %s", output)
+	}
+}
@@ -0,0 +1,369 @@
+package zip
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The archive formats, named after the extension they give the output.
+const (
+	formatZip    = "zip"
+	formatTar    = "tar"
+	formatTarGz  = "tar.gz"
+	formatTarZst = "tar.zst"
+	formatTarXz  = "tar.xz"
+)
+
+// archiveFormat describes the compression levels of a format.
+type archiveFormat struct {
+	// The range of compression levels, none when MaxLevel is 0
+	MinLevel, MaxLevel int
+	DefaultLevel       int
+}
+
+var archiveFormats = map[string]archiveFormat{
+	formatZip:    {MinLevel: 0, MaxLevel: 9, DefaultLevel: 6},
+	formatTar:    {},
+	formatTarGz:  {MinLevel: 0, MaxLevel: 9, DefaultLevel: 6},
+	formatTarZst: {MinLevel: 1, MaxLevel: 22, DefaultLevel: 3},
+	formatTarXz:  {MinLevel: 0, MaxLevel: 9, DefaultLevel: 6},
+}
+
+// The dictionary sizes of the xz presets, by compression level.
+var xzDictCaps = []int{
+	256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20,
+	8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20,
+}
+
+// The modification time of the entries of reproducible archives when
+// SOURCE_DATE_EPOCH is not set, the earliest time a zip can hold.
+var reproducibleModTime = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// withExtension returns path ending with the extension of format,
+// appending it when path has no archive extension.
+func withExtension(path string, format string) (string, error) {
+	if strings.HasSuffix(path, "."+format) {
+		return path, nil
+	}
+	for other := range archiveFormats {
+		if strings.HasSuffix(path, "."+other) {
+			return "", fmt.Errorf("output %s does not have the extension of format %s", path, format)
+		}
+	}
+	return path + "." + format, nil
+}
+
+// archiveEntry is a file or a directory to archive.
+type archiveEntry struct {
+	// The path of the file on disk
+	Path string
+	// The slash separated name in the archive, with a trailing
+	// slash for directories
+	Name string
+	Info os.FileInfo
+}
+
+// collectEntries returns the entries of the sources, a directory
+// giving an entry for itself and for every file in it.
+func collectEntries(sources []archiveSource) ([]archiveEntry, error) {
+	var entries []archiveEntry
+	for _, source := range sources {
+		err := filepath.Walk(source.Path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(source.Path, path)
+			if err != nil {
+				return err
+			}
+			name := source.Name
+			if rel != "." {
+				name += "/" + filepath.ToSlash(rel)
+			}
+			if info.IsDir() {
+				name += "/"
+			}
+			entries = append(entries, archiveEntry{Path: path, Name: name, Info: info})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// archiveOptions tells how to write an archive.
+type archiveOptions struct {
+	Format string
+	Level  int
+	// Glob patterns of the file names to store without compression, zip only
+	Store []string
+	// The number of blocks compressed at once, and held in memory
+	Workers  int
+	InFlight int
+	// Whether to sort the entries and normalize their times to ModTime,
+	// their owners and their permissions
+	Reproducible bool
+	ModTime      time.Time
+	// Records the files for the manifest when set
+	Manifest *manifestRecorder
+	// Gets the bytes of the files as they are archived when set
+	Progress io.Writer
+}
+
+// copyFile copies the file of entry to w.
+func (o *archiveOptions) copyFile(ctx context.Context, w io.Writer, entry archiveEntry) (int64, error) {
+	if o.Progress != nil {
+		w = io.MultiWriter(w, o.Progress)
+	}
+	if o.Manifest != nil {
+		return o.Manifest.copyFile(ctx, w, entry)
+	}
+	return copyFile(ctx, w, entry.Path)
+}
+
+func (o *archiveOptions) parallelWriter(w io.Writer, compress compressFunc) *parallelWriter {
+	return newParallelWriter(w, compress, o.Workers, o.InFlight)
+}
+
+// reproducibleInfo is the file info of an entry of a reproducible
+// archive: it has a fixed time, no owner, and only tells whether a file
+// is executable of its permissions.
+type reproducibleInfo struct {
+	os.FileInfo
+	modTime time.Time
+}
+
+func (i reproducibleInfo) ModTime() time.Time { return i.modTime }
+
+func (i reproducibleInfo) Mode() os.FileMode {
+	mode := i.FileInfo.Mode()
+	switch {
+	case mode.IsDir():
+		return os.ModeDir | 0755
+	case mode&os.ModeSymlink != 0:
+		return os.ModeSymlink | 0777
+	case mode&0111 != 0:
+		return 0755
+	}
+	return 0644
+}
+
+// Sys hides the owner and the other times of the file from the archive
+// headers.
+func (i reproducibleInfo) Sys() interface{} { return nil }
+
+// makeReproducible sorts the entries by name, a directory coming
+// before its contents, and normalizes their file info.
+func makeReproducible(entries []archiveEntry, modTime time.Time) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	for i := range entries {
+		entries[i].Info = reproducibleInfo{FileInfo: entries[i].Info, modTime: modTime}
+	}
+}
+
+// stored tells whether the zip entry should not be compressed.
+func (o *archiveOptions) stored(entry archiveEntry) bool {
+	if o.Level == 0 {
+		return true
+	}
+	for _, pattern := range o.Store {
+		if ok, _ := filepath.Match(pattern, filepath.Base(entry.Path)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// writeArchive writes the entries to w as an archive.
+func writeArchive(ctx context.Context, w io.Writer, entries []archiveEntry, opts *archiveOptions) error {
+	if opts.Reproducible {
+		makeReproducible(entries, opts.ModTime)
+	}
+
+	var compress compressFunc
+	switch opts.Format {
+	case formatZip:
+		return writeZip(ctx, w, entries, opts)
+	case formatTarGz:
+		compress = gzipBlock(opts.Level)
+	case formatTarZst:
+		var err error
+		if compress, err = zstdBlock(opts.Level, opts.Workers); err != nil {
+			return err
+		}
+	case formatTarXz:
+		compress = xzBlock(opts.Level)
+	}
+
+	if compress == nil {
+		return writeTar(ctx, w, entries, opts)
+	}
+	pw := opts.parallelWriter(w, compress)
+	if err := writeTar(ctx, pw, entries, opts); err != nil {
+		pw.Close()
+		return err
+	}
+	return pw.Close()
+}
+
+func writeZip(ctx context.Context, w io.Writer, entries []archiveEntry, opts *archiveOptions) error {
+	zipWriter := zip.NewWriter(w)
+
+	for _, entry := range entries {
+		header, err := zip.FileInfoHeader(entry.Info)
+		if err != nil {
+			return err
+		}
+		header.Name = entry.Name
+
+		if entry.Info.Mode().IsRegular() && !opts.stored(entry) {
+			if err := writeZipDeflated(ctx, zipWriter, header, entry, opts); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !entry.Info.IsDir() {
+			header.Method = zip.Store
+		}
+		writer, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		switch {
+		case entry.Info.Mode().IsRegular():
+			if _, err := opts.copyFile(ctx, writer, entry); err != nil {
+				return err
+			}
+		case entry.Info.Mode()&os.ModeSymlink != 0:
+			// The content of a symlink entry is its target
+			link, err := os.Readlink(entry.Path)
+			if err != nil {
+				return err
+			}
+			if _, err := io.WriteString(writer, link); err != nil {
+				return err
+			}
+		}
+	}
+
+	return zipWriter.Close()
+}
+
+// writeZipDeflated adds a file compressed in parallel to the zip. The
+// sizes and the checksum are only known once it is compressed, so they
+// follow the data in a data descriptor.
+func writeZipDeflated(ctx context.Context, zipWriter *zip.Writer, header *zip.FileHeader, entry archiveEntry, opts *archiveOptions) error {
+	header.Method = zip.Deflate
+	header.Flags |= 0x8
+	// CreateRaw only writes the MS-DOS time, add the extended timestamp
+	// CreateHeader gives the other entries
+	header.Extra = append(header.Extra, extendedTimestamp(header.Modified)...)
+	// Nor does it flag UTF-8 names, which would be read as CP437
+	if !isASCII(header.Name) && utf8.ValidString(header.Name) {
+		header.Flags |= 0x800
+	}
+	writer, err := zipWriter.CreateRaw(header)
+	if err != nil {
+		return err
+	}
+
+	crc := crc32.NewIEEE()
+	pw := opts.parallelWriter(writer, deflateBlock(opts.Level))
+	size, err := opts.copyFile(ctx, io.MultiWriter(pw, crc), entry)
+	if err != nil {
+		pw.Close()
+		return err
+	}
+	if err := pw.Close(); err != nil {
+		return err
+	}
+
+	// The header is written with the data descriptor and the
+	// central directory, after the data
+	header.CRC32 = crc.Sum32()
+	header.UncompressedSize64 = uint64(size)
+	header.CompressedSize64 = uint64(pw.Written())
+	header.UncompressedSize = uint32(min(header.UncompressedSize64, math.MaxUint32))
+	header.CompressedSize = uint32(min(header.CompressedSize64, math.MaxUint32))
+	return nil
+}
+
+// isASCII reports whether s only holds ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// extendedTimestamp returns the zip extra field holding the modification
+// time t, in the format of Info-ZIP.
+func extendedTimestamp(t time.Time) []byte {
+	extra := make([]byte, 9)
+	binary.LittleEndian.PutUint16(extra[0:], 0x5455)
+	binary.LittleEndian.PutUint16(extra[2:], 5)
+	extra[4] = 1 // Only the modification time
+	binary.LittleEndian.PutUint32(extra[5:], uint32(t.Unix()))
+	return extra
+}
+
+func writeTar(ctx context.Context, w io.Writer, entries []archiveEntry, opts *archiveOptions) error {
+	tarWriter := tar.NewWriter(w)
+
+	for _, entry := range entries {
+		link := ""
+		if entry.Info.Mode()&os.ModeSymlink != 0 {
+			var err error
+			if link, err = os.Readlink(entry.Path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(entry.Info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = entry.Name
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if entry.Info.Mode().IsRegular() {
+			if _, err := opts.copyFile(ctx, tarWriter, entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tarWriter.Close()
+}
+
+// copyFile copies the file at path to w, until ctx is done.
+func copyFile(ctx context.Context, w io.Writer, path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return io.Copy(w, &contextReader{ctx: ctx, r: file})
+}
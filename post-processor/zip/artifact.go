@@ -3,14 +3,35 @@ package zip
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 const BuilderId = "naveenrajm7.utm.post-processor.zip"
 
 // Artifact is the result of running the UTM zip post-processor,
-// namely a zip file which contains a utm directory (UTM VM bundle).
+// namely archives which contain utm directories (UTM VM bundles).
 type Artifact struct {
+	// One archive per bundle, unless they were combined
+	Archives []*Archive
+}
+
+// Archive is an archive written by the post-processor, with the files
+// written next to it.
+type Archive struct {
 	Path string
+	// The parts of the archive when it is split, Path is then not written
+	Parts []string
+	// The manifest listing the parts, to join them
+	JoinManifest string
+	// The checksum files written next to the archive
+	ChecksumFiles []string
+	// The manifest written next to the archive, if any
+	Manifest string
+	// The detached signatures of the archive and its manifest
+	Signatures []string
+	// The digests of the archive by checksum type
+	Digests map[string]string
 }
 
 func (a *Artifact) BuilderId() string {
@@ -22,17 +43,61 @@ func (*Artifact) Id() string {
 }
 
 func (a *Artifact) Files() []string {
-	return []string{a.Path}
+	var files []string
+	for _, archive := range a.Archives {
+		if len(archive.Parts) > 0 {
+			files = append(files, archive.Parts...)
+		} else {
+			files = append(files, archive.Path)
+		}
+		files = append(files, archive.ChecksumFiles...)
+		if archive.JoinManifest != "" {
+			files = append(files, archive.JoinManifest)
+		}
+		if archive.Manifest != "" {
+			files = append(files, archive.Manifest)
+		}
+		files = append(files, archive.Signatures...)
+	}
+	return files
 }
 
 func (a *Artifact) String() string {
-	return fmt.Sprintf("compressed artifacts in: %s", a.Path)
+	var paths []string
+	for _, archive := range a.Archives {
+		paths = append(paths, archive.Path)
+	}
+	return fmt.Sprintf("compressed artifacts in: %s", strings.Join(paths, ", "))
 }
 
-func (*Artifact) State(name string) interface{} {
+// State returns the digests of the archives by archive name and
+// checksum type as "digests", and the paths to their manifests as
+// "manifest". Both have the same type for one archive and for several.
+func (a *Artifact) State(name string) interface{} {
+	switch name {
+	case "digests":
+		digests := map[string]map[string]string{}
+		for _, archive := range a.Archives {
+			digests[filepath.Base(archive.Path)] = archive.Digests
+		}
+		return digests
+	case "manifest":
+		manifests := []string{}
+		for _, archive := range a.Archives {
+			if archive.Manifest != "" {
+				manifests = append(manifests, archive.Manifest)
+			}
+		}
+		return manifests
+	}
 	return nil
 }
 
 func (a *Artifact) Destroy() error {
-	return os.Remove(a.Path)
+	for _, file := range a.Files() {
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,142 @@
+package zip
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The checksum types, as the file extensions of the checksum files.
+var checksumTypes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha224": sha256.New224,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// The checksum type of the manifest when no checksum_types are set.
+const defaultManifestChecksum = "sha256"
+
+// The checksum type signatures are made from.
+const signatureChecksum = "sha512"
+
+// hashes computes several checksums of what is written to it at once.
+type hashes struct {
+	types  []string
+	hashes []hash.Hash
+	// The number of bytes hashed
+	size int64
+}
+
+func newHashes(types []string) *hashes {
+	h := &hashes{types: types}
+	for _, t := range types {
+		h.hashes = append(h.hashes, checksumTypes[t]())
+	}
+	return h
+}
+
+func (h *hashes) Write(data []byte) (int, error) {
+	for _, hash := range h.hashes {
+		hash.Write(data)
+	}
+	h.size += int64(len(data))
+	return len(data), nil
+}
+
+// Digests returns the hex digests by checksum type.
+func (h *hashes) Digests() map[string]string {
+	digests := map[string]string{}
+	for i, t := range h.types {
+		digests[t] = hex.EncodeToString(h.hashes[i].Sum(nil))
+	}
+	return digests
+}
+
+// writeChecksumFile writes the digest of the file path to path.<type>,
+// in the format of sha256sum and its siblings so they can check it.
+func writeChecksumFile(path string, checksumType string, digest string) (string, error) {
+	checksumPath := path + "." + checksumType
+	content := fmt.Sprintf("%s  %s\n", digest, filepath.Base(path))
+	if err := os.WriteFile(checksumPath, []byte(content), 0644); err != nil {
+		return "", err
+	}
+	return checksumPath, nil
+}
+
+// manifestFile describes a file in a manifest.
+type manifestFile struct {
+	Name    string            `json:"name"`
+	Size    int64             `json:"size"`
+	Digests map[string]string `json:"digests"`
+}
+
+// manifest describes an archive, what it holds and where it comes from.
+type manifest struct {
+	BuildName     string                 `json:"build_name"`
+	BuilderType   string                 `json:"builder_type"`
+	UTMVersion    string                 `json:"utm_version,omitempty"`
+	GeneratedData map[string]interface{} `json:"generated_data"`
+	Archive       manifestFile           `json:"archive"`
+	// The parts of the archive, when it is split
+	Parts []manifestFile `json:"parts,omitempty"`
+	// The files of the bundle, by their name in the archive
+	Files []manifestFile `json:"files"`
+}
+
+// manifestRecorder hashes the files of the bundle as they are archived.
+type manifestRecorder struct {
+	types []string
+	files []manifestFile
+}
+
+// copyFile copies the file of entry to w, hashing it on the way.
+func (r *manifestRecorder) copyFile(ctx context.Context, w io.Writer, entry archiveEntry) (int64, error) {
+	h := newHashes(r.types)
+	size, err := copyFile(ctx, io.MultiWriter(w, h), entry.Path)
+	if err != nil {
+		return size, err
+	}
+	r.files = append(r.files, manifestFile{Name: entry.Name, Size: size, Digests: h.Digests()})
+	return size, nil
+}
+
+// Files returns the files hashed so far, sorted by name.
+func (r *manifestRecorder) Files() []manifestFile {
+	files := append([]manifestFile(nil), r.files...)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files
+}
+
+// writeJSON writes v to path as indented JSON.
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// stringKeys returns the generated data of a builder with string keys,
+// which JSON needs.
+func stringKeys(data map[interface{}]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		result[fmt.Sprint(k)] = v
+	}
+	return result
+}
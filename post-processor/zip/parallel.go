@@ -0,0 +1,227 @@
+package zip
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// The size of the blocks the archives are cut into to be compressed
+// in parallel. The blocks are compressed independently, so the output
+// only depends on their size, not on the number of workers.
+const compressBlockSize = 4 << 20
+
+// compressFunc compresses a block, last tells whether it is the last
+// block of the stream.
+type compressFunc func(block []byte, last bool) ([]byte, error)
+
+// deflateBlock compresses blocks which concatenate into a raw deflate
+// stream: every block but the last ends with a sync flush instead of
+// the final block marker, like pigz does.
+func deflateBlock(level int) compressFunc {
+	return func(block []byte, last bool) ([]byte, error) {
+		var out bytes.Buffer
+		fw, err := flate.NewWriter(&out, level)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fw.Write(block); err != nil {
+			return nil, err
+		}
+		if last {
+			err = fw.Close()
+		} else {
+			err = fw.Flush()
+		}
+		return out.Bytes(), err
+	}
+}
+
+// gzipBlock compresses every block into a gzip member, a gzip file
+// can hold several of them.
+func gzipBlock(level int) compressFunc {
+	return func(block []byte, last bool) ([]byte, error) {
+		var out bytes.Buffer
+		gz, err := gzip.NewWriterLevel(&out, level)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := gz.Write(block); err != nil {
+			return nil, err
+		}
+		err = gz.Close()
+		return out.Bytes(), err
+	}
+}
+
+// zstdBlock compresses every block into a zstd frame, with up to
+// workers blocks at once.
+func zstdBlock(level int, workers int) (compressFunc, error) {
+	encoder, err := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+		zstd.WithEncoderConcurrency(workers))
+	if err != nil {
+		return nil, err
+	}
+	return func(block []byte, last bool) ([]byte, error) {
+		return encoder.EncodeAll(block, nil), nil
+	}, nil
+}
+
+// xzBlock compresses every block into an xz stream, an xz file can
+// hold several of them.
+func xzBlock(level int) compressFunc {
+	return func(block []byte, last bool) ([]byte, error) {
+		var out bytes.Buffer
+		xw, err := xz.WriterConfig{DictCap: xzDictCaps[level]}.NewWriter(&out)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := xw.Write(block); err != nil {
+			return nil, err
+		}
+		err = xw.Close()
+		return out.Bytes(), err
+	}
+}
+
+// compressJob is a block on its way through a parallelWriter.
+type compressJob struct {
+	block []byte
+	last  bool
+	out   []byte
+	err   error
+	done  chan struct{}
+}
+
+// parallelWriter compresses what is written to it with compress in
+// blocks of compressBlockSize, using up to workers goroutines, and
+// writes the compressed blocks to w in order. At most inFlight blocks
+// wait to be written, besides the one the writing goroutine holds and
+// the one being filled.
+type parallelWriter struct {
+	w        io.Writer
+	compress compressFunc
+
+	block   []byte
+	jobs    chan *compressJob
+	order   chan *compressJob
+	workers sync.WaitGroup
+	written chan struct{}
+
+	// Written by the writing goroutine, read once it is done or
+	// under mu to fail early
+	mu  sync.Mutex
+	err error
+	n   int64
+}
+
+func newParallelWriter(w io.Writer, compress compressFunc, workers int, inFlight int) *parallelWriter {
+	p := &parallelWriter{
+		w:        w,
+		compress: compress,
+		block:    make([]byte, 0, compressBlockSize),
+		jobs:     make(chan *compressJob, inFlight),
+		order:    make(chan *compressJob, inFlight),
+		written:  make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		p.workers.Add(1)
+		go p.work()
+	}
+	go p.write()
+	return p
+}
+
+func (p *parallelWriter) work() {
+	defer p.workers.Done()
+	for job := range p.jobs {
+		job.out, job.err = p.compress(job.block, job.last)
+		job.block = nil
+		close(job.done)
+	}
+}
+
+func (p *parallelWriter) write() {
+	defer close(p.written)
+	for job := range p.order {
+		<-job.done
+
+		p.mu.Lock()
+		failed := p.err != nil
+		p.mu.Unlock()
+		if failed {
+			continue
+		}
+
+		err := job.err
+		if err == nil {
+			var n int
+			n, err = p.w.Write(job.out)
+			p.mu.Lock()
+			p.n += int64(n)
+			p.mu.Unlock()
+		}
+		if err != nil {
+			p.mu.Lock()
+			p.err = err
+			p.mu.Unlock()
+		}
+	}
+}
+
+func (p *parallelWriter) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *parallelWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		if err := p.failed(); err != nil {
+			return written, err
+		}
+
+		// The full block is only submitted once more data comes,
+		// so the last block is known to be last
+		if len(p.block) == compressBlockSize {
+			p.submit(false)
+		}
+		n := copy(p.block[len(p.block):compressBlockSize], data)
+		p.block = p.block[:len(p.block)+n]
+		data = data[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (p *parallelWriter) submit(last bool) {
+	job := &compressJob{block: p.block, last: last, done: make(chan struct{})}
+	p.order <- job
+	p.jobs <- job
+	p.block = make([]byte, 0, compressBlockSize)
+}
+
+// Close compresses the last block and waits for everything to be
+// written. It does not close w.
+func (p *parallelWriter) Close() error {
+	p.submit(true)
+	close(p.jobs)
+	close(p.order)
+	p.workers.Wait()
+	<-p.written
+	return p.err
+}
+
+// Written returns the number of compressed bytes written to w.
+func (p *parallelWriter) Written() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.n
+}
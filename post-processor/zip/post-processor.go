@@ -4,32 +4,103 @@
 package zip
 
 import (
-	"archive/zip"
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"runtime"
-	"strings"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/hashicorp/hcl/v2/hcldec"
 	"github.com/hashicorp/packer-plugin-sdk/common"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
 	"github.com/hashicorp/packer-plugin-sdk/template/config"
 	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+	"github.com/naveenrajm7/packer-plugin-utm/signature"
 )
 
+// The memory the compression uses by default.
+const defaultMemoryLimit = "512MiB"
+
+// The memory of a block in flight, which holds its data and its
+// compressed copy.
+const blockMemory = 2 * compressBlockSize
+
+// Enough for the block being filled, the block the writer holds and one
+// block waiting for it.
+const minMemoryLimit = compressBlockSize + 2*blockMemory
+
 type Config struct {
 	common.PackerConfig `mapstructure:",squash"`
 
-	// Fields from config file
+	// The path to the archive. This is a template engine, the variables
+	// `BuildName`, `BuilderType` and `BundleName` are available, along with
+	// the data the builder generated. The extension of `format` is appended when the path
+	// has none. Defaults to `packer_{{.BuildName}}_{{.BuilderType}}`.
 	OutputPath string `mapstructure:"output"`
-
-	// Derived fields
-	Archive   string
-	Algorithm string
+	// The archive format: `zip`, `tar`, `tar.gz`, `tar.zst` or `tar.xz`.
+	// Defaults to `zip`.
+	Format string `mapstructure:"format"`
+	// The compression level: from 0 (no compression) to 9 for `zip`,
+	// `tar.gz` and `tar.xz`, from 1 to 22 for `tar.zst`. `tar` is not
+	// compressed. Defaults to 6, or 3 for `tar.zst`. The zstd encoder only
+	// has three levels: 1 and 2 are the fastest, 3 to 5 the default and 6
+	// to 22 all give the same better compression.
+	CompressionLevel *int `mapstructure:"compression_level"`
+	// Glob patterns of the file names to store in a `zip` archive without
+	// compressing them, like `["*.qcow2"]` for disks which are already
+	// compressed. Compressing them again costs time for little gain.
+	Store []string `mapstructure:"store"`
+	// The number of blocks compressed at once. Files are compressed in
+	// blocks of 4MiB, independently of each other so the archive is the
+	// same whatever the parallelism. Defaults to the number of CPUs.
+	Parallelism int `mapstructure:"parallelism"`
+	// The memory the compression may use for its blocks, like `512MiB` or
+	// `2G`, which bounds the number of blocks in flight. It must be at
+	// least 20MiB. Defaults to `512MiB`.
+	MemoryLimit string `mapstructure:"memory_limit"`
+	// Write the same archive for the same bundle contents: the entries are
+	// sorted by name, owned by root, with 0644 or 0755 permissions and the
+	// time of the `SOURCE_DATE_EPOCH` environment variable, or 1980-01-01
+	// when it is not set.
+	Reproducible bool `mapstructure:"reproducible"`
+	// The checksums of the archive to write next to it, as `<output>.<type>`
+	// files which `sha256sum -c` and its siblings check: `md5`, `sha1`,
+	// `sha224`, `sha256`, `sha384` or `sha512`. None by default.
+	ChecksumTypes []string `mapstructure:"checksum_types"`
+	// Write `<output>.manifest.json` next to the archive, with its size and
+	// checksums, the size and checksums of every file of the bundle, the
+	// build name, the UTM version and the data the builder generated. The
+	// checksums are of `checksum_types`, or `sha256` when it is not set.
+	Manifest bool `mapstructure:"manifest"`
+	// When the artifact has several UTM bundles, put them all in one archive.
+	// By default every bundle gets its own archive, and `output` must then
+	// use the `BundleName` variable, the name of the bundle without `.utm`,
+	// to name them apart.
+	Combine bool `mapstructure:"combine"`
+	// Overwrite the archives which already exist. Defaults to the `-force`
+	// flag of `packer build`, without which a build fails when an archive
+	// exists.
+	Force bool `mapstructure:"force"`
+	// Split the archive in parts of at most this size, like `5GB` or
+	// `4GiB`, for stores limiting the size of the files they take. The parts
+	// are `<output>.part01`, `<output>.part02` and so on, which concatenated
+	// in order give the archive, as listed in `<output>.join.json` with their
+	// sizes and checksums. Not split by default.
+	SplitSize string `mapstructure:"split_size"`
+	// The private key to sign the archive and its manifest with: an OpenSSH
+	// key, like the ones of `ssh-keygen -t ed25519`, or an ed25519 PEM key.
+	// The detached signatures are `<output>.sig` and
+	// `<output>.manifest.json.sig`, in the format of `ssh-keygen -Y sign`
+	// with the `file` namespace. Not signed by default.
+	SigningKeyFile string `mapstructure:"signing_key_file"`
+	// The passphrase of `signing_key_file`, when it is encrypted.
+	SigningKeyPassphrase string `mapstructure:"signing_key_passphrase"`
 
 	ctx interpolate.Context
 }
@@ -38,6 +109,14 @@ type Config struct {
 // Creates a zip archive of a given UTM directory (UTM VM bundle)
 type PostProcessor struct {
 	config Config
+
+	// The parsed memory_limit and split_size
+	memoryLimit int64
+	splitSize   int64
+	// Signs the archives when signing_key_file is set
+	signer *signature.Signer
+	// The time of the entries of reproducible archives
+	modTime time.Time
 }
 
 func (p *PostProcessor) ConfigSpec() hcldec.ObjectSpec { return p.config.FlatMapstructure().HCL2Spec() }
@@ -57,20 +136,108 @@ func (p *PostProcessor) Configure(raws ...interface{}) error {
 
 	errs := new(packersdk.MultiError)
 
-	// If there is no explicit number of Go threads to use, then set it
-	if os.Getenv("GOMAXPROCS") == "" {
-		runtime.GOMAXPROCS(runtime.NumCPU())
-	}
-
 	if p.config.OutputPath == "" {
 		p.config.OutputPath = "packer_{{.BuildName}}_{{.BuilderType}}"
 	}
 
+	if p.config.PackerForce {
+		p.config.Force = true
+	}
+
 	if err = interpolate.Validate(p.config.OutputPath, &p.config.ctx); err != nil {
 		errs = packersdk.MultiErrorAppend(
 			errs, fmt.Errorf("Error parsing target template: %s", err))
 	}
 
+	if p.config.Format == "" {
+		p.config.Format = formatZip
+	}
+	format, ok := archiveFormats[p.config.Format]
+	switch {
+	case !ok:
+		errs = packersdk.MultiErrorAppend(
+			errs, fmt.Errorf("format must be one of zip, tar, tar.gz, tar.zst and tar.xz, not %q", p.config.Format))
+	case p.config.CompressionLevel == nil:
+		level := format.DefaultLevel
+		p.config.CompressionLevel = &level
+	case format.MaxLevel == 0:
+		errs = packersdk.MultiErrorAppend(
+			errs, fmt.Errorf("compression_level can't be set for format %s, it is not compressed", p.config.Format))
+	case *p.config.CompressionLevel < format.MinLevel || *p.config.CompressionLevel > format.MaxLevel:
+		errs = packersdk.MultiErrorAppend(
+			errs, fmt.Errorf("compression_level must be between %d and %d for format %s",
+				format.MinLevel, format.MaxLevel, p.config.Format))
+	}
+
+	if len(p.config.Store) > 0 && p.config.Format != formatZip {
+		errs = packersdk.MultiErrorAppend(
+			errs, fmt.Errorf("store only applies to the zip format, %s archives are compressed as a whole", p.config.Format))
+	}
+	for _, pattern := range p.config.Store {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			errs = packersdk.MultiErrorAppend(
+				errs, fmt.Errorf("invalid store pattern %q: %s", pattern, err))
+		}
+	}
+
+	if p.config.Parallelism == 0 {
+		p.config.Parallelism = runtime.NumCPU()
+	} else if p.config.Parallelism < 0 {
+		errs = packersdk.MultiErrorAppend(
+			errs, errors.New("parallelism must be positive"))
+	}
+
+	if p.config.MemoryLimit == "" {
+		p.config.MemoryLimit = defaultMemoryLimit
+	}
+	if limit, err := parseSize(p.config.MemoryLimit); err != nil {
+		errs = packersdk.MultiErrorAppend(
+			errs, fmt.Errorf("invalid memory_limit: %s", err))
+	} else if limit < minMemoryLimit {
+		errs = packersdk.MultiErrorAppend(
+			errs, errors.New("memory_limit must be at least 20MiB, to compress a block while filling the next one"))
+	} else {
+		p.memoryLimit = limit
+	}
+
+	if p.config.SplitSize != "" {
+		if size, err := parseSize(p.config.SplitSize); err != nil {
+			errs = packersdk.MultiErrorAppend(
+				errs, fmt.Errorf("invalid split_size: %s", err))
+		} else if size == 0 {
+			errs = packersdk.MultiErrorAppend(
+				errs, errors.New("split_size must be positive"))
+		} else {
+			p.splitSize = size
+		}
+	}
+
+	if p.config.SigningKeyFile != "" {
+		signer, err := signature.LoadSigner(p.config.SigningKeyFile, p.config.SigningKeyPassphrase)
+		if err != nil {
+			errs = packersdk.MultiErrorAppend(
+				errs, fmt.Errorf("invalid signing_key_file: %s", err))
+		}
+		p.signer = signer
+	}
+
+	for _, checksumType := range p.config.ChecksumTypes {
+		if _, ok := checksumTypes[checksumType]; !ok {
+			errs = packersdk.MultiErrorAppend(
+				errs, fmt.Errorf("unknown checksum type %q, expected md5, sha1, sha224, sha256, sha384 or sha512", checksumType))
+		}
+	}
+
+	p.modTime = reproducibleModTime
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" && p.config.Reproducible {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			errs = packersdk.MultiErrorAppend(
+				errs, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q, expected a number of seconds", epoch))
+		}
+		p.modTime = time.Unix(seconds, 0).UTC()
+	}
+
 	if len(errs.Errors) > 0 {
 		return errs
 	}
@@ -83,6 +250,12 @@ func (p *PostProcessor) PostProcess(
 	ui packersdk.Ui,
 	artifact packersdk.Artifact,
 ) (packersdk.Artifact, bool, bool, error) {
+	if host, ok := artifact.State("utm_host").(string); ok && host != "" {
+		return nil, false, false, fmt.Errorf(
+			"The files of the artifact are on the UTM host %s, they can't be read to create the archive. "+
+				"Run Packer on the UTM host to post-process them.", host)
+	}
+
 	var generatedData map[interface{}]interface{}
 	stateData := artifact.State("generated_data")
 	if stateData != nil {
@@ -95,103 +268,275 @@ func (p *PostProcessor) PostProcess(
 		generatedData = make(map[interface{}]interface{})
 	}
 
+	// The manifest holds what the builder generated, not the variables
+	// added below
+	builderData := stringKeys(generatedData)
+
 	// These are extra variables that will be made available for interpolation.
 	generatedData["BuildName"] = p.config.PackerBuildName
 	generatedData["BuilderType"] = p.config.PackerBuilderType
 	p.config.ctx.Data = generatedData
 
-	target, err := interpolate.Render(p.config.OutputPath, &p.config.ctx)
+	sources, err := findSources(artifact.Files())
 	if err != nil {
-		return nil, false, false, fmt.Errorf("Error interpolating output value: %s", err)
-	} else {
-		fmt.Println(target)
+		return nil, false, false, fmt.Errorf("Error finding what to archive: %s", err)
 	}
 
-	newArtifact := &Artifact{Path: target}
-
-	ui.Say(fmt.Sprintf("Zipping %s", target))
+	// One archive per bundle, unless they are combined
+	groups := [][]archiveSource{sources}
+	if sources[0].Bundle && !p.config.Combine {
+		groups = nil
+		for _, source := range sources {
+			groups = append(groups, []archiveSource{source})
+		}
+	}
 
-	// Find path to UTM directory in our artifact
-	utmDir, err := findUTMDirectory(artifact)
-	// Pass the directory of artifact to create zip archive
-	err = zipDirectory(utmDir, target)
+	var targets []string
+	for _, group := range groups {
+		generatedData["BundleName"] = ""
+		if len(group) == 1 && group[0].Bundle {
+			generatedData["BundleName"] = group[0].BundleName()
+		}
+		target, err := interpolate.Render(p.config.OutputPath, &p.config.ctx)
+		if err != nil {
+			return nil, false, false, fmt.Errorf("Error interpolating output value: %s", err)
+		}
+		target, err = withExtension(target, p.config.Format)
+		if err != nil {
+			return nil, false, false, err
+		}
+		for _, other := range targets {
+			if other == target {
+				return nil, false, false, fmt.Errorf(
+					"The artifact has several bundles, which would all be archived to %s. "+
+						"Use {{.BundleName}} in output, or combine them in one archive with combine.", target)
+			}
+		}
+		existing := []string{target}
+		if p.splitSize > 0 {
+			// Any part left over would be joined with the new ones
+			existing, err = existingParts(target)
+			if err != nil {
+				return nil, false, false, err
+			}
+		}
+		for _, path := range existing {
+			if _, err := os.Stat(path); err == nil && !p.config.Force {
+				return nil, false, false, fmt.Errorf(
+					"Output %s already exists. Use the force flag or set force to overwrite it.", path)
+			}
+		}
+		targets = append(targets, target)
+	}
 
-	if err != nil {
-		return nil, false, false, fmt.Errorf("Error creating zip: %s", err)
+	var utmVersion string
+	if version, ok := artifact.State("utm_version").(string); ok {
+		utmVersion = version
 	}
 
-	ui.Say(fmt.Sprintf("Archive %s completed", target))
+	newArtifact := &Artifact{}
+	for i, group := range groups {
+		archive, err := p.archive(ctx, ui, group, targets[i], builderData, utmVersion)
+		if err != nil {
+			return nil, false, false, err
+		}
+		newArtifact.Archives = append(newArtifact.Archives, archive)
+	}
 
 	return newArtifact, false, false, nil
 }
 
-func findUTMDirectory(artifact packersdk.Artifact) (string, error) {
-	for _, file := range artifact.Files() {
-		if idx := strings.Index(file, ".utm/"); idx != -1 {
-			return file[:idx+4], nil // +4 to include ".utm"
-		}
+// archive writes the sources to the archive target, with its checksum
+// files and its manifest.
+func (p *PostProcessor) archive(ctx context.Context, ui packersdk.Ui, sources []archiveSource, target string,
+	builderData map[string]interface{}, utmVersion string) (*Archive, error) {
+	ui.Say(fmt.Sprintf("Archiving %s (%s)", target, p.config.Format))
+
+	var recorder *manifestRecorder
+	if p.config.Manifest {
+		recorder = &manifestRecorder{types: p.digestTypes()}
 	}
-	return "", errors.New("no .utm directory found")
-}
 
-func zipDirectory(sourceDir, zipFile string) error {
-	// Create a new zip file
-	zipfile, err := os.Create(zipFile)
+	written, parts, err := p.archiveSources(ctx, ui, sources, target, recorder)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Error creating archive: %s", err)
 	}
-	defer zipfile.Close()
 
-	// Create a new zip writer
-	zipWriter := zip.NewWriter(zipfile)
-	defer zipWriter.Close()
+	ui.Say(fmt.Sprintf("Archive %s completed", target))
 
-	// Walk through the source directory
-	return filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+	archive := &Archive{Path: target, Digests: written.Digests}
+	for _, part := range parts {
+		archive.Parts = append(archive.Parts, filepath.Join(filepath.Dir(target), part.Name))
+	}
+
+	// The checksums of the archive, and of its parts
+	for _, checksumType := range p.config.ChecksumTypes {
+		path, err := writeChecksumFile(target, checksumType, written.Digests[checksumType])
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("Error writing checksum: %s", err)
+		}
+		archive.ChecksumFiles = append(archive.ChecksumFiles, path)
+	}
+	for i, part := range parts {
+		for _, checksumType := range p.config.ChecksumTypes {
+			path, err := writeChecksumFile(archive.Parts[i], checksumType, part.Digests[checksumType])
+			if err != nil {
+				return nil, fmt.Errorf("Error writing checksum: %s", err)
+			}
+			archive.ChecksumFiles = append(archive.ChecksumFiles, path)
 		}
+	}
 
-		// Create a zip header
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
-			return err
+	if len(parts) > 0 {
+		path := target + ".join.json"
+		if err := writeJSON(path, &joinManifest{Archive: *written, Parts: parts}); err != nil {
+			return nil, fmt.Errorf("Error writing join manifest: %s", err)
 		}
+		archive.JoinManifest = path
+	}
 
-		// Set the header name to the relative path
-		header.Name, err = filepath.Rel(filepath.Dir(sourceDir), path)
-		if err != nil {
-			return err
+	if recorder != nil {
+		m := &manifest{
+			BuildName:     p.config.PackerBuildName,
+			BuilderType:   p.config.PackerBuilderType,
+			UTMVersion:    utmVersion,
+			GeneratedData: builderData,
+			Archive:       *written,
+			Parts:         parts,
+			Files:         recorder.Files(),
+		}
+		path := target + ".manifest.json"
+		if err := writeJSON(path, m); err != nil {
+			return nil, fmt.Errorf("Error writing manifest: %s", err)
 		}
+		archive.Manifest = path
+	}
 
-		// If the file is a directory, add a trailing slash to the header name
-		if info.IsDir() {
-			header.Name += "/"
-		} else {
-			// Set the method to deflate for files
-			header.Method = zip.Deflate
+	if p.signer != nil {
+		if err := p.sign(archive, written); err != nil {
+			return nil, fmt.Errorf("Error signing archive: %s", err)
 		}
+	}
+
+	return archive, nil
+}
 
-		// Create a writer for the file in the zip archive
-		writer, err := zipWriter.CreateHeader(header)
+// sign writes the signatures of the archive, from its digest as the
+// parts may be all there is of it, and of its manifest.
+func (p *PostProcessor) sign(archive *Archive, written *manifestFile) error {
+	digest, err := hex.DecodeString(written.Digests[signatureChecksum])
+	if err != nil {
+		return err
+	}
+	sig, err := p.signer.SignDigest(digest)
+	if err != nil {
+		return err
+	}
+	path := archive.Path + signature.Extension
+	if err := os.WriteFile(path, sig, 0644); err != nil {
+		return err
+	}
+	archive.Signatures = append(archive.Signatures, path)
+
+	if archive.Manifest != "" {
+		path, err := p.signer.SignFile(archive.Manifest)
 		if err != nil {
 			return err
 		}
+		archive.Signatures = append(archive.Signatures, path)
+	}
+	return nil
+}
 
-		// If the file is not a directory, copy its contents to the zip writer
-		if !info.IsDir() {
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
+// digestTypes returns the checksum types of the archive to compute: the
+// ones to write, or the one of the manifests.
+func (p *PostProcessor) digestTypes() []string {
+	if len(p.config.ChecksumTypes) == 0 && (p.config.Manifest || p.splitSize > 0) {
+		return []string{defaultManifestChecksum}
+	}
+	return p.config.ChecksumTypes
+}
 
-			_, err = io.Copy(writer, file)
-			if err != nil {
-				return err
+// archiveSources writes the sources to the archive target, and returns
+// its size and digests, with the ones of its parts when it is split.
+// The files archived are recorded in recorder, unless it is nil. The
+// progress shows in a progress bar of ui. The archive is removed when
+// it fails, or when ctx is done.
+func (p *PostProcessor) archiveSources(ctx context.Context, ui packersdk.Ui, sources []archiveSource,
+	target string, recorder *manifestRecorder) (*manifestFile, []manifestFile, error) {
+	entries, err := collectEntries(sources)
+	if err != nil {
+		return nil, nil, err
+	}
+	var total int64
+	for _, entry := range entries {
+		if entry.Info.Mode().IsRegular() {
+			total += entry.Info.Size()
+		}
+	}
+
+	var out io.WriteCloser
+	var split *splitWriter
+	if p.splitSize > 0 {
+		parts, err := existingParts(target)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, part := range parts {
+			if err := os.Remove(part); err != nil {
+				return nil, nil, err
 			}
 		}
+		split = newSplitWriter(target, p.splitSize, p.digestTypes())
+		out = split
+	} else {
+		file, err := os.Create(target)
+		if err != nil {
+			return nil, nil, err
+		}
+		out = file
+	}
 
-		return nil
+	progress := newProgressWriter(func(stream io.ReadCloser) io.ReadCloser {
+		return ui.TrackProgress(filepath.Base(target), 0, total, stream)
 	})
+	opts := &archiveOptions{
+		Format: p.config.Format,
+		Level:  *p.config.CompressionLevel,
+		Store:  p.config.Store,
+
+		Reproducible: p.config.Reproducible,
+		ModTime:      p.modTime,
+		Manifest:     recorder,
+		Progress:     progress,
+	}
+	// Besides the blocks in flight, the writer holds one and one is filled
+	opts.InFlight = int((p.memoryLimit-compressBlockSize)/blockMemory) - 1
+	opts.Workers = min(p.config.Parallelism, opts.InFlight)
+
+	// The archive is hashed as it is written, for the signature as well
+	types := p.digestTypes()
+	if p.signer != nil && !slices.Contains(types, signatureChecksum) {
+		types = append(types, signatureChecksum)
+	}
+	h := newHashes(types)
+	err = writeArchive(ctx, io.MultiWriter(out, h), entries, opts)
+	progress.Close()
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if split != nil {
+			split.Remove()
+		} else {
+			os.Remove(target)
+		}
+		return nil, nil, err
+	}
+
+	written := &manifestFile{Name: filepath.Base(target), Size: h.size, Digests: h.Digests()}
+	if split != nil {
+		return written, split.Parts, nil
+	}
+	return written, nil, nil
 }
@@ -10,17 +10,28 @@ import (
 // FlatConfig is an auto-generated flat version of Config.
 // Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
 type FlatConfig struct {
-	PackerBuildName     *string           `mapstructure:"packer_build_name" cty:"packer_build_name" hcl:"packer_build_name"`
-	PackerBuilderType   *string           `mapstructure:"packer_builder_type" cty:"packer_builder_type" hcl:"packer_builder_type"`
-	PackerCoreVersion   *string           `mapstructure:"packer_core_version" cty:"packer_core_version" hcl:"packer_core_version"`
-	PackerDebug         *bool             `mapstructure:"packer_debug" cty:"packer_debug" hcl:"packer_debug"`
-	PackerForce         *bool             `mapstructure:"packer_force" cty:"packer_force" hcl:"packer_force"`
-	PackerOnError       *string           `mapstructure:"packer_on_error" cty:"packer_on_error" hcl:"packer_on_error"`
-	PackerUserVars      map[string]string `mapstructure:"packer_user_variables" cty:"packer_user_variables" hcl:"packer_user_variables"`
-	PackerSensitiveVars []string          `mapstructure:"packer_sensitive_variables" cty:"packer_sensitive_variables" hcl:"packer_sensitive_variables"`
-	OutputPath          *string           `mapstructure:"output" cty:"output" hcl:"output"`
-	Archive             *string           `cty:"archive" hcl:"archive"`
-	Algorithm           *string           `cty:"algorithm" hcl:"algorithm"`
+	PackerBuildName      *string           `mapstructure:"packer_build_name" cty:"packer_build_name" hcl:"packer_build_name"`
+	PackerBuilderType    *string           `mapstructure:"packer_builder_type" cty:"packer_builder_type" hcl:"packer_builder_type"`
+	PackerCoreVersion    *string           `mapstructure:"packer_core_version" cty:"packer_core_version" hcl:"packer_core_version"`
+	PackerDebug          *bool             `mapstructure:"packer_debug" cty:"packer_debug" hcl:"packer_debug"`
+	PackerForce          *bool             `mapstructure:"packer_force" cty:"packer_force" hcl:"packer_force"`
+	PackerOnError        *string           `mapstructure:"packer_on_error" cty:"packer_on_error" hcl:"packer_on_error"`
+	PackerUserVars       map[string]string `mapstructure:"packer_user_variables" cty:"packer_user_variables" hcl:"packer_user_variables"`
+	PackerSensitiveVars  []string          `mapstructure:"packer_sensitive_variables" cty:"packer_sensitive_variables" hcl:"packer_sensitive_variables"`
+	OutputPath           *string           `mapstructure:"output" cty:"output" hcl:"output"`
+	Format               *string           `mapstructure:"format" cty:"format" hcl:"format"`
+	CompressionLevel     *int              `mapstructure:"compression_level" cty:"compression_level" hcl:"compression_level"`
+	Store                []string          `mapstructure:"store" cty:"store" hcl:"store"`
+	Parallelism          *int              `mapstructure:"parallelism" cty:"parallelism" hcl:"parallelism"`
+	MemoryLimit          *string           `mapstructure:"memory_limit" cty:"memory_limit" hcl:"memory_limit"`
+	Reproducible         *bool             `mapstructure:"reproducible" cty:"reproducible" hcl:"reproducible"`
+	ChecksumTypes        []string          `mapstructure:"checksum_types" cty:"checksum_types" hcl:"checksum_types"`
+	Manifest             *bool             `mapstructure:"manifest" cty:"manifest" hcl:"manifest"`
+	Combine              *bool             `mapstructure:"combine" cty:"combine" hcl:"combine"`
+	Force                *bool             `mapstructure:"force" cty:"force" hcl:"force"`
+	SplitSize            *string           `mapstructure:"split_size" cty:"split_size" hcl:"split_size"`
+	SigningKeyFile       *string           `mapstructure:"signing_key_file" cty:"signing_key_file" hcl:"signing_key_file"`
+	SigningKeyPassphrase *string           `mapstructure:"signing_key_passphrase" cty:"signing_key_passphrase" hcl:"signing_key_passphrase"`
 }
 
 // FlatMapstructure returns a new FlatConfig.
@@ -44,8 +55,19 @@ func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 		"packer_user_variables":      &hcldec.AttrSpec{Name: "packer_user_variables", Type: cty.Map(cty.String), Required: false},
 		"packer_sensitive_variables": &hcldec.AttrSpec{Name: "packer_sensitive_variables", Type: cty.List(cty.String), Required: false},
 		"output":                     &hcldec.AttrSpec{Name: "output", Type: cty.String, Required: false},
-		"archive":                    &hcldec.AttrSpec{Name: "archive", Type: cty.String, Required: false},
-		"algorithm":                  &hcldec.AttrSpec{Name: "algorithm", Type: cty.String, Required: false},
+		"format":                     &hcldec.AttrSpec{Name: "format", Type: cty.String, Required: false},
+		"compression_level":          &hcldec.AttrSpec{Name: "compression_level", Type: cty.Number, Required: false},
+		"store":                      &hcldec.AttrSpec{Name: "store", Type: cty.List(cty.String), Required: false},
+		"parallelism":                &hcldec.AttrSpec{Name: "parallelism", Type: cty.Number, Required: false},
+		"memory_limit":               &hcldec.AttrSpec{Name: "memory_limit", Type: cty.String, Required: false},
+		"reproducible":               &hcldec.AttrSpec{Name: "reproducible", Type: cty.Bool, Required: false},
+		"checksum_types":             &hcldec.AttrSpec{Name: "checksum_types", Type: cty.List(cty.String), Required: false},
+		"manifest":                   &hcldec.AttrSpec{Name: "manifest", Type: cty.Bool, Required: false},
+		"combine":                    &hcldec.AttrSpec{Name: "combine", Type: cty.Bool, Required: false},
+		"force":                      &hcldec.AttrSpec{Name: "force", Type: cty.Bool, Required: false},
+		"split_size":                 &hcldec.AttrSpec{Name: "split_size", Type: cty.String, Required: false},
+		"signing_key_file":           &hcldec.AttrSpec{Name: "signing_key_file", Type: cty.String, Required: false},
+		"signing_key_passphrase":     &hcldec.AttrSpec{Name: "signing_key_passphrase", Type: cty.String, Required: false},
 	}
 	return s
 }
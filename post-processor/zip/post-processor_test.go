@@ -0,0 +1,899 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package zip
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/klauspost/compress/zstd"
+	"github.com/naveenrajm7/packer-plugin-utm/signature"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/crypto/ssh"
+)
+
+// testArtifact creates a UTM bundle and returns an artifact with its files.
+func testArtifact(t *testing.T) *packersdk.MockArtifact {
+	bundle := filepath.Join(t.TempDir(), "packer-test.utm")
+	if err := os.MkdirAll(filepath.Join(bundle, "Data"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	files := []string{filepath.Join(bundle, "config.plist"), filepath.Join(bundle, "Data", "disk.qcow2")}
+	for _, file := range files {
+		if err := os.WriteFile(file, bytes.Repeat([]byte(filepath.Base(file)), 100), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	return &packersdk.MockArtifact{FilesValue: files}
+}
+
+func testUi() *packersdk.BasicUi {
+	return &packersdk.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: new(bytes.Buffer),
+		PB:     new(packersdk.NoopProgressTracker),
+	}
+}
+
+// testProgressTracker records the progress bars and what was read
+// through them.
+type testProgressTracker struct {
+	totals map[string]int64
+	read   map[string]int64
+	closed map[string]bool
+}
+
+func (p *testProgressTracker) TrackProgress(src string, currentSize, totalSize int64, stream io.ReadCloser) io.ReadCloser {
+	p.totals[src] = totalSize
+	return &testProgressStream{ReadCloser: stream, tracker: p, src: src}
+}
+
+type testProgressStream struct {
+	io.ReadCloser
+	tracker *testProgressTracker
+	src     string
+}
+
+func (s *testProgressStream) Read(b []byte) (int, error) {
+	n, err := s.ReadCloser.Read(b)
+	s.tracker.read[s.src] += int64(n)
+	return n, err
+}
+
+func (s *testProgressStream) Close() error {
+	s.tracker.closed[s.src] = true
+	return s.ReadCloser.Close()
+}
+
+func testPostProcess(t *testing.T, cfg map[string]interface{}) packersdk.Artifact {
+	var p PostProcessor
+	if err := p.Configure(cfg); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ui := testUi()
+	artifact, _, _, err := p.PostProcess(context.Background(), ui, testArtifact(t))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return artifact
+}
+
+// readArchive returns the contents of the regular files of an archive by name.
+func readArchive(t *testing.T, path string, format string) map[string]string {
+	files := map[string]string{}
+	if format == formatZip {
+		r, err := zip.OpenReader(path)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			files[f.Name] = string(data)
+		}
+		return files
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer file.Close()
+	var r io.Reader = file
+	switch format {
+	case formatTarGz:
+		r, err = gzip.NewReader(file)
+	case formatTarZst:
+		r, err = zstd.NewReader(file)
+	case formatTarXz:
+		r, err = xz.NewReader(file)
+	}
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			files[header.Name] = string(data)
+		}
+	}
+	return files
+}
+
+func TestPostProcessor_impl(t *testing.T) {
+	var _ packersdk.PostProcessor = new(PostProcessor)
+}
+
+func TestPostProcessor_Configure(t *testing.T) {
+	for _, cfg := range []map[string]interface{}{
+		{"format": "rar"},
+		{"format": "tar", "compression_level": 1},
+		{"format": "tar.zst", "compression_level": 0},
+		{"format": "zip", "compression_level": 10},
+		{"format": "tar.gz", "store": []string{"*.qcow2"}},
+		{"store": []string{"["}},
+		{"parallelism": -1},
+		{"memory_limit": "lots"},
+		{"memory_limit": "8MiB"},
+		{"checksum_types": []string{"crc32"}},
+		{"split_size": "0"},
+		{"split_size": "big"},
+		{"signing_key_file": "missing.key"},
+	} {
+		var p PostProcessor
+		if err := p.Configure(cfg); err == nil {
+			t.Fatalf("should error: %#v", cfg)
+		}
+	}
+
+	var p PostProcessor
+	if err := p.Configure(map[string]interface{}{"format": "tar.zst"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if *p.config.CompressionLevel != 3 {
+		t.Fatalf("bad compression_level: %d", *p.config.CompressionLevel)
+	}
+}
+
+func TestPostProcessor_Formats(t *testing.T) {
+	expected := map[string]string{
+		"packer-test.utm/config.plist":    string(bytes.Repeat([]byte("config.plist"), 100)),
+		"packer-test.utm/Data/disk.qcow2": string(bytes.Repeat([]byte("disk.qcow2"), 100)),
+	}
+	for _, format := range []string{formatZip, formatTar, formatTarGz, formatTarZst, formatTarXz} {
+		t.Run(format, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "test")
+			artifact := testPostProcess(t, map[string]interface{}{
+				"output": output,
+				"format": format,
+			})
+
+			// The extension is inferred from the format
+			path := output + "." + format
+			if !reflect.DeepEqual(artifact.Files(), []string{path}) {
+				t.Fatalf("bad files: %#v", artifact.Files())
+			}
+			if files := readArchive(t, path, format); !reflect.DeepEqual(files, expected) {
+				t.Fatalf("bad archive: %#v", files)
+			}
+		})
+	}
+}
+
+// testBundles returns an artifact with the files of two UTM bundles.
+func testBundles(t *testing.T) *packersdk.MockArtifact {
+	dir := t.TempDir()
+	var files []string
+	for _, name := range []string{"first.utm", "second.utm"} {
+		bundle := filepath.Join(dir, name)
+		if err := os.MkdirAll(bundle, 0755); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		file := filepath.Join(bundle, "config.plist")
+		if err := os.WriteFile(file, []byte(name), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		files = append(files, file)
+	}
+	return &packersdk.MockArtifact{FilesValue: files}
+}
+
+func TestPostProcessor_Bundles(t *testing.T) {
+	ui := testUi()
+	dir := t.TempDir()
+
+	// An archive per bundle
+	var p PostProcessor
+	if err := p.Configure(map[string]interface{}{"output": filepath.Join(dir, "{{.BundleName}}")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	artifact, _, _, err := p.PostProcess(context.Background(), ui, testBundles(t))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	expected := []string{filepath.Join(dir, "first.zip"), filepath.Join(dir, "second.zip")}
+	if !reflect.DeepEqual(artifact.Files(), expected) {
+		t.Fatalf("bad files: %#v", artifact.Files())
+	}
+	if files := readArchive(t, expected[1], formatZip); !reflect.DeepEqual(files, map[string]string{
+		"second.utm/config.plist": "second.utm",
+	}) {
+		t.Fatalf("bad archive: %#v", files)
+	}
+	// The state has the same type as with one archive
+	if digests, ok := artifact.State("digests").(map[string]map[string]string); !ok || len(digests) != 2 {
+		t.Fatalf("bad digests: %#v", artifact.State("digests"))
+	}
+	if manifests, ok := artifact.State("manifest").([]string); !ok || len(manifests) != 0 {
+		t.Fatalf("bad manifest: %#v", artifact.State("manifest"))
+	}
+
+	// The archives can't have the same path
+	p = PostProcessor{}
+	if err := p.Configure(map[string]interface{}{"output": filepath.Join(dir, "same")}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, _, _, err := p.PostProcess(context.Background(), ui, testBundles(t)); err == nil {
+		t.Fatal("should error")
+	}
+
+	// One combined archive
+	output := filepath.Join(dir, "combined.zip")
+	p = PostProcessor{}
+	if err := p.Configure(map[string]interface{}{"output": output, "combine": true}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, _, _, err := p.PostProcess(context.Background(), ui, testBundles(t)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if files := readArchive(t, output, formatZip); !reflect.DeepEqual(files, map[string]string{
+		"first.utm/config.plist":  "first.utm",
+		"second.utm/config.plist": "second.utm",
+	}) {
+		t.Fatalf("bad archive: %#v", files)
+	}
+}
+
+func TestPostProcessor_OtherArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "output", "logs"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	disk := filepath.Join(dir, "output", "disk.img")
+	log := filepath.Join(dir, "output", "logs", "build.log")
+	for _, file := range []string{disk, log} {
+		if err := os.WriteFile(file, []byte(filepath.Base(file)), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		Files    []string
+		Expected map[string]string
+	}{
+		// A single file
+		{[]string{disk}, map[string]string{"disk.img": "disk.img"}},
+		// Files, named relative to their directory
+		{[]string{disk, log}, map[string]string{"disk.img": "disk.img", "logs/build.log": "build.log"}},
+		// A directory
+		{[]string{filepath.Join(dir, "output")}, map[string]string{
+			"output/disk.img": "disk.img", "output/logs/build.log": "build.log",
+		}},
+	} {
+		var p PostProcessor
+		output := filepath.Join(t.TempDir(), "test.zip")
+		if err := p.Configure(map[string]interface{}{"output": output}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		ui := testUi()
+		source := &packersdk.MockArtifact{FilesValue: tc.Files}
+		if _, _, _, err := p.PostProcess(context.Background(), ui, source); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if files := readArchive(t, output, formatZip); !reflect.DeepEqual(files, tc.Expected) {
+			t.Fatalf("bad archive of %#v: %#v", tc.Files, files)
+		}
+	}
+
+	// Nothing to archive
+	for _, files := range [][]string{{}, {filepath.Join(dir, "missing")}} {
+		var p PostProcessor
+		if err := p.Configure(map[string]interface{}{"output": filepath.Join(t.TempDir(), "test")}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		ui := testUi()
+		source := &packersdk.MockArtifact{FilesValue: files}
+		if _, _, _, err := p.PostProcess(context.Background(), ui, source); err == nil {
+			t.Fatalf("should error: %#v", files)
+		}
+	}
+}
+
+func TestPostProcessor_Parallelism(t *testing.T) {
+	// A disk spanning several blocks, half random so it does not
+	// compress to nothing
+	data := make([]byte, 2*compressBlockSize+compressBlockSize/4)
+	rand.New(rand.NewSource(1)).Read(data[:len(data)/2])
+	copy(data[len(data)/2:], bytes.Repeat([]byte("disk"), len(data)/8))
+
+	bundle := filepath.Join(t.TempDir(), "packer-test.utm")
+	if err := os.MkdirAll(bundle, 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	disk := filepath.Join(bundle, "disk.qcow2")
+	if err := os.WriteFile(disk, data, 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	source := &packersdk.MockArtifact{FilesValue: []string{disk}}
+
+	for _, format := range []string{formatZip, formatTarGz, formatTarZst, formatTarXz} {
+		t.Run(format, func(t *testing.T) {
+			var archives [][]byte
+			for _, parallelism := range []int{1, 8} {
+				var p PostProcessor
+				output := filepath.Join(t.TempDir(), "test")
+				err := p.Configure(map[string]interface{}{
+					"output":            output,
+					"format":            format,
+					"compression_level": 1,
+					"parallelism":       parallelism,
+					"memory_limit":      "36MiB",
+				})
+				if err != nil {
+					t.Fatalf("err: %s", err)
+				}
+				ui := testUi()
+				artifact, _, _, err := p.PostProcess(context.Background(), ui, source)
+				if err != nil {
+					t.Fatalf("err: %s", err)
+				}
+
+				path := artifact.Files()[0]
+				files := readArchive(t, path, format)
+				if files["packer-test.utm/disk.qcow2"] != string(data) {
+					t.Fatalf("bad disk in archive with parallelism %d", parallelism)
+				}
+				archive, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatalf("err: %s", err)
+				}
+				archives = append(archives, archive)
+			}
+
+			if !bytes.Equal(archives[0], archives[1]) {
+				t.Fatal("the archive depends on the parallelism")
+			}
+		})
+	}
+}
+
+func TestPostProcessor_Reproducible(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+
+	// Two bundles with the same contents, but not the same times and
+	// permissions
+	first, second := testArtifact(t), testArtifact(t)
+	for _, file := range second.FilesValue {
+		if err := os.Chmod(file, 0600); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := os.Chtimes(file, time.Now(), time.Now().Add(-time.Hour)); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	for _, format := range []string{formatZip, formatTar, formatTarGz} {
+		t.Run(format, func(t *testing.T) {
+			var archives [][]byte
+			for _, source := range []*packersdk.MockArtifact{first, second} {
+				var p PostProcessor
+				err := p.Configure(map[string]interface{}{
+					"output":       filepath.Join(t.TempDir(), "test"),
+					"format":       format,
+					"reproducible": true,
+				})
+				if err != nil {
+					t.Fatalf("err: %s", err)
+				}
+				ui := testUi()
+				artifact, _, _, err := p.PostProcess(context.Background(), ui, source)
+				if err != nil {
+					t.Fatalf("err: %s", err)
+				}
+				archive, err := os.ReadFile(artifact.Files()[0])
+				if err != nil {
+					t.Fatalf("err: %s", err)
+				}
+				archives = append(archives, archive)
+			}
+
+			if !bytes.Equal(archives[0], archives[1]) {
+				t.Fatal("the archives of the same contents differ")
+			}
+		})
+	}
+
+	// The entries have the time of SOURCE_DATE_EPOCH
+	output := filepath.Join(t.TempDir(), "test.zip")
+	testPostProcess(t, map[string]interface{}{"output": output, "reproducible": true})
+	r, err := zip.OpenReader(output)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if f.Modified.Unix() != 1700000000 || f.Mode().Perm()&0022 != 0 {
+			t.Fatalf("bad entry %s: %s %s", f.Name, f.Modified, f.Mode())
+		}
+	}
+
+	t.Setenv("SOURCE_DATE_EPOCH", "yesterday")
+	var p PostProcessor
+	if err := p.Configure(map[string]interface{}{"reproducible": true}); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestPostProcessor_Store(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "test.zip")
+	testPostProcess(t, map[string]interface{}{
+		"output": output,
+		"store":  []string{"*.qcow2"},
+	})
+
+	r, err := zip.OpenReader(output)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer r.Close()
+	methods := map[string]uint16{}
+	for _, f := range r.File {
+		methods[f.Name] = f.Method
+	}
+	if methods["packer-test.utm/Data/disk.qcow2"] != zip.Store || methods["packer-test.utm/config.plist"] != zip.Deflate {
+		t.Fatalf("bad methods: %#v", methods)
+	}
+}
+
+func TestPostProcessor_NonASCIINames(t *testing.T) {
+	bundle := filepath.Join(t.TempDir(), "café.utm")
+	if err := os.MkdirAll(filepath.Join(bundle, "Data"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	disk := filepath.Join(bundle, "Data", "disque-système.qcow2")
+	if err := os.WriteFile(disk, []byte("disk"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var p PostProcessor
+	output := filepath.Join(t.TempDir(), "test.zip")
+	if err := p.Configure(map[string]interface{}{"output": output}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	source := &packersdk.MockArtifact{FilesValue: []string{disk}}
+	if _, _, _, err := p.PostProcess(context.Background(), testUi(), source); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	r, err := zip.OpenReader(output)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer r.Close()
+	found := false
+	for _, f := range r.File {
+		// Unflagged names are read as CP437 by other tools
+		if f.NonUTF8 || f.Flags&0x800 == 0 {
+			t.Fatalf("name not flagged as UTF-8: %q", f.Name)
+		}
+		found = found || f.Name == "café.utm/Data/disque-système.qcow2"
+	}
+	if !found {
+		t.Fatal("the file should be archived")
+	}
+}
+
+func TestPostProcessor_Checksums(t *testing.T) {
+	source := testArtifact(t)
+	source.StateValues = map[string]interface{}{
+		"generated_data": map[interface{}]interface{}{"SourceVM": "source"},
+		"utm_version":    "4.6.4",
+	}
+
+	var p PostProcessor
+	output := filepath.Join(t.TempDir(), "test.zip")
+	err := p.Configure(map[string]interface{}{
+		"output":            output,
+		"checksum_types":    []string{"sha256", "md5"},
+		"manifest":          true,
+		"packer_build_name": "test",
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ui := testUi()
+	artifact, _, _, err := p.PostProcess(context.Background(), ui, source)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{output, output + ".sha256", output + ".md5", output + ".manifest.json"}
+	if !reflect.DeepEqual(artifact.Files(), expected) {
+		t.Fatalf("bad files: %#v", artifact.Files())
+	}
+
+	archive, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	sha := sha256.Sum256(archive)
+	md := md5.Sum(archive)
+	digests := map[string]string{"sha256": hex.EncodeToString(sha[:]), "md5": hex.EncodeToString(md[:])}
+	if !reflect.DeepEqual(artifact.State("digests"), map[string]map[string]string{"test.zip": digests}) {
+		t.Fatalf("bad digests: %#v", artifact.State("digests"))
+	}
+	if !reflect.DeepEqual(artifact.State("manifest"), []string{output + ".manifest.json"}) {
+		t.Fatalf("bad manifest: %#v", artifact.State("manifest"))
+	}
+
+	// The checksum files are in the format of sha256sum
+	checksum, err := os.ReadFile(output + ".sha256")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(checksum) != fmt.Sprintf("%s  test.zip\n", digests["sha256"]) {
+		t.Fatalf("bad checksum file: %q", checksum)
+	}
+
+	data, err := os.ReadFile(output + ".manifest.json")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if m.BuildName != "test" || m.UTMVersion != "4.6.4" || m.GeneratedData["SourceVM"] != "source" {
+		t.Fatalf("bad manifest: %s", data)
+	}
+	if m.Archive.Name != "test.zip" || m.Archive.Size != int64(len(archive)) || !reflect.DeepEqual(m.Archive.Digests, digests) {
+		t.Fatalf("bad archive in manifest: %#v", m.Archive)
+	}
+	plist := bytes.Repeat([]byte("config.plist"), 100)
+	plistSha := sha256.Sum256(plist)
+	plistMd := md5.Sum(plist)
+	if len(m.Files) != 2 || !reflect.DeepEqual(m.Files[1], manifestFile{
+		Name:    "packer-test.utm/config.plist",
+		Size:    int64(len(plist)),
+		Digests: map[string]string{"sha256": hex.EncodeToString(plistSha[:]), "md5": hex.EncodeToString(plistMd[:])},
+	}) {
+		t.Fatalf("bad files in manifest: %#v", m.Files)
+	}
+}
+
+func TestPostProcessor_Split(t *testing.T) {
+	source := testArtifact(t)
+	dir := t.TempDir()
+
+	var p PostProcessor
+	if err := p.Configure(map[string]interface{}{"output": filepath.Join(dir, "whole"), "format": "tar"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	whole, _, _, err := p.PostProcess(context.Background(), testUi(), source)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	archive, err := os.ReadFile(whole.Files()[0])
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	p = PostProcessor{}
+	output := filepath.Join(dir, "split.tar")
+	err = p.Configure(map[string]interface{}{
+		"output":         output,
+		"format":         "tar",
+		"split_size":     "1KB",
+		"checksum_types": []string{"sha256"},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	artifact, _, _, err := p.PostProcess(context.Background(), testUi(), source)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	data, err := os.ReadFile(output + ".join.json")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var join joinManifest
+	if err := json.Unmarshal(data, &join); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	count := (len(archive) + 999) / 1000
+	if len(join.Parts) != count || join.Archive.Size != int64(len(archive)) {
+		t.Fatalf("bad join manifest: %s", data)
+	}
+
+	// The parts concatenated in order are the archive
+	var joined []byte
+	var parts, checksums []string
+	for i, part := range join.Parts {
+		path := filepath.Join(dir, part.Name)
+		if path != partPath(output, i+1) {
+			t.Fatalf("bad part name: %s", part.Name)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		sum := sha256.Sum256(content)
+		if part.Size != int64(len(content)) || part.Digests["sha256"] != hex.EncodeToString(sum[:]) {
+			t.Fatalf("bad part %s: %#v", part.Name, part)
+		}
+		if len(content) > 1000 {
+			t.Fatalf("part %s is too large: %d", part.Name, len(content))
+		}
+		joined = append(joined, content...)
+		parts = append(parts, path)
+		checksums = append(checksums, path+".sha256")
+	}
+	if !bytes.Equal(joined, archive) {
+		t.Fatal("the parts do not join into the archive")
+	}
+
+	// The checksum of the archive comes before the ones of the parts
+	expected := append(parts, output+".sha256")
+	expected = append(expected, checksums...)
+	expected = append(expected, output+".join.json")
+	if !reflect.DeepEqual(artifact.Files(), expected) {
+		t.Fatalf("bad files: %#v", artifact.Files())
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatalf("the whole archive should not be written: %v", err)
+	}
+
+	// The parts of an earlier larger archive are not left over
+	if err := artifact.Destroy(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	stale := partPath(output, count+1)
+	for _, path := range []string{stale, stale + ".sha256"} {
+		if err := os.WriteFile(path, []byte("stale"), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if _, _, _, err := p.PostProcess(context.Background(), testUi(), source); err == nil ||
+		!strings.Contains(err.Error(), stale) {
+		t.Fatalf("should error without force: %v", err)
+	}
+	p.config.Force = true
+	if _, _, _, err := p.PostProcess(context.Background(), testUi(), source); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, path := range []string{stale, stale + ".sha256"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s should be removed: %v", path, err)
+		}
+	}
+}
+
+func TestPostProcessor_Sign(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	publicKey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, splitSize := range []string{"", "1KB"} {
+		output := filepath.Join(t.TempDir(), "test.tar")
+		artifact := testPostProcess(t, map[string]interface{}{
+			"output":           output,
+			"format":           "tar",
+			"manifest":         true,
+			"split_size":       splitSize,
+			"signing_key_file": keyFile,
+		})
+
+		files := artifact.Files()
+		if !reflect.DeepEqual(files[len(files)-2:], []string{output + ".sig", output + ".manifest.json.sig"}) {
+			t.Fatalf("bad files: %#v", files)
+		}
+		if err := signature.VerifyFile(publicKey, output+".manifest.json"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		// The signature is of the whole archive, split or not
+		var archive []byte
+		for _, file := range files {
+			if file == output || strings.HasPrefix(file, output+".part") {
+				data, err := os.ReadFile(file)
+				if err != nil {
+					t.Fatalf("err: %s", err)
+				}
+				archive = append(archive, data...)
+			}
+		}
+		sig, err := os.ReadFile(output + ".sig")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := signature.Verify(publicKey, bytes.NewReader(archive), sig); err != nil {
+			t.Fatalf("bad signature with split_size %q: %s", splitSize, err)
+		}
+	}
+}
+
+func TestPostProcessor_Progress(t *testing.T) {
+	var p PostProcessor
+	output := filepath.Join(t.TempDir(), "test.tar.gz")
+	if err := p.Configure(map[string]interface{}{"output": output, "format": "tar.gz"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	tracker := &testProgressTracker{totals: map[string]int64{}, read: map[string]int64{}, closed: map[string]bool{}}
+	ui := testUi()
+	ui.PB = tracker
+	if _, _, _, err := p.PostProcess(context.Background(), ui, testArtifact(t)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The bar goes through the bytes of the files of the bundle
+	size := int64(len("config.plist")*100 + len("disk.qcow2")*100)
+	if tracker.totals["test.tar.gz"] != size || tracker.read["test.tar.gz"] != size || !tracker.closed["test.tar.gz"] {
+		t.Fatalf("bad progress: %#v %#v %#v", tracker.totals, tracker.read, tracker.closed)
+	}
+}
+
+func TestPostProcessor_Cancel(t *testing.T) {
+	var p PostProcessor
+	output := filepath.Join(t.TempDir(), "test.zip")
+	if err := p.Configure(map[string]interface{}{"output": output}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, _, err := p.PostProcess(ctx, testUi(), testArtifact(t)); err == nil {
+		t.Fatal("should error")
+	}
+
+	// The partial archive is removed
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatalf("the archive should be removed: %v", err)
+	}
+}
+
+func TestPostProcessor_Force(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "test.zip")
+	if err := os.WriteFile(output, []byte("old"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var p PostProcessor
+	if err := p.Configure(map[string]interface{}{"output": output}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, _, _, err := p.PostProcess(context.Background(), testUi(), testArtifact(t)); err == nil {
+		t.Fatal("should error")
+	}
+
+	for _, cfg := range []map[string]interface{}{
+		{"output": output, "force": true},
+		{"output": output, "packer_force": true},
+	} {
+		if err := os.WriteFile(output, []byte("old"), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		testPostProcess(t, cfg)
+		if files := readArchive(t, output, formatZip); len(files) != 2 {
+			t.Fatalf("bad archive with %#v: %#v", cfg, files)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"1024":   1024,
+		"512MiB": 512 << 20,
+		"2G":     2 << 30,
+		"100 MB": 100e6,
+		"3KB":    3000,
+		"7B":     7,
+	} {
+		if size, err := parseSize(s); err != nil || size != expected {
+			t.Fatalf("bad size of %q: %d %v", s, size, err)
+		}
+	}
+	for _, s := range []string{"", "MiB", "-1K", "1.5G", "12PB"} {
+		if _, err := parseSize(s); err == nil {
+			t.Fatalf("should error: %q", s)
+		}
+	}
+}
+
+func TestWithExtension(t *testing.T) {
+	if path, err := withExtension("box.tar.gz", formatTarGz); err != nil || path != "box.tar.gz" {
+		t.Fatalf("bad: %s %v", path, err)
+	}
+	if path, err := withExtension("box.v1", formatZip); err != nil || path != "box.v1.zip" {
+		t.Fatalf("bad: %s %v", path, err)
+	}
+	if _, err := withExtension("box.zip", formatTarGz); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestPostProcessor_RemoteArtifact(t *testing.T) {
+	var p PostProcessor
+	output := filepath.Join(t.TempDir(), "test.zip")
+	if err := p.Configure(map[string]interface{}{"output": output}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// The files are on the UTM host, not here
+	source := testArtifact(t)
+	source.StateValues = map[string]interface{}{"utm_host": "mac.example.com"}
+	_, _, _, err := p.PostProcess(context.Background(), testUi(), source)
+	if err == nil || !strings.Contains(err.Error(), "mac.example.com") {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatalf("should not exist: %s", output)
+	}
+}
@@ -0,0 +1,67 @@
+package zip
+
+import (
+	"context"
+	"io"
+)
+
+// The number of bytes between two progress updates, each of which is
+// a call to Packer when the plugin runs under it.
+const progressStep = 1 << 20
+
+// progressWriter reports the bytes written to it to a progress bar of
+// the UI.
+type progressWriter struct {
+	// The stream the UI tracks, which reads give the progress of
+	tracker io.ReadCloser
+	pending int
+	buf     []byte
+}
+
+func newProgressWriter(track func(stream io.ReadCloser) io.ReadCloser) *progressWriter {
+	return &progressWriter{
+		tracker: track(zeroStream{}),
+		buf:     make([]byte, progressStep),
+	}
+}
+
+func (p *progressWriter) Write(data []byte) (int, error) {
+	p.pending += len(data)
+	if p.pending >= progressStep {
+		p.flush()
+	}
+	return len(data), nil
+}
+
+func (p *progressWriter) flush() {
+	for p.pending > 0 {
+		n, _ := p.tracker.Read(p.buf[:min(p.pending, len(p.buf))])
+		p.pending -= n
+	}
+}
+
+// Close reports the last bytes and closes the progress bar.
+func (p *progressWriter) Close() error {
+	p.flush()
+	return p.tracker.Close()
+}
+
+// zeroStream is the stream under a progress bar, the data itself is
+// not read through it.
+type zeroStream struct{}
+
+func (zeroStream) Read(b []byte) (int, error) { return len(b), nil }
+func (zeroStream) Close() error               { return nil }
+
+// contextReader fails the reads once ctx is done, to stop archiving.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(b)
+}
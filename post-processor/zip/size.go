@@ -0,0 +1,42 @@
+package zip
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The size suffixes, with the decimal units next to the binary ones.
+var sizeUnits = []struct {
+	Suffix string
+	Factor int64
+}{
+	// Longest first, so KiB is not taken for B
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// parseSize parses a size in bytes like "512MiB", "2G" or "100MB". The
+// single letter suffixes are binary, like the ones of dd and qemu-img.
+func parseSize(s string) (int64, error) {
+	number := strings.TrimSpace(s)
+	factor := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(number, unit.Suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, unit.Suffix))
+			factor = unit.Factor
+			break
+		}
+	}
+
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected a number of bytes with an optional unit like 512MiB", s)
+	}
+	if value > (1<<63-1)/factor {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return value * factor, nil
+}
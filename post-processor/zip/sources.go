@@ -0,0 +1,97 @@
+package zip
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// archiveSource is a file or a directory to archive.
+type archiveSource struct {
+	// The path on disk
+	Path string
+	// The slash separated name in the archive
+	Name string
+	// Whether it is a UTM bundle
+	Bundle bool
+}
+
+// BundleName returns the name of the UTM bundle without its extension.
+func (s archiveSource) BundleName() string {
+	return strings.TrimSuffix(s.Name, ".utm")
+}
+
+// bundlePath returns the UTM bundle a file is in or is, or "" when it
+// is not part of one.
+func bundlePath(file string) string {
+	slashed := filepath.ToSlash(file)
+	if idx := strings.Index(slashed, ".utm/"); idx != -1 {
+		return file[:idx+len(".utm")]
+	}
+	if strings.HasSuffix(slashed, ".utm") {
+		return file
+	}
+	return ""
+}
+
+// findSources returns what to archive of the files of an artifact. The
+// UTM bundles the files are in are archived, in the order of the files,
+// and nothing else: the files the builder wrote next to them are left
+// out. The files of artifacts without bundles, like the ones of other
+// builders, are archived as they are, named relative to their common
+// directory.
+func findSources(files []string) ([]archiveSource, error) {
+	if len(files) == 0 {
+		return nil, errors.New("the artifact has no files to archive")
+	}
+
+	var bundles []archiveSource
+	seen := map[string]bool{}
+	for _, file := range files {
+		bundle := bundlePath(file)
+		if bundle == "" || seen[bundle] {
+			continue
+		}
+		seen[bundle] = true
+		bundles = append(bundles, archiveSource{Path: bundle, Name: filepath.Base(bundle), Bundle: true})
+	}
+	if len(bundles) > 0 {
+		return bundles, nil
+	}
+
+	dir := commonDir(files)
+	var sources []archiveSource
+	for _, file := range files {
+		if _, err := os.Lstat(file); err != nil {
+			return nil, fmt.Errorf("artifact file %s can't be archived: %s", file, err)
+		}
+		name, err := filepath.Rel(dir, file)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, archiveSource{Path: file, Name: filepath.ToSlash(name)})
+	}
+	return sources, nil
+}
+
+// commonDir returns the deepest directory holding all the files.
+func commonDir(files []string) string {
+	dir := filepath.Dir(filepath.Clean(files[0]))
+	for _, file := range files[1:] {
+		fileDir := filepath.Dir(filepath.Clean(file))
+		for {
+			rel, err := filepath.Rel(dir, fileDir)
+			if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				break
+			}
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+	}
+	return dir
+}
@@ -0,0 +1,133 @@
+package zip
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// joinManifest tells how to put the parts of an archive back together:
+// concatenating them in order gives the archive.
+type joinManifest struct {
+	Archive manifestFile   `json:"archive"`
+	Parts   []manifestFile `json:"parts"`
+}
+
+// partPath returns the path of the part number n, from 1, of the
+// archive path.
+func partPath(path string, n int) string {
+	return fmt.Sprintf("%s.part%02d", path, n)
+}
+
+// existingParts returns the parts of the archive path which exist and
+// the files written next to them, whatever their number, such as the
+// parts of an earlier larger archive.
+func existingParts(path string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []string
+	prefix := filepath.Base(path) + ".part"
+	for _, entry := range entries {
+		n, ok := strings.CutPrefix(entry.Name(), prefix)
+		rest := strings.TrimLeft(n, "0123456789")
+		if ok && rest != n && (rest == "" || rest[0] == '.') {
+			parts = append(parts, filepath.Join(filepath.Dir(path), entry.Name()))
+		}
+	}
+	return parts, nil
+}
+
+// splitWriter writes an archive in parts of at most size bytes, the
+// parts of path, and hashes every part.
+type splitWriter struct {
+	path  string
+	size  int64
+	types []string
+
+	file    *os.File
+	written int64
+	hashes  *hashes
+
+	// The parts written so far, named after their path
+	Paths []string
+	Parts []manifestFile
+}
+
+func newSplitWriter(path string, size int64, types []string) *splitWriter {
+	return &splitWriter{path: path, size: size, types: types}
+}
+
+func (w *splitWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		if w.file == nil || w.written == w.size {
+			if err := w.next(); err != nil {
+				return written, err
+			}
+		}
+
+		chunk := data[:min(int64(len(data)), w.size-w.written)]
+		n, err := w.file.Write(chunk)
+		w.hashes.Write(chunk[:n])
+		w.written += int64(n)
+		written += n
+		data = data[n:]
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// next closes the current part and starts the next one. Parts are only
+// started when there is data for them, so there is no empty last part.
+func (w *splitWriter) next() error {
+	if err := w.closePart(); err != nil {
+		return err
+	}
+
+	path := partPath(w.path, len(w.Paths)+1)
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.written = 0
+	w.hashes = newHashes(w.types)
+	w.Paths = append(w.Paths, path)
+	return nil
+}
+
+func (w *splitWriter) closePart() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	w.Parts = append(w.Parts, manifestFile{
+		Name:    filepath.Base(w.Paths[len(w.Paths)-1]),
+		Size:    w.written,
+		Digests: w.hashes.Digests(),
+	})
+	return err
+}
+
+// Close closes the last part.
+func (w *splitWriter) Close() error {
+	return w.closePart()
+}
+
+// Remove removes the parts written so far.
+func (w *splitWriter) Remove() {
+	w.Close()
+	for _, path := range w.Paths {
+		os.Remove(path)
+	}
+}
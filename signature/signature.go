@@ -0,0 +1,270 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+// Package signature makes and checks the detached signatures of the
+// artifacts of the plugin. They are SSH signatures, the ones of
+// `ssh-keygen -Y sign`, so ssh-keygen checks them as well:
+//
+//	ssh-keygen -Y verify -f allowed_signers -I builds -n file -s box.zip.sig < box.zip
+package signature
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Namespace is the namespace of the signatures, the one ssh-keygen
+// uses for files.
+const Namespace = "file"
+
+// Extension is the extension of the signature files, added to the
+// name of the file they sign.
+const Extension = ".sig"
+
+const (
+	magic         = "SSHSIG"
+	sigVersion    = 1
+	hashAlgorithm = "sha512"
+	armorBegin    = "-----BEGIN SSH SIGNATURE-----"
+	armorEnd      = "-----END SSH SIGNATURE-----"
+)
+
+// The signature blob, after the magic preamble.
+type wireSignature struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// What is signed, after the magic preamble.
+type signedData struct {
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+func messageToSign(digest []byte) []byte {
+	return append([]byte(magic), ssh.Marshal(&signedData{
+		Namespace:     Namespace,
+		HashAlgorithm: hashAlgorithm,
+		Hash:          digest,
+	})...)
+}
+
+// Signer makes detached signatures with a private key.
+type Signer struct {
+	signer ssh.Signer
+}
+
+// LoadSigner reads the private key at path: an OpenSSH key, ed25519 or
+// any other type, or a PEM key like the ones of openssl. The
+// passphrase decrypts encrypted keys.
+func LoadSigner(path string, passphrase string) (*Signer, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, fmt.Errorf("the key %s is encrypted, a passphrase is required", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing key %s: %s", path, err)
+	}
+	return &Signer{signer: signer}, nil
+}
+
+// PublicKey returns the public key that checks the signatures.
+func (s *Signer) PublicKey() ssh.PublicKey {
+	return s.signer.PublicKey()
+}
+
+// Sign returns the signature of the data read from r.
+func (s *Signer) Sign(r io.Reader) ([]byte, error) {
+	h := sha512.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return s.SignDigest(h.Sum(nil))
+}
+
+// SignDigest returns the signature of the data with the SHA-512 digest,
+// for data hashed on the way somewhere else.
+func (s *Signer) SignDigest(digest []byte) ([]byte, error) {
+	message := messageToSign(digest)
+
+	var sig *ssh.Signature
+	var err error
+	// SSH signatures of RSA keys use SHA-512, not the SHA-1 of ssh-rsa
+	if algorithmSigner, ok := s.signer.(ssh.AlgorithmSigner); ok && s.signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		sig, err = algorithmSigner.SignWithAlgorithm(rand.Reader, message, ssh.KeyAlgoRSASHA512)
+	} else {
+		sig, err = s.signer.Sign(rand.Reader, message)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	blob := append([]byte(magic), ssh.Marshal(&wireSignature{
+		Version:       sigVersion,
+		PublicKey:     s.signer.PublicKey().Marshal(),
+		Namespace:     Namespace,
+		HashAlgorithm: hashAlgorithm,
+		Signature:     ssh.Marshal(sig),
+	})...)
+	return armor(blob), nil
+}
+
+// SignFile writes the signature of the file at path next to it, and
+// returns the path to the signature.
+func (s *Signer) SignFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	sig, err := s.Sign(file)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path+Extension, sig, 0644); err != nil {
+		return "", err
+	}
+	return path + Extension, nil
+}
+
+// LoadPublicKey reads the public key at path: in the authorized_keys
+// format of the .pub files of OpenSSH, or a PEM key like the ones of
+// openssl.
+func LoadPublicKey(path string) (ssh.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing key %s: %s", path, err)
+		}
+		return ssh.NewPublicKey(key)
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing key %s: %s", path, err)
+	}
+	return key, nil
+}
+
+// Verify checks that signature is a signature by key of the data read
+// from r.
+func Verify(key ssh.PublicKey, r io.Reader, signature []byte) error {
+	blob, err := unarmor(signature)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(blob, []byte(magic)) {
+		return errors.New("not an SSH signature")
+	}
+	var wire wireSignature
+	if err := ssh.Unmarshal(blob[len(magic):], &wire); err != nil {
+		return fmt.Errorf("error parsing signature: %s", err)
+	}
+	if wire.Version != sigVersion {
+		return fmt.Errorf("unsupported signature version %d", wire.Version)
+	}
+	if wire.Namespace != Namespace {
+		return fmt.Errorf("the signature is for %q, not %q", wire.Namespace, Namespace)
+	}
+	if !bytes.Equal(wire.PublicKey, key.Marshal()) {
+		return errors.New("the signature was made with another key")
+	}
+	if wire.HashAlgorithm != hashAlgorithm {
+		return fmt.Errorf("unsupported signature hash %s", wire.HashAlgorithm)
+	}
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(wire.Signature, &sig); err != nil {
+		return fmt.Errorf("error parsing signature: %s", err)
+	}
+	if sig.Format == ssh.KeyAlgoRSA {
+		return errors.New("ssh-rsa signatures use SHA-1, which is not supported")
+	}
+
+	h := sha512.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	if err := key.Verify(messageToSign(h.Sum(nil)), &sig); err != nil {
+		return errors.New("the signature does not match the data")
+	}
+	return nil
+}
+
+// VerifyFile checks the signature next to the file at path, the one
+// SignFile writes.
+func VerifyFile(key ssh.PublicKey, path string) error {
+	signature, err := os.ReadFile(path + Extension)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := Verify(key, file, signature); err != nil {
+		return fmt.Errorf("bad signature of %s: %s", path, err)
+	}
+	return nil
+}
+
+// armor wraps a signature in the text format of ssh-keygen.
+func armor(blob []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(blob)
+	var b strings.Builder
+	b.WriteString(armorBegin + "\n")
+	for len(encoded) > 70 {
+		b.WriteString(encoded[:70] + "\n")
+		encoded = encoded[70:]
+	}
+	b.WriteString(encoded + "\n" + armorEnd + "\n")
+	return []byte(b.String())
+}
+
+func unarmor(signature []byte) ([]byte, error) {
+	text := strings.TrimSpace(string(signature))
+	if !strings.HasPrefix(text, armorBegin) || !strings.HasSuffix(text, armorEnd) {
+		return nil, errors.New("not an SSH signature")
+	}
+	text = strings.TrimSuffix(strings.TrimPrefix(text, armorBegin), armorEnd)
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding signature: %s", err)
+	}
+	return blob, nil
+}
@@ -0,0 +1,203 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package signature
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testKey writes the private key in the OpenSSH format and its public
+// key in the authorized_keys format, and returns their paths.
+func testKey(t *testing.T, key interface{}, passphrase string) (string, string) {
+	var block *pem.Block
+	var err error
+	if passphrase != "" {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte(passphrase))
+	} else {
+		block, err = ssh.MarshalPrivateKey(key, "")
+	}
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dir := t.TempDir()
+	private, public := filepath.Join(dir, "key"), filepath.Join(dir, "key.pub")
+	if err := os.WriteFile(private, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.WriteFile(public, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return private, public
+}
+
+func testEd25519Key(t *testing.T) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return key
+}
+
+func TestSignVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for name, key := range map[string]interface{}{
+		"ed25519": testEd25519Key(t),
+		"rsa":     rsaKey,
+	} {
+		t.Run(name, func(t *testing.T) {
+			private, public := testKey(t, key, "")
+			signer, err := LoadSigner(private, "")
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			publicKey, err := LoadPublicKey(public)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			path := filepath.Join(t.TempDir(), "box.zip")
+			if err := os.WriteFile(path, []byte("box"), 0644); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			sigPath, err := signer.SignFile(path)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if sigPath != path+".sig" {
+				t.Fatalf("bad signature path: %s", sigPath)
+			}
+			if err := VerifyFile(publicKey, path); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+
+			// Other data
+			sig, err := os.ReadFile(sigPath)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if err := Verify(publicKey, strings.NewReader("other box"), sig); err == nil {
+				t.Fatal("should not verify other data")
+			}
+
+			// Another key
+			other, err := ssh.NewSignerFromKey(testEd25519Key(t))
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if err := Verify(other.PublicKey(), strings.NewReader("box"), sig); err == nil {
+				t.Fatal("should not verify with another key")
+			}
+		})
+	}
+}
+
+func TestLoadSigner_Passphrase(t *testing.T) {
+	private, _ := testKey(t, testEd25519Key(t), "secret")
+	if _, err := LoadSigner(private, ""); err == nil || !strings.Contains(err.Error(), "passphrase") {
+		t.Fatalf("should require a passphrase: %v", err)
+	}
+	if _, err := LoadSigner(private, "wrong"); err == nil {
+		t.Fatal("should error")
+	}
+	if _, err := LoadSigner(private, "secret"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestLoadKeys_PEM(t *testing.T) {
+	key := testEd25519Key(t)
+	private, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	dir := t.TempDir()
+	privatePath, publicPath := filepath.Join(dir, "key.pem"), filepath.Join(dir, "key.pub.pem")
+	if err := os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private}), 0600); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	signer, err := LoadSigner(privatePath, "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	publicKey, err := LoadPublicKey(publicPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	sig, err := signer.Sign(strings.NewReader("box"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := Verify(publicKey, strings.NewReader("box"), sig); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestSSHKeygen(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+
+	private, public := testKey(t, testEd25519Key(t), "")
+	publicKey, err := LoadPublicKey(public)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	path := filepath.Join(t.TempDir(), "box.zip")
+	if err := os.WriteFile(path, []byte("box"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// ssh-keygen checks our signatures
+	signer, err := LoadSigner(private, "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	sigPath, err := signer.SignFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cmd := exec.Command("ssh-keygen", "-Y", "check-novalidate", "-n", Namespace, "-s", sigPath)
+	cmd.Stdin = bytes.NewReader([]byte("box"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("ssh-keygen does not verify the signature: %s\n%s", err, out)
+	}
+
+	// We check the signatures of ssh-keygen
+	os.Remove(sigPath)
+	if out, err := exec.Command("ssh-keygen", "-Y", "sign", "-n", Namespace, "-f", private, path).CombinedOutput(); err != nil {
+		t.Fatalf("err: %s\n%s", err, out)
+	}
+	if err := VerifyFile(publicKey, path); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}